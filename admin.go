@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+)
+
+// Control and debug endpoints of the admin port. They are served on
+// adminAddress only, never next to /metrics and the API on the public port,
+// and require the adminToken as bearer token:
+//
+//	GET      /admin/config     the running config, secrets redacted
+//	GET/PUT  /admin/loglevel   the level of the root logger, e.g. DEBUG
+//	POST     /admin/inject     gateway lines, one per line, decoded as if
+//	                           received from a gateway (?site= attributes them)
+//	GET      /debug/pprof/     the Go profiler and runtime stats, see debug.go
+//
+// besides backup, restore, corpus, the inverter registry and replacements.
+// adminAllow restricts the admin port to a comma separated list of
+// addresses and networks, e.g. 127.0.0.1,::1 for local access only.
+
+// secretKeys are the config keys /admin/config doesn't show.
+var secretKeys = map[string]bool{
+	"password": true, "commandToken": true, "adminToken": true, "peerToken": true,
+	"forecastApiKey": true, "grafanaApiKey": true, "s3AccessKey": true, "s3SecretKey": true,
+	"remoteWritePassword": true, "privacySalt": true, "metricsPassword": true, "metricsToken": true, "mqttBrokers": true, "mqttHeaders": true,
+}
+
+// injectInput is the input of the lines posted to /admin/inject.
+type injectInput struct{}
+
+func (injectInput) name() string                  { return "inject" }
+func (injectInput) kind() string                  { return "admin" }
+func (injectInput) run(deliver lineHandler) error { return nil }
+
+var (
+	injectOnce    sync.Once
+	injectDeliver lineHandler
+)
+
+func init() {
+	adminMux.HandleFunc("/admin/config", requireAdminToken(serveConfig))
+	adminMux.HandleFunc("/admin/loglevel", requireAdminToken(serveLogLevel))
+	adminMux.HandleFunc("/admin/inject", requireAdminToken(serveInject))
+}
+
+// allowOnly serves handler to the clients of allow, all if it's empty.
+func allowOnly(allow []*net.IPNet, handler http.Handler) http.Handler {
+	if len(allow) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(gatewayHost(r.RemoteAddr))
+		for _, n := range allow {
+			if ip != nil && n.Contains(ip) {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+}
+
+// redactedConfig returns the running config by key, without the secrets.
+func redactedConfig() map[string]interface{} {
+	out := map[string]interface{}{}
+	v := reflect.ValueOf(*currentConfig())
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("yaml")
+		if key == "" {
+			continue
+		}
+		value := v.Field(i).Interface()
+		switch {
+		case secretKeys[key]:
+			if !v.Field(i).IsZero() {
+				value = "<redacted>"
+			}
+		case v.Field(i).Type() == reflect.TypeOf(time.Duration(0)):
+			value = value.(time.Duration).String()
+		}
+		out[key] = value
+	}
+	return out
+}
+
+func serveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(redactedConfig())
+}
+
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		value := r.URL.Query().Get("level")
+		if value == "" {
+			body, _ := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64))
+			value = strings.TrimSpace(string(body))
+		}
+		result, err := commandLogLevel(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		emitEvent(event{Kind: "admin_command", Severity: severityInfo, Message: result})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": loggo.GetLogger("").LogLevel().String()})
+}
+
+func serveInject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	siteName := r.URL.Query().Get("site")
+	if siteName != "" {
+		if _, ok := siteByName(siteName); !ok {
+			http.Error(w, "unknown site "+siteName, http.StatusNotFound)
+			return
+		}
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, ingestMaxBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	received := time.Now()
+	injectOnce.Do(func() { injectDeliver = inputDeliverer(injectInput{}) })
+
+	gateway, lines := gatewayHost(r.RemoteAddr), 0
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Split(scanGatewayLines)
+	for scanner.Scan() {
+		if message := scanner.Text(); message != "" {
+			injectDeliver(message, gateway, lineSite(siteName, gateway), received)
+			lines++
+		}
+	}
+	emitEvent(event{Kind: "admin_command", Severity: severityInfo, Site: siteName,
+		Message: fmt.Sprintf("%d lines injected by %s", lines, gateway)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"lines": lines})
+}
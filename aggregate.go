@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Per-site and per-group (array) totals: AC and DC power and average
+// temperature of the online inverters, so offline ones with stale values
+// don't count, and the energy produced today. They are part of /metrics,
+// saving sum() over dozens of series, and the only content of a second
+// endpoint (aggregatePath, default /metrics/aggregate on the metrics port)
+// for federation into a central Prometheus that shouldn't ingest a series
+// per micro inverter from dozens of sites. That one has a registry of its
+// own, so none of the per-inverter series leak into it.
+
+type aggregateCollector struct{}
+
+var (
+	aggSitePower = prometheus.NewDesc("enecsys_site_ac_power",
+		"AC power of the online inverters of the site.", []string{"site"}, nil)
+	aggSiteDCPower = prometheus.NewDesc("enecsys_site_dc_power",
+		"DC power of the online inverters of the site.", []string{"site"}, nil)
+	aggSiteTemperature = prometheus.NewDesc("enecsys_site_temperature_average",
+		"Average temperature of the online inverters of the site.", []string{"site"}, nil)
+	aggSiteToday = prometheus.NewDesc("enecsys_site_watthours_today",
+		"Energy produced by the site today.", []string{"site"}, nil)
+	aggSiteOnline = prometheus.NewDesc("enecsys_site_inverters_online",
+		"Inverters of the site currently reporting.", []string{"site"}, nil)
+	aggSiteKnown = prometheus.NewDesc("enecsys_site_inverters",
+		"Inverters of the site seen since the start.", []string{"site"}, nil)
+	aggGroupPower = prometheus.NewDesc("enecsys_group_ac_power",
+		"AC power of the online inverters of the group (array).", []string{"site", "group"}, nil)
+	aggGroupToday = prometheus.NewDesc("enecsys_group_watthours_today",
+		"Energy produced by the group (array) today.", []string{"site", "group"}, nil)
+)
+
+func (aggregateCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{aggSitePower, aggSiteDCPower, aggSiteTemperature, aggSiteToday, aggSiteOnline, aggSiteKnown,
+		aggGroupPower, aggGroupToday} {
+		ch <- d
+	}
+}
+
+func (aggregateCollector) Collect(ch chan<- prometheus.Metric) {
+	type group struct{ site, name string }
+	power := map[string]float64{}
+	dcPower := map[string]float64{}
+	onlineCount := map[string]float64{}
+	temperature := map[string]float64{}
+	temperatureCount := map[string]float64{}
+	groupPower := map[group]float64{}
+	for _, r := range currentReadings() {
+		power[r.Site] += r.ACPower
+		dcPower[r.Site] += r.DCPower
+		onlineCount[r.Site]++
+		if r.valid("temperature") {
+			temperature[r.Site] += r.Temperature
+			temperatureCount[r.Site]++
+		}
+		if array := inverter(r.ID).Array; array != "" {
+			groupPower[group{r.Site, array}] += r.ACPower
+		}
+	}
+
+	known := map[string]float64{}
+	for _, id := range knownInverters() {
+		known[inverterSite(id)]++
+	}
+
+	dayMu.Lock()
+	todayWh := make(map[string]float64, len(today.Inverters))
+	for id, wh := range today.Inverters {
+		todayWh[id] = wh
+	}
+	dayMu.Unlock()
+	siteToday := map[string]float64{}
+	groupToday := map[group]float64{}
+	for id, wh := range todayWh {
+		siteName := inverterSite(id)
+		siteToday[siteName] += wh
+		if array := inverter(id).Array; array != "" {
+			groupToday[group{siteName, array}] += wh
+		}
+	}
+
+	for g := range groupPower {
+		groupToday[g] += 0
+	}
+
+	for siteName, n := range known {
+		ch <- prometheus.MustNewConstMetric(aggSitePower, prometheus.GaugeValue, power[siteName], siteName)
+		ch <- prometheus.MustNewConstMetric(aggSiteDCPower, prometheus.GaugeValue, dcPower[siteName], siteName)
+		if n := temperatureCount[siteName]; n > 0 {
+			ch <- prometheus.MustNewConstMetric(aggSiteTemperature, prometheus.GaugeValue, temperature[siteName]/n, siteName)
+		}
+		ch <- prometheus.MustNewConstMetric(aggSiteToday, prometheus.GaugeValue, siteToday[siteName], siteName)
+		ch <- prometheus.MustNewConstMetric(aggSiteOnline, prometheus.GaugeValue, onlineCount[siteName], siteName)
+		ch <- prometheus.MustNewConstMetric(aggSiteKnown, prometheus.GaugeValue, n, siteName)
+	}
+	for g, wh := range groupToday {
+		ch <- prometheus.MustNewConstMetric(aggGroupPower, prometheus.GaugeValue, groupPower[g], g.site, g.name)
+		ch <- prometheus.MustNewConstMetric(aggGroupToday, prometheus.GaugeValue, wh, g.site, g.name)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(aggregateCollector{})
+}
+
+// startAggregate serves the aggregate endpoint.
+func startAggregate() {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(aggregateCollector{})
+	publicMux.Handle(currentConfig().AggregatePath,
+		requireMetricsAuth(promhttp.HandlerFor(renamingGatherer(registry), promhttp.HandlerOpts{})))
+}
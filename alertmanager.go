@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alertmanager forwarding: with alertmanagerUrl set, events of at least
+// alertmanagerMinSeverity (default warning) are posted to Alertmanager's
+// v2 API as alerts, labelled with alertname (the event kind), severity,
+// site and inverter, with the message as summary annotation. Events that
+// end a condition (e.g. gateway_up after gateway_down) resolve its alert,
+// and firing alerts are re-sent every minute so Alertmanager keeps them
+// active. Alerts of one-off events, like a new inverter, expire after an
+// hour.
+
+// alertResolutions maps the events ending a condition to the event starting
+// it.
+var alertResolutions = map[string]string{
+	"inverter_online":          "inverter_offline",
+	"gateway_up":               "gateway_down",
+	"gateway_clock_ok":         "gateway_clock_skew",
+	"decode_errors_recovered":  "decode_error_burst",
+	"thermal_derating_cleared": "thermal_derating",
+}
+
+// alertConditions are the events starting a condition that is resolved by
+// a later event.
+var alertConditions = map[string]bool{}
+
+func init() {
+	for _, condition := range alertResolutions {
+		alertConditions[condition] = true
+	}
+}
+
+type alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      *time.Time        `json:"endsAt,omitempty"`
+}
+
+var (
+	alertsMu     sync.Mutex
+	firing       = map[string]alert{}
+	alertsClient = &http.Client{Timeout: 10 * time.Second}
+	resendOnce   sync.Once
+)
+
+func alertKey(kind, siteName, inverter string) string {
+	return kind + "/" + siteName + "/" + inverter
+}
+
+// forwardAlert turns e into an alert, or resolves the alert e ends.
+func forwardAlert(e event) {
+	cfg := currentConfig()
+	if cfg.AlertmanagerURL == "" {
+		return
+	}
+	resendOnce.Do(func() { go resendAlerts() })
+
+	if condition, ok := alertResolutions[e.Kind]; ok {
+		key := alertKey(condition, e.Site, e.Inverter)
+		alertsMu.Lock()
+		a, ok := firing[key]
+		delete(firing, key)
+		alertsMu.Unlock()
+		if ok {
+			a.EndsAt = &e.Time
+			postAlerts([]alert{a})
+		}
+		return
+	}
+	if severityRank[e.Severity] < severityRank[cfg.AlertmanagerMinSeverity] || silenced(e) {
+		return
+	}
+
+	labels := map[string]string{"alertname": e.Kind, "severity": e.Severity, "job": "enecsys-exporter"}
+	if e.Site != "" {
+		labels["site"] = e.Site
+	}
+	if e.Inverter != "" {
+		labels["inverter"] = e.Inverter
+	}
+	a := alert{Labels: labels, Annotations: map[string]string{"summary": e.Message}, StartsAt: e.Time}
+	if !alertConditions[e.Kind] {
+		expires := e.Time.Add(time.Hour)
+		a.EndsAt = &expires
+	} else {
+		alertsMu.Lock()
+		firing[alertKey(e.Kind, e.Site, e.Inverter)] = a
+		alertsMu.Unlock()
+	}
+	postAlerts([]alert{a})
+}
+
+// resendAlerts re-sends the firing alerts every minute. It never returns.
+func resendAlerts() {
+	for range time.Tick(time.Minute) {
+		alertsMu.Lock()
+		alerts := make([]alert, 0, len(firing))
+		for _, a := range firing {
+			alerts = append(alerts, a)
+		}
+		alertsMu.Unlock()
+		if len(alerts) > 0 {
+			postAlerts(alerts)
+		}
+	}
+}
+
+func postAlerts(alerts []alert) {
+	payload, err := json.Marshal(alerts)
+	if err != nil {
+		logger.Errorf("Couldn't encode alerts: %s", err)
+		return
+	}
+	url := strings.TrimRight(currentConfig().AlertmanagerURL, "/") + "/api/v2/alerts"
+	resp, err := alertsClient.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		logger.Errorf("Forwarding alerts to %s failed: %s", url, err)
+		reportHealth("alertmanager", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logger.Errorf("Forwarding alerts to %s failed: %s", url, resp.Status)
+		err = fmt.Errorf("%s", resp.Status)
+	}
+	reportHealth("alertmanager", err)
+}
+
+// checkSeverity returns an error unless severity is a known severity.
+func checkSeverity(severity string) error {
+	if _, ok := severityRank[severity]; !ok {
+		return fmt.Errorf("unknown severity %q", severity)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Archival to S3-compatible object storage, so the SD card isn't the only
+// copy of years of production data. Every archiveInterval (default 6h) the
+// compressed raw captures and gzipped history files of finished days are
+// uploaded to <s3Prefix>raw/<day>.log.gz and <s3Prefix>history/<day>.csv.gz,
+// unless already present. Archived days older than s3RetentionDays are deleted
+// from the bucket.
+//
+//	s3Endpoint: https://s3.eu-central-1.amazonaws.com
+//	s3Region: eu-central-1
+//	s3Bucket: my-solar-archive
+//	s3AccessKey: AKIA...
+//	s3SecretKey: ...
+//	s3Prefix: enecsys/
+//	s3RetentionDays: "3650"
+
+type archiveSource struct {
+	dir, kind, ext string
+	compressed     bool
+}
+
+func startArchive() {
+	cfg := currentConfig()
+	bucket := cfg.S3Bucket
+	if bucket == "" {
+		return
+	}
+	client := &s3Client{
+		endpoint:  cfg.S3Endpoint,
+		region:    cfg.S3Region,
+		bucket:    bucket,
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+		http:      &http.Client{Timeout: 5 * time.Minute},
+	}
+	interval := cfg.ArchiveInterval
+
+	go func() {
+		for {
+			err := archiveOnce(client, time.Now())
+			if err != nil {
+				logger.Errorf("Archival failed: %s", err)
+			}
+			reportHealth("archive", err)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func archiveSources() []archiveSource {
+	cfg := currentConfig()
+	var sources []archiveSource
+	if dir := cfg.CaptureDir; dir != "" {
+		sources = append(sources, archiveSource{dir, "raw", ".log.gz", true})
+	}
+	if dir := cfg.HistoryDir; dir != "" {
+		sources = append(sources, archiveSource{dir, "history", ".csv", false})
+	}
+	return sources
+}
+
+// archiveOnce uploads the finished days missing in the bucket and applies
+// the retention.
+func archiveOnce(client *s3Client, now time.Time) error {
+	cfg := currentConfig()
+	prefix := cfg.S3Prefix
+	currentDay := siteDay(now)
+	retain := cfg.S3RetentionDays > 0
+	oldest := siteDay(now.AddDate(0, 0, -cfg.S3RetentionDays))
+
+	for _, source := range archiveSources() {
+		keyPrefix := prefix + source.kind + "/"
+		keys, err := client.list(keyPrefix)
+		if err != nil {
+			return err
+		}
+		archived := map[string]bool{}
+		for _, key := range keys {
+			archived[key] = true
+			day := strings.SplitN(path.Base(key), ".", 2)[0]
+			if retain && day < oldest {
+				if err := client.delete(key); err != nil {
+					return err
+				}
+				fmt.Println("Deleted archived", key)
+			}
+		}
+
+		files, err := filepath.Glob(filepath.Join(source.dir, "????-??-??"+source.ext))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			day := strings.TrimSuffix(filepath.Base(file), source.ext)
+			key := keyPrefix + day + source.ext
+			if !source.compressed {
+				key += ".gz"
+			}
+			if day >= currentDay || archived[key] || (retain && day < oldest) {
+				continue
+			}
+			body, err := ioutil.ReadFile(file)
+			if !source.compressed && err == nil {
+				body, err = gzipData(body)
+			}
+			if err != nil {
+				return err
+			}
+			if err := client.put(key, body); err != nil {
+				return err
+			}
+			fmt.Println("Archived", file, "to", key)
+		}
+	}
+	return nil
+}
+
+func gzipData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Staleness tracker: every decoded frame marks its inverter as seen, and a
+// background loop marks inverters offline once they have been silent for
+// longer than the configured timeout. Transitions are published retained to
+// enecsys/<id>/availability so consumers like Home Assistant can show the
+// entity as unavailable instead of freezing at the last value, and raised
+// as events. The state lives in the state store, see state.go.
+//
+// enecsys_last_report_timestamp_seconds is the time of the latest decoded
+// frame of each inverter, for alerts on silence during daylight, e.g.
+//
+//	time() - enecsys_last_report_timestamp_seconds > 7200 and on() hour() >= 9 < 16
+//
+// It's restored from the state file and outlives seriesExpiry.
+
+const (
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+)
+
+var enecLastReport = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "enecsys_last_report_timestamp_seconds",
+	Help: "Time the latest frame of the inverter was decoded.",
+},
+	[]string{"id", "site"},
+)
+
+// markSeen records a report from inverter id received at now from a
+// gateway of siteName and publishes its metadata and "online" if the
+// inverter was unknown or offline before.
+func markSeen(id string, siteName string, now time.Time) {
+	var known, wasOnline bool
+	updateState(id, func(s *inverterState) {
+		known, wasOnline = !s.FirstSeen.IsZero(), s.Online
+		if !known {
+			s.FirstSeen = now
+		}
+		s.LastSeen, s.Site, s.Online = now, siteName, true
+	})
+
+	if !known {
+		emitEvent(event{Kind: "inverter_new", Severity: severityInfo, Inverter: id, Time: now,
+			Message: fmt.Sprintf("New inverter %s", id)})
+	}
+	if !wasOnline {
+		fmt.Println("Inverter", id, "is online")
+		publishMeta(id)
+		publishMqtt(inverterTopic(id, "availability"), availabilityOnline)
+		emitEvent(event{Kind: "inverter_online", Severity: severityInfo, Inverter: id, Time: now,
+			Message: fmt.Sprintf("Inverter %s is online", id)})
+	}
+}
+
+// inverterSite returns the site of inverter id: the one assigned in the site
+// file, or else the site of the gateway it last reported through.
+func inverterSite(id string) string {
+	if siteName := inverter(id).Site; siteName != "" {
+		return siteName
+	}
+	s, _ := stateOf(id)
+	return s.Site
+}
+
+// expireStale marks every inverter not seen since before the deadline as
+// offline and returns their IDs.
+func expireStale(deadline time.Time) []string {
+	var candidates, expired []string
+	for _, s := range allStates() {
+		if s.Online && s.LastSeen.Before(deadline) {
+			candidates = append(candidates, s.ID)
+		}
+	}
+	for _, id := range candidates {
+		// a reading may have arrived since the states were copied
+		updateState(id, func(s *inverterState) {
+			if s.Online && s.LastSeen.Before(deadline) {
+				s.Online = false
+				expired = append(expired, id)
+			}
+		})
+	}
+	return expired
+}
+
+// watchStaleness periodically publishes "offline" for inverters that
+// haven't reported within timeout. It never returns.
+func watchStaleness(timeout time.Duration) {
+	interval := timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		for _, id := range expireStale(time.Now().Add(-timeout)) {
+			fmt.Println("Inverter", id, "is offline, no report for", timeout)
+			publishMqtt(inverterTopic(id, "availability"), availabilityOffline)
+			emitEvent(event{Kind: "inverter_offline", Severity: severityInfo, Inverter: id,
+				Message: fmt.Sprintf("Inverter %s is offline, no report for %s", id, timeout)})
+		}
+	}
+}
+
+// republishAvailability publishes the metadata and availability of every
+// known inverter again, e.g. after the MQTT client was rebuilt.
+func republishAvailability() {
+	for _, s := range allStates() {
+		if s.LastSeen.IsZero() {
+			continue
+		}
+		publishMeta(s.ID)
+		if s.Online {
+			publishMqtt(inverterTopic(s.ID, "availability"), availabilityOnline)
+		} else {
+			publishMqtt(inverterTopic(s.ID, "availability"), availabilityOffline)
+		}
+	}
+}
+
+func init() {
+	prometheus.MustRegister(enecLastReport)
+	onMqttRepublish(republishAvailability)
+}
+
+// knownInverters returns the IDs of all inverters seen so far.
+func knownInverters() []string {
+	all := allStates()
+	ids := make([]string, 0, len(all))
+	for _, s := range all {
+		if !s.LastSeen.IsZero() {
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids
+}
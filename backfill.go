@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The backfill subcommand replays the history store into a remote_write
+// target with the original timestamps, e.g. to repopulate a Prometheus TSDB
+// rebuilt after a disk failure. Prometheus has to run with the remote write
+// receiver enabled and an out of order window covering the replayed range.
+
+func runBackfill(args []string) int {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	from := flags.String("from", "", "first day to replay (YYYY-MM-DD)")
+	to := flags.String("to", "", "last day to replay (YYYY-MM-DD)")
+	extra := flags.String("labels", "", "labels added to every series, e.g. job=enecsys,instance=pi:5041")
+	user := flags.String("user", "", "basic auth user for the remote_write endpoint")
+	password := flags.String("password", "", "basic auth password for the remote_write endpoint")
+	batch := flags.Int("batch", 10000, "samples per request")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s backfill [flags] /path/to/config_file remote_write_url\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	getCredentials(flags.Arg(0))
+	url := flags.Arg(1)
+
+	dir := currentConfig().HistoryDir
+	if dir == "" {
+		fmt.Println("No historyDir configured, nothing to backfill.")
+		return 1
+	}
+
+	extraLabels, err := parseRemoteWriteLabels(*extra)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	days, err := historyDays(dir, *from, *to)
+	if err != nil {
+		fmt.Println("Couldn't list history:", err)
+		return 1
+	}
+
+	b := backfiller{url: url, user: *user, password: *password, extra: extraLabels, series: map[string]*rwSeries{}}
+	for _, day := range days {
+		err := readHistoryDay(dir, day, func(row historyRow) error {
+			for column, value := range row.Values {
+				name := "enecsys_" + column
+				if column == "daily_reset_wh" {
+					name = "enecsys_daily_reset_previous_watthours"
+				}
+				b.add(namespaced(name), row.ID, row.Site, value, row.Time)
+			}
+			if b.samples >= *batch {
+				return b.flush()
+			}
+			return nil
+		})
+		if err == nil {
+			err = b.flush()
+		}
+		if err != nil {
+			fmt.Printf("Backfill of %s failed: %s\n", day, err)
+			return 1
+		}
+		fmt.Println("Backfilled", day)
+	}
+	fmt.Println("Backfilled", len(days), "days,", b.total, "samples.")
+	return 0
+}
+
+type backfiller struct {
+	url, user, password string
+	extra               []rwLabel
+
+	series  map[string]*rwSeries
+	samples int
+	total   int
+}
+
+func (b *backfiller) add(metric, id, siteName string, value float64, t time.Time) {
+	key := metric + "\xff" + id + "\xff" + siteName
+	s, ok := b.series[key]
+	if !ok {
+		labels := append([]rwLabel{{"__name__", metric}, {"id", id}}, b.extra...)
+		if siteName != "" {
+			labels = append(labels, rwLabel{"site", siteName})
+		}
+		s = &rwSeries{labels: labels}
+		b.series[key] = s
+	}
+	s.samples = append(s.samples, rwSample{value: value, timestamp: t.UnixNano() / int64(time.Millisecond)})
+	b.samples++
+}
+
+// flush sends the collected samples, retrying a few times with backoff.
+func (b *backfiller) flush() error {
+	if b.samples == 0 {
+		return nil
+	}
+	series := make([]rwSeries, 0, len(b.series))
+	for _, s := range b.series {
+		series = append(series, *s)
+	}
+
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err = remoteWrite(b.url, b.user, b.password, series); err == nil {
+			b.total += b.samples
+			b.series = map[string]*rwSeries{}
+			b.samples = 0
+			return nil
+		}
+	}
+	return err
+}
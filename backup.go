@@ -0,0 +1,339 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Backup and restore of everything the exporter persists, for moving it to
+// another host. GET /admin/backup returns a tar.gz with the current state
+// (state.json), the site file (site) and the history, report and capture
+// directories (history/, reports/, capture/). POST /admin/restore takes such
+// an archive of up to maxRestoreSize bytes, writes the parts configured on
+// this host and applies the state and site file immediately. Both require
+// the adminToken as bearer token.
+//
+// The exporter keeps its data in plain files (JSON state, CSV history, log
+// captures), not in a database, so the backup is an archive of these
+// files.
+
+// maxRestoreSize limits the size of an uploaded backup.
+const maxRestoreSize = 1 << 30
+
+type backupDir struct {
+	dir  func() string
+	name string
+}
+
+var backupDirs = []backupDir{
+	{func() string { return currentConfig().HistoryDir }, "history"},
+	{func() string { return currentConfig().ReportDir }, "reports"},
+	{func() string { return currentConfig().CaptureDir }, "capture"},
+}
+
+func init() {
+	adminMux.HandleFunc("/admin/backup", requireAdminToken(serveBackup))
+	adminMux.HandleFunc("/admin/restore", requireAdminToken(serveRestore))
+}
+
+// requireAdminToken rejects requests without the configured adminToken as
+// bearer token. Without adminToken the endpoint is disabled.
+func requireAdminToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := currentConfig().AdminToken
+		if token == "" {
+			http.Error(w, "adminToken not configured", http.StatusForbidden)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func serveBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Build the archive in a temporary file first, so a failure can still be
+	// reported with a status code.
+	tmp, err := ioutil.TempFile("", "enecsys-backup-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := writeBackup(tmp); err != nil {
+		logger.Errorf("Backup failed: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	emitEvent(event{Kind: "admin_backup", Severity: severityInfo,
+		Message: fmt.Sprintf("Backup taken by %s", gatewayHost(r.RemoteAddr))})
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := "enecsys-backup-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	io.Copy(w, tmp)
+}
+
+// backupFile is a file to back up, as far as it was written when the
+// backup was taken.
+type backupFile struct {
+	name, path string
+	size       int64
+	modTime    time.Time
+}
+
+// writeBackup writes a consistent backup. History and capture writes are
+// only held off while they are flushed, the state is taken and the sizes
+// of the files are noted; the files are read afterwards, up to those
+// sizes, as they are only appended to.
+func writeBackup(out io.Writer) error {
+	state, files, err := takeBackup()
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	tw := tar.NewWriter(zw)
+	if err := addBackupEntry(tw, "state.json", state, time.Now()); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := addBackupFile(tw, file); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// takeBackup flushes the writers and returns the encoded state and the
+// files to back up.
+func takeBackup() ([]byte, []backupFile, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	eventLogMu.Lock()
+	defer eventLogMu.Unlock()
+	flushHistory()
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	if captureWriter != nil {
+		captureWriter.Flush()
+	}
+
+	state, err := json.MarshalIndent(takeSnapshot(), "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []backupFile
+	if siteFile := currentConfig().SiteFile; siteFile != "" {
+		info, err := os.Stat(siteFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, backupFile{"site", siteFile, info.Size(), info.ModTime()})
+	}
+	for _, dir := range backupDirs {
+		root := dir.dir()
+		if root == "" {
+			continue
+		}
+		infos, err := ioutil.ReadDir(root)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				files = append(files, backupFile{dir.name + "/" + info.Name(), filepath.Join(root, info.Name()), info.Size(), info.ModTime()})
+			}
+		}
+	}
+	return state, files, nil
+}
+
+func addBackupEntry(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// addBackupFile adds file as it was when the backup was taken. A capture
+// compressed since is left out, its .gz wasn't there yet.
+func addBackupFile(tw *tar.Writer, file backupFile) error {
+	f, err := os.Open(file.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, file.size))
+	if err != nil {
+		return err
+	}
+	return addBackupEntry(tw, file.name, data, file.modTime)
+}
+
+type restoreResult struct {
+	Restored []string `json:"restored"`
+	Skipped  []string `json:"skipped,omitempty"`
+}
+
+func serveRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := restoreBackup(http.MaxBytesReader(w, r.Body, maxRestoreSize))
+	if err != nil {
+		logger.Errorf("Restore failed: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Println("Restored", len(result.Restored), "files from backup")
+	emitEvent(event{Kind: "admin_restore", Severity: severityWarning,
+		Message: fmt.Sprintf("%d files restored from a backup by %s", len(result.Restored), gatewayHost(r.RemoteAddr))})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// restoreBackup unpacks a backup written by writeBackup. Entries whose
+// destination isn't configured on this host are skipped.
+func restoreBackup(in io.Reader) (*restoreResult, error) {
+	cfg := currentConfig()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	result := &restoreResult{}
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	closeHistory()
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	closeCapture()
+
+	var state []byte
+	siteRestored := false
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return result, err
+		}
+
+		dest := restoreDestination(header.Name)
+		if header.Name == "state.json" {
+			state = data
+			dest = cfg.StateFile
+		}
+		if dest == "" {
+			if header.Name != "state.json" {
+				result.Skipped = append(result.Skipped, header.Name)
+			}
+			continue
+		}
+		if err := writeFileAtomic(dest, data, header.ModTime); err != nil {
+			return result, err
+		}
+		if header.Name == "site" {
+			siteRestored = true
+		}
+		result.Restored = append(result.Restored, header.Name)
+	}
+
+	if state != nil {
+		if err := applySnapshot("backup", state); err != nil {
+			return result, err
+		}
+		if cfg.StateFile == "" {
+			result.Restored = append(result.Restored, "state.json")
+		}
+	}
+	if siteRestored {
+		reloadSiteFile(cfg.SiteFile)
+	}
+	return result, nil
+}
+
+// restoreDestination maps a backup entry to its path on this host, "" if
+// the entry can't be restored here.
+func restoreDestination(name string) string {
+	if name == "site" {
+		return currentConfig().SiteFile
+	}
+	for _, dir := range backupDirs {
+		root := dir.dir()
+		if root == "" || path.Dir(name) != dir.name {
+			continue
+		}
+		base := path.Base(name)
+		if base == "." || base == ".." || strings.ContainsAny(base, `/\`) {
+			return ""
+		}
+		return filepath.Join(root, base)
+	}
+	return ""
+}
+
+func writeFileAtomic(dest string, data []byte, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".enecsys-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, modTime, modTime)
+}
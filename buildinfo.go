@@ -0,0 +1,38 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without, the version is the module version of go install, or dev. It's
+// printed by the version subcommand and --version and exported as the
+// labels of enecsys_exporter_build_info, which is always 1:
+//
+//	count by (version) (enecsys_exporter_build_info)
+
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func init() {
+	if info, ok := debug.ReadBuildInfo(); ok && version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_exporter_build_info",
+		Help: "Version, commit and build date of the running exporter, always 1.",
+	},
+		[]string{"version", "commit", "build_date", "goversion"},
+	)
+	buildInfo.WithLabelValues(version, commit, buildDate, runtime.Version()).Set(1)
+	prometheus.MustRegister(buildInfo)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Raw capture: with captureDir configured every line received from a
+// gateway is appended to <captureDir>/<day>.log as
+//
+//	<RFC 3339 receive time>\t<gateway>\t<site>\t<line>
+//
+// which keeps everything needed to replay or re-decode the traffic later.
+// Finished days are compressed to <day>.log.gz and, with
+// captureRetentionDays set, deleted once they are older than that, checked
+// at the start of every day and hourly, also while no gateway sends. GET
+// /api/v1/captures on the admin port, protected by the adminToken, lists
+// the available days, /api/v1/captures/<day> returns one of them.
+
+const captureTimeFormat = time.RFC3339Nano
+
+var (
+	captureMu     sync.Mutex
+	captureDay    string
+	captureFile   *os.File
+	captureWriter *bufio.Writer
+
+	// held while compressing and pruning, which runs in the background
+	compressMu sync.Mutex
+)
+
+func captureLine(t time.Time, gateway, siteName, line string) {
+	dir := currentConfig().CaptureDir
+	if dir == "" {
+		return
+	}
+
+	captureMu.Lock()
+	defer captureMu.Unlock()
+
+	if day := siteDay(t); day != captureDay || captureWriter == nil {
+		closeCapture()
+		go compressCaptures(dir, day)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			logger.Errorf("Couldn't create capture directory: %s", err)
+			reportHealth("captures", err)
+			return
+		}
+		osFile, err := os.OpenFile(filepath.Join(dir, day+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			logger.Errorf("Couldn't open capture file: %s", err)
+			reportHealth("captures", err)
+			return
+		}
+		captureFile, captureWriter, captureDay = osFile, bufio.NewWriter(osFile), day
+	}
+	fmt.Fprintf(captureWriter, "%s\t%s\t%s\t%s\n", t.Format(captureTimeFormat), gateway, siteName, line)
+}
+
+// closeCapture flushes and closes the current capture file. captureMu must
+// be held.
+func closeCapture() {
+	if captureFile == nil {
+		return
+	}
+	if err := captureWriter.Flush(); err != nil {
+		logger.Errorf("Couldn't write capture: %s", err)
+	}
+	captureFile.Close()
+	captureFile, captureWriter = nil, nil
+}
+
+// flushCaptureLoop flushes the capture every ten seconds, less often in
+// deep sleep. It never returns.
+func flushCaptureLoop() {
+	for range sleepyTick(10 * time.Second) {
+		captureMu.Lock()
+		if captureWriter != nil {
+			err := captureWriter.Flush()
+			if err != nil {
+				logger.Errorf("Couldn't write capture: %s", err)
+			}
+			reportHealth("captures", err)
+		}
+		captureMu.Unlock()
+	}
+}
+
+// pruneCapturesLoop compresses finished days and applies the retention
+// every hour. It never returns.
+func pruneCapturesLoop() {
+	for range time.Tick(time.Hour) {
+		dir := currentConfig().CaptureDir
+		if dir == "" {
+			continue
+		}
+		// the file still open since yesterday is compressed once it's closed
+		day := siteDay(time.Now())
+		captureMu.Lock()
+		if captureWriter != nil && captureDay < day {
+			day = captureDay
+		}
+		captureMu.Unlock()
+		compressCaptures(dir, day)
+	}
+}
+
+// compressCaptures gzips the capture files of the days before currentDay
+// and applies the retention.
+func compressCaptures(dir, currentDay string) {
+	compressMu.Lock()
+	defer compressMu.Unlock()
+	cfg := currentConfig()
+	files, err := filepath.Glob(filepath.Join(dir, "????-??-??.log"))
+	if err != nil {
+		logger.Errorf("Couldn't list captures: %s", err)
+		return
+	}
+	for _, file := range files {
+		if strings.TrimSuffix(filepath.Base(file), ".log") >= currentDay {
+			continue
+		}
+		if err := gzipCapture(file); err != nil {
+			logger.Errorf("Couldn't compress capture %s: %s", file, err)
+		}
+	}
+
+	if cfg.CaptureRetentionDays <= 0 {
+		return
+	}
+	oldest := siteDay(time.Now().AddDate(0, 0, -cfg.CaptureRetentionDays))
+	files, _ = filepath.Glob(filepath.Join(dir, "????-??-??.log.gz"))
+	for _, file := range files {
+		if strings.TrimSuffix(filepath.Base(file), ".log.gz") < oldest {
+			if err := os.Remove(file); err != nil {
+				logger.Errorf("Couldn't remove capture: %s", err)
+				continue
+			}
+			fmt.Println("Removed capture", file)
+		}
+	}
+}
+
+// gzipCapture replaces file by file.gz.
+func gzipCapture(file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(file + ".gz.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(out.Name(), file+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+type captureEntry struct {
+	Day        string `json:"day"`
+	Size       int64  `json:"size"`
+	Compressed bool   `json:"compressed"`
+	URL        string `json:"url"`
+}
+
+func init() {
+	adminMux.HandleFunc("/api/v1/captures", requireAdminToken(serveCaptureIndex))
+	adminMux.HandleFunc("/api/v1/captures/", requireAdminToken(serveCapture))
+}
+
+func serveCaptureIndex(w http.ResponseWriter, r *http.Request) {
+	dir := currentConfig().CaptureDir
+	if dir == "" {
+		http.Error(w, "captureDir not configured", http.StatusNotFound)
+		return
+	}
+	days := []captureEntry{}
+	files, _ := filepath.Glob(filepath.Join(dir, "????-??-??.log*"))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || !(strings.HasSuffix(file, ".log") || strings.HasSuffix(file, ".log.gz")) {
+			continue
+		}
+		day := strings.SplitN(filepath.Base(file), ".", 2)[0]
+		days = append(days, captureEntry{
+			Day:        day,
+			Size:       info.Size(),
+			Compressed: strings.HasSuffix(file, ".gz"),
+			URL:        "/api/v1/captures/" + day,
+		})
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Day < days[j].Day })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(days)
+}
+
+// serveCapture returns the capture of a day, gzip compressed for finished
+// days and as plain text for the current one.
+func serveCapture(w http.ResponseWriter, r *http.Request) {
+	dir := currentConfig().CaptureDir
+	if dir == "" {
+		http.Error(w, "captureDir not configured", http.StatusNotFound)
+		return
+	}
+	day := strings.TrimPrefix(r.URL.Path, "/api/v1/captures/")
+	if _, err := time.Parse("2006-01-02", day); err != nil {
+		http.Error(w, "invalid day", http.StatusBadRequest)
+		return
+	}
+
+	file := filepath.Join(dir, day+".log.gz")
+	contentType := "application/gzip"
+	if _, err := os.Stat(file); err != nil {
+		file = filepath.Join(dir, day+".log")
+		contentType = "text/plain; charset=utf-8"
+		captureMu.Lock()
+		if captureWriter != nil && captureDay == day {
+			captureWriter.Flush()
+		}
+		captureMu.Unlock()
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		http.Error(w, "no capture for "+day, http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(file)+`"`)
+	io.Copy(w, f)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// The binary is organised in subcommands. For compatibility with existing
+// service files an unknown first argument runs serve, treating it as the
+// path of the config file like before.
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+	// alternative name, e.g. a shorter one
+	alias string
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "run the exporter (default)", runServe, ""},
+		{"decode", "decode WS telegrams from the arguments or stdin", runDecode, ""},
+		{"replay", "replay raw captures into the live sinks", runReplay, ""},
+		{"simulate", "send simulated telegrams to an exporter", runSimulate, ""},
+		{"check-config", "validate the config and site file", runCheckConfig, "check"},
+		{"import", "decode raw captures into the history store", runImport, ""},
+		{"lint", "report how every line of a capture is parsed", runLint, ""},
+		{"backfill", "replay the history store into a remote_write target", runBackfill, ""},
+		{"version", "print the version", runVersion, ""},
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "help", "-h", "-help", "--help":
+			printCommands()
+			return
+		case "-version", "--version":
+			os.Exit(runVersion(os.Args[2:]))
+		}
+		for _, c := range commands {
+			if c.name == os.Args[1] || c.alias != "" && c.alias == os.Args[1] {
+				os.Exit(c.run(os.Args[2:]))
+			}
+		}
+	}
+	os.Exit(runServe(os.Args[1:]))
+}
+
+func printCommands() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [arguments]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		usage := c.usage
+		if c.alias != "" {
+			usage += " (alias: " + c.alias + ")"
+		}
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of a command.\n", os.Args[0])
+}
+
+func runServe(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	tui := flags.Bool("tui", false, "show a live table of the inverters instead of the trace output")
+	listen := flags.String("listen", "", "address of the gateway listener, overrides listenAddress")
+	metrics := flags.String("metrics", "", "address of the metrics and API server, overrides metricsAddress")
+	iface := flags.String("interface", "", "network interface to bind to, overrides bindInterface")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s serve [flags] [/path/to/config_file]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *tui {
+		startTUI()
+	}
+	configFile := "undefined_path_and_file"
+	if flags.NArg() > 0 {
+		configFile = flags.Arg(0)
+	} else {
+		logger.Errorf(fmt.Sprintf("If you want MQTT logging, add path to configuration file as first argument to program: %s /path/to/config_file, or configure it with ENECSYS_* environment variables", os.Args[0]))
+	}
+	getCredentials(configFile)
+	c := *currentConfig()
+	if *listen != "" {
+		c.ListenAddress = *listen
+	}
+	if *metrics != "" {
+		c.MetricsAddress = *metrics
+	}
+	if *iface != "" {
+		c.BindInterface = *iface
+	}
+	if err := bindInterface(&c); err != nil {
+		logger.Criticalf("Couldn't bind to interface %s: %s", c.BindInterface, err)
+		return 1
+	}
+	setConfig(c)
+
+	go watchReload(configFile)
+	serve()
+	return 0
+}
+
+func runVersion(args []string) int {
+	fmt.Printf("enecsys-exporter %s (commit %s, built %s, %s %s/%s)\n", version, commit, buildDate, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
+
+func runCheckConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s check-config /path/to/config_file\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	problems, warnings := checkConfig(flags.Arg(0))
+	for _, w := range warnings {
+		fmt.Println("warning:", w)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Println(flags.Arg(0), "is valid")
+	return 0
+}
+
+// checkConfig returns the problems making the config at path unusable and
+// warnings about optional parts that are incomplete.
+func checkConfig(path string) (problems, warnings []string) {
+	parsed, invalid, err := readConfig(path)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+	setConfig(parsed)
+
+	credentials := map[string]string{"userName": parsed.UserName, "password": parsed.Password,
+		"mqttAddress": parsed.MqttAddress, "clientName": parsed.ClientName}
+	for _, key := range []string{"userName", "password", "mqttAddress", "clientName"} {
+		if credentials[key] == "" {
+			warnings = append(warnings, fmt.Sprintf("%s: %s missing, MQTT publishing will be disabled", path, key))
+		}
+	}
+	for _, problem := range append(invalid, parsed.validate()...) {
+		problems = append(problems, fmt.Sprintf("%s: %s", path, problem))
+	}
+	if parsed.SiteFile != "" {
+		if err := loadSiteFile(parsed.SiteFile); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", parsed.SiteFile, err))
+		}
+	}
+	return problems, warnings
+}
+
+func runDecode(args []string) int {
+	flags := flag.NewFlagSet("decode", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the readings as JSON")
+	serialFormat := flags.String("serial-format", "", "derive serials by this serialFormat")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s decode [flags] [telegram...]\n\n"+
+			"Telegrams are full gateway lines, the payload after WS= or capture lines.\n"+
+			"Without arguments they are read from stdin, one per line.\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if err := checkSerialFormat(*serialFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *serialFormat != "" {
+		c := *currentConfig()
+		c.SerialFormat = *serialFormat
+		setConfig(c)
+	}
+
+	status := 0
+	decode := func(line string) {
+		line = strings.TrimRight(line, "\r\n")
+		if i := strings.LastIndexByte(line, '\t'); i >= 0 {
+			line = line[i+1:]
+		}
+		if i := strings.Index(line, "WS="); i >= 0 {
+			line = line[i+3:]
+		}
+		if line == "" {
+			return
+		}
+		r, err := decodeWS(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", line, err)
+			status = 1
+			return
+		}
+		r.ID = canonicalID(r.ID)
+		validate(&r)
+		if *asJSON {
+			out, _ := json.Marshal(r)
+			fmt.Println(string(out))
+			return
+		}
+		fmt.Printf("id %s (serial %s)\n", r.ID, inverter(r.ID).Serial)
+		for _, f := range fields {
+			note := ""
+			if reason, ok := r.Invalid[f.topic]; ok {
+				note = "  invalid: " + reason
+			}
+			fmt.Printf("  %-12s %10.3f%s\n", f.topic, f.value(&r), note)
+		}
+	}
+
+	if flags.NArg() > 0 {
+		for _, arg := range flags.Args() {
+			decode(arg)
+		}
+		return status
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		decode(scanner.Text())
+	}
+	return status
+}
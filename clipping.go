@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Clipping detection: an inverter clips when its panels could deliver more
+// than it can convert, so its output sits at its AC limit. A reading with
+// at least clippingRatio (default 0.97) of the ratedWatts of the site file
+// is at the limit, and the time between two consecutive readings at the
+// limit, up to integrationMaxGap, counts as clipping. It's exported per day
+// and in total, and is part of the daily report as clippingSeconds. An
+// inverter clipping for hours on sunny days is a candidate for a larger
+// model or fewer panels. Inverters without ratedWatts aren't tracked.
+
+var (
+	enecClipping = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_clipping",
+		Help: "1 if the inverter's AC power is at its rated limit.",
+	},
+		[]string{"id", "site"},
+	)
+	enecClippingToday = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_clipping_seconds_today",
+		Help: "Time the inverter's AC power sat at its rated limit today.",
+	},
+		[]string{"id", "site"},
+	)
+	enecClippingTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_clipping_seconds_total",
+		Help: "Time the inverter's AC power sat at its rated limit.",
+	},
+		[]string{"id", "site"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(enecClipping)
+	prometheus.MustRegister(enecClippingToday)
+	prometheus.MustRegister(enecClippingTotal)
+}
+
+func deleteClippingSeries(id, siteName string) {
+	enecClipping.DeleteLabelValues(id, siteName)
+	enecClippingToday.DeleteLabelValues(id, siteName)
+	enecClippingTotal.DeleteLabelValues(id, siteName)
+}
+
+// atLimit reports whether the AC power of r is at its inverter's limit.
+func atLimit(r reading, rated float64) bool {
+	return r.valid("acpower") && r.ACPower >= currentConfig().ClippingRatio*rated
+}
+
+// trackClipping accounts the time since prev if both it and r, readings of
+// the same inverter, are at the limit. prev is only set if hasPrev.
+func trackClipping(prev reading, hasPrev bool, r reading) {
+	rated := inverter(r.ID).RatedWatts
+	if rated <= 0 || !r.valid("acpower") {
+		return
+	}
+	at := atLimit(r, rated)
+	if at {
+		enecClipping.WithLabelValues(r.ID, r.Site).Set(1)
+	} else {
+		enecClipping.WithLabelValues(r.ID, r.Site).Set(0)
+	}
+	dt := r.Time.Sub(prev.Time)
+	if !hasPrev || !at || !atLimit(prev, rated) || dt <= 0 || dt > currentConfig().IntegrationMaxGap {
+		return
+	}
+
+	enecClippingTotal.WithLabelValues(r.ID, r.Site).Add(dt.Seconds())
+	dayMu.Lock()
+	today.Clipping[r.ID] += dt.Seconds()
+	seconds := today.Clipping[r.ID]
+	dayMu.Unlock()
+	enecClippingToday.WithLabelValues(r.ID, r.Site).Set(seconds)
+}
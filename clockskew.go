@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Gateway clock skew detection. Gateway status lines carrying a timestamp
+// (YYYY-MM-DD HH:MM:SS, optionally with T separator and zone offset; local
+// time without offset) are compared against the host clock. A skewed
+// gateway clock shifts the inverters' daily rollover, so an event is raised
+// when the skew exceeds clockSkewThreshold (default 5m).
+
+var (
+	enecGatewayClockSkew = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_gateway_clock_skew_seconds",
+		Help: "Gateway clock minus host clock, from timestamps in status lines.",
+	},
+		[]string{"gateway", "site"},
+	)
+
+	gatewayTimestamp   = regexp.MustCompile(`\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2}([+-]\d{2}:?\d{2}|Z)?`)
+	gatewayTimeFormats = []string{
+		"2006-01-02T15:04:05Z07:00",
+		"2006-01-02 15:04:05Z07:00",
+		"2006-01-02T15:04:05-0700",
+		"2006-01-02 15:04:05-0700",
+	}
+
+	skewMu     sync.Mutex
+	skewedGate = map[string]bool{}
+)
+
+func init() {
+	prometheus.MustRegister(enecGatewayClockSkew)
+}
+
+// parseGatewayTime extracts the first timestamp of line, if any.
+func parseGatewayTime(line string) (time.Time, bool) {
+	match := gatewayTimestamp.FindString(line)
+	if match == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range gatewayTimeFormats {
+		if t, err := time.Parse(layout, match); err == nil {
+			return t, true
+		}
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, match, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// handleStatusLine processes a gateway line received at t that isn't a WS
+// telegram.
+func handleStatusLine(line string, gateway string, siteName string, t time.Time) {
+	gatewayTime, ok := parseGatewayTime(line)
+	if !ok {
+		return
+	}
+	skew := gatewayTime.Sub(t)
+	enecGatewayClockSkew.WithLabelValues(gateway, siteName).Set(skew.Seconds())
+
+	threshold := currentConfig().ClockSkewThreshold
+	skewed := math.Abs(skew.Seconds()) > threshold.Seconds()
+
+	skewMu.Lock()
+	changed := skewedGate[gateway] != skewed
+	skewedGate[gateway] = skewed
+	skewMu.Unlock()
+
+	if !changed {
+		return
+	}
+	if skewed {
+		emitEvent(event{Kind: "gateway_clock_skew", Severity: severityWarning, Site: siteName,
+			Message: fmt.Sprintf("Clock of gateway %s is off by %s", gateway, skew.Round(time.Second))})
+	} else {
+		emitEvent(event{Kind: "gateway_clock_ok", Severity: severityInfo, Site: siteName,
+			Message: fmt.Sprintf("Clock of gateway %s is back in sync", gateway)})
+	}
+}
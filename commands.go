@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/juju/loggo"
+)
+
+// Runtime control over MQTT. With commandToken set the exporter subscribes
+// to enecsys/cmd/# and runs the command named by the last topic level. The
+// payload is JSON with the token and, where the command takes one, a value:
+//
+//	enecsys/cmd/loglevel   {"token": "...", "value": "DEBUG"}
+//	enecsys/cmd/silence    {"token": "...", "value": "2h"}   # "0" ends it
+//	enecsys/cmd/discovery  {"token": "..."}                  # re-publish meta and discovery
+//	enecsys/cmd/report     {"token": "..."}                  # publish today's report so far
+//
+// The report so far is published, not retained, to enecsys/report/current;
+// enecsys/report/daily and the report files only get finished days.
+//
+// While silenced, events below critical are logged but neither sent to the
+// notifiers nor forwarded to Alertmanager; resolutions still are. Every
+// command run is logged as an admin_command event.
+
+const commandTopic = "enecsys/cmd/#"
+
+type commandMessage struct {
+	Token string `json:"token"`
+	Value string `json:"value"`
+}
+
+var (
+	silenceMu     sync.Mutex
+	silencedUntil time.Time
+
+	mqttCommands = map[string]func(value string) (string, error){
+		"loglevel":  commandLogLevel,
+		"silence":   commandSilence,
+		"discovery": commandDiscovery,
+		"report":    commandReport,
+	}
+)
+
+// startCommands subscribes to the command topic if commandToken is set.
+func startCommands() {
+	if currentConfig().CommandToken == "" {
+		return
+	}
+	subscribeMqtt("cmd", commandTopic, handleCommand)
+}
+
+func handleCommand(client mqtt.Client, msg mqtt.Message) {
+	name := msg.Topic()[strings.LastIndexByte(msg.Topic(), '/')+1:]
+	run, ok := mqttCommands[name]
+	if !ok {
+		logger.Errorf("Unknown command on %s", msg.Topic())
+		return
+	}
+	var cmd commandMessage
+	if err := json.Unmarshal(msg.Payload(), &cmd); err != nil {
+		logger.Errorf("Couldn't parse command on %s: %s", msg.Topic(), err)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(cmd.Token), []byte(currentConfig().CommandToken)) != 1 {
+		logger.Warningf("Rejecting command on %s with a wrong token", msg.Topic())
+		return
+	}
+
+	result, err := run(cmd.Value)
+	if err != nil {
+		logger.Errorf("Command %s failed: %s", name, err)
+		return
+	}
+	emitEvent(event{Kind: "admin_command", Severity: severityInfo, Message: result})
+}
+
+func commandLogLevel(value string) (string, error) {
+	if _, ok := loggo.ParseLevel(value); !ok {
+		return "", fmt.Errorf("unknown level %q", value)
+	}
+	if err := loggo.ConfigureLoggers("<root>=" + value); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Log level set to %s", strings.ToUpper(value)), nil
+}
+
+func commandSilence(value string) (string, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return "", fmt.Errorf("invalid duration %q", value)
+	}
+	until := time.Now().Add(d)
+	silenceMu.Lock()
+	silencedUntil = until
+	silenceMu.Unlock()
+	if d == 0 {
+		return "Alerts no longer silenced", nil
+	}
+	return fmt.Sprintf("Alerts silenced until %s", until.Format(time.RFC3339)), nil
+}
+
+func commandDiscovery(string) (string, error) {
+	ids := knownInverters()
+	forgetRetained()
+	for _, id := range ids {
+		publishMeta(id)
+	}
+	return fmt.Sprintf("Metadata and discovery of %d inverters re-published", len(ids)), nil
+}
+
+func commandReport(string) (string, error) {
+	dayMu.Lock()
+	day := today.Day
+	payload, err := json.Marshal(today.rounded())
+	dayMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	queueMqtt(mqttMessage{topic: currentReportTopic, value: string(payload)})
+	return fmt.Sprintf("Report of %s so far published", day), nil
+}
+
+// silenced reports whether e is held back by a silence.
+func silenced(e event) bool {
+	silenceMu.Lock()
+	defer silenceMu.Unlock()
+	return e.Severity != severityCritical && e.Time.Before(silencedUntil)
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/goccy/go-yaml"
+	"github.com/juju/loggo"
+)
+
+// configuration holds the settings read from the YAML config file. Every
+// key is optional; missing keys keep the defaults of defaultConfig. The
+// features a key belongs to document it in more detail.
+type configuration struct {
+	// MQTT publishing is active when all four of these are set.
+	UserName    string `yaml:"userName"`
+	Password    string `yaml:"password"`
+	MqttAddress string `yaml:"mqttAddress"`
+	ClientName  string `yaml:"clientName"`
+
+	MqttQueueSize      int           `yaml:"mqttQueueSize"`
+	MqttPublishTimeout time.Duration `yaml:"mqttPublishTimeout"`
+	MqttRestartAfter   int           `yaml:"mqttRestartAfter"`
+	MqttQos            int           `yaml:"mqttQos"`
+	MqttRetain         bool          `yaml:"mqttRetain"`
+	MqttRetainValues   bool          `yaml:"mqttRetainValues"`
+	MqttPayload        string        `yaml:"mqttPayload"`
+	MqttTopicTemplate  string        `yaml:"mqttTopicTemplate"`
+	MqttOnChange       bool          `yaml:"mqttOnChange"`
+	MqttChangeDeltas   string        `yaml:"mqttChangeDeltas"`
+	MqttMinInterval    time.Duration `yaml:"mqttMinInterval"`
+
+	// TLS to the broker.
+	MqttCAFile             string `yaml:"mqttCAFile"`
+	MqttCert               string `yaml:"mqttCert"`
+	MqttKey                string `yaml:"mqttKey"`
+	MqttServerName         string `yaml:"mqttServerName"`
+	MqttInsecureSkipVerify bool   `yaml:"mqttInsecureSkipVerify"`
+	MqttHeaders            string `yaml:"mqttHeaders"`
+
+	// Further brokers everything is published to.
+	MqttBrokers string `yaml:"mqttBrokers"`
+
+	// Home Assistant discovery.
+	HomeAssistant       bool   `yaml:"homeAssistant"`
+	HomeAssistantPrefix string `yaml:"homeAssistantPrefix"`
+
+	// Commands over MQTT, disabled without a token.
+	CommandToken string `yaml:"commandToken"`
+
+	// Gateway listeners and telegram handling.
+	ListenAddress        string        `yaml:"listenAddress"`
+	BindInterface        string        `yaml:"bindInterface"`
+	ListenAllow          string        `yaml:"listenAllow"`
+	TLSListen            string        `yaml:"tlsListen"`
+	TLSCert              string        `yaml:"tlsCert"`
+	TLSKey               string        `yaml:"tlsKey"`
+	TLSClientCA          string        `yaml:"tlsClientCA"`
+	TLSSite              string        `yaml:"tlsSite"`
+	Inputs               string        `yaml:"inputs"`
+	TLSAllow             string        `yaml:"tlsAllow"`
+	GatewayTimeout       time.Duration `yaml:"gatewayTimeout"`
+	GatewayKeepalive     string        `yaml:"gatewayKeepalive"`
+	GatewayAck           string        `yaml:"gatewayAck"`
+	ClockSkewThreshold   time.Duration `yaml:"clockSkewThreshold"`
+	StrictParse          bool          `yaml:"strictParse"`
+	PanIDs               string        `yaml:"panIds"`
+	CorpusDir            string        `yaml:"corpusDir"`
+	CorpusMax            int           `yaml:"corpusMax"`
+	IDFormat             string        `yaml:"idFormat"`
+	SerialFormat         string        `yaml:"serialFormat"`
+	DecodeErrorThreshold float64       `yaml:"decodeErrorThreshold"`
+	DecodeErrorPeriod    time.Duration `yaml:"decodeErrorPeriod"`
+	StaleTimeout         time.Duration `yaml:"staleTimeout"`
+	ShutdownTimeout      time.Duration `yaml:"shutdownTimeout"`
+	SeriesExpiry         time.Duration `yaml:"seriesExpiry"`
+	RecordWorkers        int           `yaml:"recordWorkers"`
+	RecordQueueSize      int           `yaml:"recordQueueSize"`
+
+	// HTTP endpoints.
+	MetricsAddress   string        `yaml:"metricsAddress"`
+	MetricsPath      string        `yaml:"metricsPath"`
+	MetricsOnAdmin   bool          `yaml:"metricsOnAdmin"`
+	MetricsTLSCert   string        `yaml:"metricsTlsCert"`
+	MetricsTLSKey    string        `yaml:"metricsTlsKey"`
+	MetricsUser      string        `yaml:"metricsUser"`
+	MetricsPassword  string        `yaml:"metricsPassword"`
+	MetricsToken     string        `yaml:"metricsToken"`
+	AggregatePath    string        `yaml:"aggregatePath"`
+	ReadyTimeout     time.Duration `yaml:"readyTimeout"`
+	AdminAddress     string        `yaml:"adminAddress"`
+	AdminToken       string        `yaml:"adminToken"`
+	AdminAllow       string        `yaml:"adminAllow"`
+	MetricNames      string        `yaml:"metricNames"`
+	MetricNamespace  string        `yaml:"metricNamespace"`
+	InverterLabels   string        `yaml:"inverterLabels"`
+	MetricTimestamps bool          `yaml:"metricTimestamps"`
+	MetricNamesUntil string        `yaml:"metricNamesUntil"`
+	Tracing          bool          `yaml:"tracing"`
+	TraceBufferSize  int           `yaml:"traceBufferSize"`
+	// Serve the profiler and runtime stats on the public port too, see
+	// debug.go.
+	Pprof bool `yaml:"pprof"`
+	// Pseudonyms instead of inverter IDs on the public port, see
+	// privacy.go.
+	Privacy     bool   `yaml:"privacy"`
+	PrivacySalt string `yaml:"privacySalt"`
+
+	// Log level of the root logger, e.g. WARNING or DEBUG.
+	LogLevel string `yaml:"logLevel"`
+	// Every logSampleEvery-th decoded telegram is logged in full, see
+	// samplelog.go.
+	LogSampleEvery int `yaml:"logSampleEvery"`
+
+	// Unknown keys in the config file are problems unless allowed, e.g.
+	// to share a file with a newer version.
+	AllowUnknownKeys bool `yaml:"allowUnknownKeys"`
+
+	// Files and directories.
+	SiteFile             string        `yaml:"siteFile"`
+	SiteFileInterval     time.Duration `yaml:"siteFileInterval"`
+	StateFile            string        `yaml:"stateFile"`
+	SnapshotInterval     time.Duration `yaml:"snapshotInterval"`
+	HistoryDir           string        `yaml:"historyDir"`
+	ReportDir            string        `yaml:"reportDir"`
+	DayOffset            time.Duration `yaml:"dayOffset"`
+	GapEstimate          string        `yaml:"gapEstimate"`
+	CaptureDir           string        `yaml:"captureDir"`
+	CaptureRetentionDays int           `yaml:"captureRetentionDays"`
+
+	// Energy values.
+	EnergySource      string        `yaml:"energySource"`
+	IntegrationMaxGap time.Duration `yaml:"integrationMaxGap"`
+	Precision         string        `yaml:"precision"`
+
+	// Deep sleep, disabled with a zero sleepAfter.
+	SleepAfter    time.Duration `yaml:"sleepAfter"`
+	SleepSlowdown int           `yaml:"sleepSlowdown"`
+	SleepStatus   bool          `yaml:"sleepStatus"`
+
+	// Thermal derating detection.
+	DeratingTemperature float64 `yaml:"deratingTemperature"`
+	DeratingRatio       float64 `yaml:"deratingRatio"`
+
+	// Clipping detection.
+	ClippingRatio float64 `yaml:"clippingRatio"`
+
+	// Location and forecasts. A zero forecastInterval selects the default
+	// of the provider.
+	Latitude         *float64      `yaml:"latitude"`
+	Longitude        *float64      `yaml:"longitude"`
+	ForecastProvider string        `yaml:"forecastProvider"`
+	ForecastAPIKey   string        `yaml:"forecastApiKey"`
+	ForecastInterval time.Duration `yaml:"forecastInterval"`
+
+	// Alertmanager forwarding.
+	AlertmanagerURL         string `yaml:"alertmanagerUrl"`
+	AlertmanagerMinSeverity string `yaml:"alertmanagerMinSeverity"`
+
+	// Grafana annotations.
+	GrafanaURL    string `yaml:"grafanaUrl"`
+	GrafanaAPIKey string `yaml:"grafanaApiKey"`
+	GrafanaEvents string `yaml:"grafanaEvents"`
+
+	// Grid meter.
+	GridTopic     string        `yaml:"gridTopic"`
+	GridJSONField string        `yaml:"gridJsonField"`
+	GridInvert    bool          `yaml:"gridInvert"`
+	GridTimeout   time.Duration `yaml:"gridTimeout"`
+
+	// S3 archive.
+	S3Bucket        string        `yaml:"s3Bucket"`
+	S3Endpoint      string        `yaml:"s3Endpoint"`
+	S3Region        string        `yaml:"s3Region"`
+	S3AccessKey     string        `yaml:"s3AccessKey"`
+	S3SecretKey     string        `yaml:"s3SecretKey"`
+	S3Prefix        string        `yaml:"s3Prefix"`
+	S3RetentionDays int           `yaml:"s3RetentionDays"`
+	ArchiveInterval time.Duration `yaml:"archiveInterval"`
+
+	// Remote write push.
+	RemoteWriteURL       string        `yaml:"remoteWriteUrl"`
+	RemoteWriteUser      string        `yaml:"remoteWriteUser"`
+	RemoteWritePassword  string        `yaml:"remoteWritePassword"`
+	RemoteWriteLabels    string        `yaml:"remoteWriteLabels"`
+	RemoteWriteInterval  time.Duration `yaml:"remoteWriteInterval"`
+	RemoteWriteBatchSize int           `yaml:"remoteWriteBatchSize"`
+	RemoteWriteQueueSize int           `yaml:"remoteWriteQueueSize"`
+
+	// Registry sync, peers is a comma separated list of base URLs.
+	Peers            string        `yaml:"peers"`
+	PeerToken        string        `yaml:"peerToken"`
+	PeerSyncInterval time.Duration `yaml:"peerSyncInterval"`
+}
+
+func defaultConfig() configuration {
+	return configuration{
+		MqttQueueSize:           1000,
+		MqttPublishTimeout:      10 * time.Second,
+		MqttRestartAfter:        10,
+		MqttRetain:              true,
+		MqttRetainValues:        true,
+		MqttPayload:             "topics",
+		MqttTopicTemplate:       defaultTopicTemplate,
+		SleepSlowdown:           10,
+		CorpusMax:               1000,
+		HomeAssistantPrefix:     "homeassistant",
+		ListenAddress:           "0.0.0.0:5040",
+		GatewayTimeout:          5 * time.Minute,
+		ClockSkewThreshold:      5 * time.Minute,
+		IDFormat:                "hex",
+		SerialFormat:            "decimal",
+		DecodeErrorThreshold:    5,
+		DecodeErrorPeriod:       10 * time.Minute,
+		StaleTimeout:            10 * time.Minute,
+		ShutdownTimeout:         10 * time.Second,
+		RecordWorkers:           4,
+		RecordQueueSize:         1000,
+		MetricsAddress:          ":5041",
+		MetricsPath:             "/metrics",
+		AggregatePath:           "/metrics/aggregate",
+		ReadyTimeout:            time.Hour,
+		MetricNames:             "legacy",
+		MetricNamespace:         defaultNamespace,
+		InverterLabels:          "name",
+		TraceBufferSize:         10000,
+		LogLevel:                "ERROR",
+		SiteFileInterval:        10 * time.Second,
+		SnapshotInterval:        5 * time.Minute,
+		EnergySource:            "frame",
+		IntegrationMaxGap:       15 * time.Minute,
+		DeratingTemperature:     60,
+		DeratingRatio:           0.8,
+		ClippingRatio:           0.97,
+		AlertmanagerMinSeverity: severityWarning,
+		GrafanaEvents:           defaultGrafanaEvents,
+		GridTimeout:             5 * time.Minute,
+		S3Endpoint:              "https://s3.amazonaws.com",
+		S3Region:                "us-east-1",
+		ArchiveInterval:         6 * time.Hour,
+		RemoteWriteInterval:     15 * time.Second,
+		RemoteWriteBatchSize:    1000,
+		RemoteWriteQueueSize:    100000,
+		PeerSyncInterval:        time.Minute,
+	}
+}
+
+var (
+	configMu      sync.RWMutex
+	runningConfig = func() *configuration { c := defaultConfig(); return &c }()
+)
+
+// currentConfig returns the running configuration. A reload replaces it as a
+// whole and never changes it in place, so read it once and keep using that
+// snapshot for work that needs consistent settings.
+func currentConfig() *configuration {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return runningConfig
+}
+
+// setConfig makes c the running configuration.
+func setConfig(c configuration) {
+	configMu.Lock()
+	runningConfig = &c
+	configMu.Unlock()
+}
+
+// mqttEnabled reports whether the MQTT credentials are complete.
+func (c *configuration) mqttEnabled() bool {
+	return c.UserName != "" && c.Password != "" && c.MqttAddress != "" && c.ClientName != ""
+}
+
+// peerToken returns the token sent to peers, the admin token by default.
+func (c *configuration) peerToken() string {
+	if c.PeerToken != "" {
+		return c.PeerToken
+	}
+	return c.AdminToken
+}
+
+// splitList splits a comma separated config value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// readConfig parses the config file at path on top of the defaults, then
+// applies the environment variables. All values are read as strings, so
+// quoted and unquoted numbers and booleans are equally accepted; values that
+// don't fit their key are returned as problems, and so are unknown keys,
+// with the known key they are most likely a typo of, unless
+// allowUnknownKeys is set. The error is about reading the file, the
+// environment is applied even if it can't be read.
+//
+// Every key can be set as ENECSYS_ followed by the key in upper snake case,
+// e.g. ENECSYS_MQTT_ADDRESS for mqttAddress or ENECSYS_TLS_CLIENT_CA for
+// tlsClientCA, which takes precedence over the file. That's enough to run
+// the exporter in a container without a config file.
+func readConfig(path string) (c configuration, problems []string, err error) {
+	c = defaultConfig()
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		values := map[string]string{}
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return c, nil, fmt.Errorf("%s: %s", path, err)
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := c.set(key, values[key]); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		for _, key := range keys {
+			if knownKey(key) {
+				continue
+			}
+			problem := key + ": unknown key"
+			if suggestion := suggestKey(key); suggestion != "" {
+				problem += ", did you mean " + suggestion + "?"
+			}
+			if c.AllowUnknownKeys {
+				logger.Errorf("%s: %s (ignored)", path, problem)
+			} else {
+				problems = append(problems, problem)
+			}
+		}
+	}
+
+	t := reflect.TypeOf(c)
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("yaml")
+		if value, ok := os.LookupEnv(envName(key)); ok {
+			if err := c.set(key, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s (from %s)", err, envName(key)))
+			}
+		}
+	}
+	return c, problems, err
+}
+
+// envName returns the environment variable of key. A run of capitals is one
+// word, up to the capital starting the next one, e.g. mqttCAFile becomes
+// MQTT_CA_FILE.
+func envName(key string) string {
+	var name []rune
+	runes := []rune(key)
+	for i, r := range runes {
+		wordStart := i > 0 && !unicode.IsUpper(runes[i-1]) ||
+			i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+		if unicode.IsUpper(r) && wordStart {
+			name = append(name, '_')
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+	return "ENECSYS_" + string(name)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// knownKey reports whether key is a config key.
+func knownKey(key string) bool {
+	t := reflect.TypeOf(configuration{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("yaml") == key {
+			return true
+		}
+	}
+	return false
+}
+
+// suggestKey returns the config key closest to the unknown key, if it's
+// close enough to be a typo: differing only in case, or by at most a
+// quarter of its letters (at least 2).
+func suggestKey(key string) string {
+	limit := len(key) / 4
+	if limit < 2 {
+		limit = 2
+	}
+	best, bestDistance := "", limit+1
+	t := reflect.TypeOf(configuration{})
+	for i := 0; i < t.NumField(); i++ {
+		known := t.Field(i).Tag.Get("yaml")
+		if strings.EqualFold(known, key) {
+			return known
+		}
+		if d := editDistance(strings.ToLower(key), strings.ToLower(known)); d < bestDistance {
+			best, bestDistance = known, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// set parses value into the field configured by key. Unknown keys are
+// ignored here, readConfig reports them.
+func (c *configuration) set(key, value string) error {
+	t := reflect.TypeOf(*c)
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("yaml") != key {
+			continue
+		}
+		field := reflect.ValueOf(c).Elem().Field(i)
+		switch {
+		case field.Type() == durationType:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid duration %q", key, value)
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: expected true or false, got %q", key, value)
+			}
+			field.SetBool(b)
+		case field.Kind() == reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid integer %q", key, value)
+			}
+			field.SetInt(int64(n))
+		case field.Kind() == reflect.Float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s: invalid number %q", key, value)
+			}
+			field.SetFloat(f)
+		case field.Type() == reflect.TypeOf((*float64)(nil)):
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s: invalid number %q", key, value)
+			}
+			field.Set(reflect.ValueOf(&f))
+		}
+		return nil
+	}
+	return nil
+}
+
+// validate returns the problems that make c unusable.
+func (c *configuration) validate() []string {
+	var problems []string
+	durations := map[string]time.Duration{
+		"mqttPublishTimeout": c.MqttPublishTimeout, "gatewayTimeout": c.GatewayTimeout,
+		"clockSkewThreshold": c.ClockSkewThreshold, "decodeErrorPeriod": c.DecodeErrorPeriod,
+		"staleTimeout": c.StaleTimeout, "siteFileInterval": c.SiteFileInterval, "shutdownTimeout": c.ShutdownTimeout,
+		"snapshotInterval": c.SnapshotInterval, "integrationMaxGap": c.IntegrationMaxGap,
+		"gridTimeout": c.GridTimeout, "archiveInterval": c.ArchiveInterval,
+		"peerSyncInterval": c.PeerSyncInterval, "remoteWriteInterval": c.RemoteWriteInterval,
+		"readyTimeout": c.ReadyTimeout,
+	}
+	for key, d := range durations {
+		if d <= 0 {
+			problems = append(problems, fmt.Sprintf("%s: must be positive, got %s", key, d))
+		}
+	}
+	if c.DayOffset <= -24*time.Hour || c.DayOffset >= 24*time.Hour {
+		problems = append(problems, fmt.Sprintf("dayOffset: must be less than a day, got %s", c.DayOffset))
+	}
+	if c.LogSampleEvery < 0 {
+		problems = append(problems, fmt.Sprintf("logSampleEvery: must be positive, got %d", c.LogSampleEvery))
+	}
+	if c.SeriesExpiry < 0 {
+		problems = append(problems, fmt.Sprintf("seriesExpiry: must be positive, got %s", c.SeriesExpiry))
+	}
+	if c.SleepAfter < 0 {
+		problems = append(problems, fmt.Sprintf("sleepAfter: must be positive, got %s", c.SleepAfter))
+	}
+	if c.ForecastInterval < 0 {
+		problems = append(problems, fmt.Sprintf("forecastInterval: must be positive, got %s", c.ForecastInterval))
+	}
+	sizes := map[string]int{
+		"mqttQueueSize": c.MqttQueueSize, "mqttRestartAfter": c.MqttRestartAfter,
+		"traceBufferSize": c.TraceBufferSize, "sleepSlowdown": c.SleepSlowdown, "corpusMax": c.CorpusMax,
+		"remoteWriteBatchSize": c.RemoteWriteBatchSize, "remoteWriteQueueSize": c.RemoteWriteQueueSize,
+		"recordWorkers": c.RecordWorkers, "recordQueueSize": c.RecordQueueSize,
+	}
+	for key, n := range sizes {
+		if n < 1 {
+			problems = append(problems, fmt.Sprintf("%s: must be at least 1, got %d", key, n))
+		}
+	}
+
+	// host:port without scheme is a tcp:// address
+	if strings.Contains(c.MqttAddress, "://") {
+		if u, err := url.Parse(c.MqttAddress); err != nil || !mqttSchemes[u.Scheme] {
+			problems = append(problems, fmt.Sprintf("mqttAddress: expected a tcp://, ssl://, ws:// or wss:// URL, got %q", c.MqttAddress))
+		}
+	}
+	if _, err := parsePANs(c.PanIDs); err != nil {
+		problems = append(problems, fmt.Sprintf("panIds: %s", err))
+	}
+	for _, spec := range splitList(c.Inputs) {
+		if _, _, _, err := parseInput(spec); err != nil {
+			problems = append(problems, fmt.Sprintf("inputs: %s", err))
+		}
+	}
+	if _, err := parseChangeDeltas(c.MqttChangeDeltas); err != nil {
+		problems = append(problems, fmt.Sprintf("mqttChangeDeltas: %s", err))
+	}
+	if c.MqttMinInterval < 0 {
+		problems = append(problems, fmt.Sprintf("mqttMinInterval: must be positive, got %s", c.MqttMinInterval))
+	}
+	if _, err := parseBrokers(c.MqttBrokers); err != nil {
+		problems = append(problems, fmt.Sprintf("mqttBrokers: %s", err))
+	}
+	if _, err := parseHeaders(c.MqttHeaders); err != nil {
+		problems = append(problems, fmt.Sprintf("mqttHeaders: %s", err))
+	}
+	if (c.MqttCert == "") != (c.MqttKey == "") {
+		problems = append(problems, "mqttCert and mqttKey must be set together")
+	}
+	if c.MqttQos < 0 || c.MqttQos > 2 {
+		problems = append(problems, fmt.Sprintf("mqttQos: expected 0, 1 or 2, got %d", c.MqttQos))
+	}
+
+	if c.Privacy && c.PrivacySalt == "" {
+		problems = append(problems, "privacySalt: must be set for privacy")
+	}
+	if !metricNamespacePattern.MatchString(c.MetricNamespace) {
+		problems = append(problems, fmt.Sprintf("metricNamespace: invalid metric name prefix %q", c.MetricNamespace))
+	}
+	if _, err := parseInverterLabels(c.InverterLabels); err != nil {
+		problems = append(problems, fmt.Sprintf("inverterLabels: %s", err))
+	}
+	if c.RemoteWriteURL != "" {
+		if u, err := url.Parse(c.RemoteWriteURL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("remoteWriteUrl: expected an http:// or https:// URL, got %q", c.RemoteWriteURL))
+		}
+	}
+	if _, err := parseRemoteWriteLabels(c.RemoteWriteLabels); err != nil {
+		problems = append(problems, fmt.Sprintf("remoteWriteLabels: %s", err))
+	}
+	if err := checkTopicTemplate(c.MqttTopicTemplate); err != nil {
+		problems = append(problems, fmt.Sprintf("mqttTopicTemplate: %s", err))
+	}
+
+	switch c.MqttPayload {
+	case "topics", "json", "both":
+	default:
+		problems = append(problems, fmt.Sprintf("mqttPayload: expected topics, json or both, got %q", c.MqttPayload))
+	}
+
+	switch c.GapEstimate {
+	case "", "samples", "peers":
+	default:
+		problems = append(problems, fmt.Sprintf("gapEstimate: expected samples or peers, got %q", c.GapEstimate))
+	}
+
+	switch c.MetricNames {
+	case "legacy", "both", "new":
+	default:
+		problems = append(problems, fmt.Sprintf("metricNames: expected legacy, both or new, got %q", c.MetricNames))
+	}
+	if c.MetricNamesUntil != "" {
+		if _, err := time.Parse("2006-01-02", c.MetricNamesUntil); err != nil {
+			problems = append(problems, fmt.Sprintf("metricNamesUntil: expected YYYY-MM-DD, got %q", c.MetricNamesUntil))
+		}
+	}
+	switch c.IDFormat {
+	case "hex", "upper", "reversed", "decimal":
+	default:
+		problems = append(problems, fmt.Sprintf("idFormat: expected hex, upper, reversed or decimal, got %q", c.IDFormat))
+	}
+	if c.DeratingRatio <= 0 || c.DeratingRatio > 1 {
+		problems = append(problems, fmt.Sprintf("deratingRatio: must be between 0 and 1, got %g", c.DeratingRatio))
+	}
+	if c.ClippingRatio <= 0 || c.ClippingRatio > 1 {
+		problems = append(problems, fmt.Sprintf("clippingRatio: must be between 0 and 1, got %g", c.ClippingRatio))
+	}
+	if err := checkSeverity(c.AlertmanagerMinSeverity); err != nil {
+		problems = append(problems, fmt.Sprintf("alertmanagerMinSeverity: %s", err))
+	}
+	if err := checkSerialFormat(c.SerialFormat); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := checkEnergySource(c.EnergySource); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.GatewayKeepalive != "" {
+		if _, err := regexp.Compile(c.GatewayKeepalive); err != nil {
+			problems = append(problems, fmt.Sprintf("gatewayKeepalive: %s", err))
+		}
+	}
+	if _, ok := loggo.ParseLevel(c.LogLevel); !ok {
+		problems = append(problems, fmt.Sprintf("logLevel: unknown level %q", c.LogLevel))
+	}
+	for key, value := range map[string]string{"listenAllow": c.ListenAllow, "tlsAllow": c.TLSAllow, "adminAllow": c.AdminAllow} {
+		if _, err := parseAllowlist(splitList(value)); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", key, err))
+		}
+	}
+	if c.TLSListen != "" && (c.TLSCert == "" || c.TLSKey == "") {
+		problems = append(problems, "tlsListen needs tlsCert and tlsKey")
+	}
+	if (c.MetricsTLSCert == "") != (c.MetricsTLSKey == "") {
+		problems = append(problems, "metricsTlsCert and metricsTlsKey must be set together")
+	}
+	if (c.MetricsUser == "") != (c.MetricsPassword == "") {
+		problems = append(problems, "metricsUser and metricsPassword must be set together")
+	}
+	sort.Strings(problems)
+	return problems
+}
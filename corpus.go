@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Corpus of failed frames for decoder development. With corpusDir set,
+// gateway lines that look like telegrams but fail - they don't decode
+// (decode_error), have the wrong length (bad_length) or values rejected by
+// strictParse (invalid_values) - are appended to <corpusDir>/<reason>.capture,
+// each distinct line once and up to corpusMax (default 1000) lines in all.
+// The files are in the capture format (see capture.go), so the replay
+// subcommand reproduces them.
+//
+// The lines are anonymized: the inverter ID and PAN ID in the payload are
+// replaced by hashes of them, so the same inverter gets the same made up
+// ID, and neither gateway nor site is recorded. The hashes are keyed with
+// privacySalt, or else a random key kept in <corpusDir>/.key, since the IDs
+// are short enough to be recovered from plain hashes. Payloads that don't
+// decode can't be anonymized that way, every base64 character of them is
+// replaced by A, which keeps their length and the offending characters. GET /admin/corpus returns
+// the corpus as tar.gz for attaching to a bug report; it requires the
+// adminToken as bearer token.
+
+var (
+	corpusMu    sync.Mutex
+	corpusOnce  sync.Once
+	corpusLines map[string]bool
+	corpusKey   []byte
+)
+
+func init() {
+	adminMux.HandleFunc("/admin/corpus", requireAdminToken(serveCorpus))
+}
+
+// loadCorpus reads the lines already in the corpus and the key of its
+// hashes. corpusMu must be held.
+func loadCorpus(dir string) {
+	corpusKey = []byte(currentConfig().PrivacySalt)
+	if len(corpusKey) == 0 {
+		key, err := loadCorpusKey(filepath.Join(dir, ".key"))
+		if err != nil {
+			logger.Errorf("Couldn't load the corpus key: %s", err)
+		}
+		corpusKey = key
+	}
+
+	corpusLines = map[string]bool{}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.capture"))
+	for _, file := range files {
+		readCapture(file, func(c captureRecord) error {
+			corpusLines[c.Line] = true
+			return nil
+		})
+	}
+}
+
+// loadCorpusKey reads the random key at path, creating it if it doesn't
+// exist yet. Without a key file a new key is used until the next restart.
+func loadCorpusKey(path string) ([]byte, error) {
+	if key, err := ioutil.ReadFile(path); err == nil && len(key) > 0 {
+		return key, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return key, err
+	}
+	return key, ioutil.WriteFile(path, key, 0600)
+}
+
+// recordFailure adds the anonymized gateway line message, received at t,
+// to the corpus file of reason.
+func recordFailure(message, reason string, t time.Time) {
+	cfg := currentConfig()
+	dir := cfg.CorpusDir
+	if dir == "" {
+		return
+	}
+	corpusMu.Lock()
+	defer corpusMu.Unlock()
+	corpusOnce.Do(func() { loadCorpus(dir) })
+	line := anonymizeLine(message, corpusKey)
+	if corpusLines[line] || len(corpusLines) >= cfg.CorpusMax {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.Errorf("Couldn't create corpus directory: %s", err)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(dir, reason+".capture"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Errorf("Couldn't open corpus file: %s", err)
+		return
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s\tcorpus\t\t%s\n", t.UTC().Format(captureTimeFormat), line); err != nil {
+		logger.Errorf("Couldn't write corpus file: %s", err)
+		return
+	}
+	corpusLines[line] = true
+}
+
+// anonymizeLine replaces the inverter and PAN ID of a telegram line with
+// hashes of them keyed with key. The base64 characters of payloads that
+// don't decode are all replaced.
+func anonymizeLine(message string, key []byte) string {
+	if len(message) <= 21 {
+		return message
+	}
+	payload := message[21:]
+	p, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return message[:21] + strings.Map(func(c rune) rune {
+			if strings.ContainsRune(base64URLAlphabet, c) {
+				return 'A'
+			}
+			return c
+		}, payload)
+	}
+	for _, field := range [][2]int{{0, 4}, {4, 6}} {
+		if len(p) < field[1] {
+			break
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(p[field[0]:field[1]])
+		copy(p[field[0]:field[1]], mac.Sum(nil))
+	}
+	return message[:21] + base64.RawURLEncoding.EncodeToString(p)
+}
+
+const base64URLAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+func serveCorpus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dir := currentConfig().CorpusDir
+	if dir == "" {
+		http.Error(w, "corpusDir not configured", http.StatusNotFound)
+		return
+	}
+
+	corpusMu.Lock()
+	defer corpusMu.Unlock()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := "enecsys-corpus-" + time.Now().Format("20060102") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, file := range files {
+		if !file.Mode().IsRegular() || !strings.HasSuffix(file.Name(), ".capture") {
+			continue
+		}
+		if err := addBackupFile(tw, backupFile{"corpus/" + file.Name(), filepath.Join(dir, file.Name()), file.Size(), file.ModTime()}); err != nil {
+			logger.Errorf("Couldn't add %s to the corpus download: %s", file.Name(), err)
+			return
+		}
+	}
+	tw.Close()
+	zw.Close()
+}
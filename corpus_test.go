@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func telegramLine(r reading) string {
+	return strings.Repeat("0", 18) + "WS=" + encodeWS(r)
+}
+
+func TestAnonymizeLine(t *testing.T) {
+	r := simulatedReading(3, time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC), 200)
+	line := telegramLine(r)
+
+	a := anonymizeLine(line, []byte("one"))
+	if a != anonymizeLine(line, []byte("one")) {
+		t.Error("pseudonyms with the same key differ")
+	}
+	if a == anonymizeLine(line, []byte("two")) {
+		t.Error("pseudonyms don't depend on the key")
+	}
+
+	decoded, err := decodeWS(a[21:])
+	if err != nil {
+		t.Fatalf("anonymized line doesn't decode: %s", err)
+	}
+	if decoded.ID == r.ID {
+		t.Errorf("inverter ID %s kept", r.ID)
+	}
+	if decoded.DCPower != mustDecode(t, line).DCPower {
+		t.Errorf("DC power changed from %g to %g", mustDecode(t, line).DCPower, decoded.DCPower)
+	}
+}
+
+func TestAnonymizeUndecodableLine(t *testing.T) {
+	line := strings.Repeat("0", 18) + "WS=0f2a91cc!Zz9-_"
+	want := strings.Repeat("0", 18) + "WS=AAAAAAAA!AAAAA"
+	if got := anonymizeLine(line, []byte("key")); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestCorpusReplay records failed lines and reads the corpus back the way
+// the replay subcommand does.
+func TestCorpusReplay(t *testing.T) {
+	dir := t.TempDir()
+	c := defaultConfig()
+	c.CorpusDir = dir
+	setConfig(c)
+	defer setConfig(defaultConfig())
+	// corpusDir is read once, load the corpus of this test's directory
+	corpusOnce = sync.Once{}
+
+	r := simulatedReading(0, time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC), 200)
+	line := telegramLine(r)
+	now := time.Now()
+	recordFailure(line, "invalid_values", now)
+	recordFailure(line, "invalid_values", now)
+	recordFailure(line[:40]+"!", "decode_error", now)
+
+	if _, err := os.Stat(filepath.Join(dir, ".key")); err != nil {
+		t.Errorf("corpus key not kept: %s", err)
+	}
+
+	var lines []string
+	err := readCapture(filepath.Join(dir, "invalid_values.capture"), func(c captureRecord) error {
+		lines = append(lines, c.Line)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want the line once", len(lines))
+	}
+	replayed := mustDecode(t, lines[0])
+	if replayed.ID == r.ID {
+		t.Errorf("inverter ID %s in the corpus", r.ID)
+	}
+
+	err = readCapture(filepath.Join(dir, "decode_error.capture"), func(c captureRecord) error {
+		if strings.Contains(c.Line, line[21:40]) {
+			t.Errorf("payload of an undecodable line in the corpus: %s", c.Line)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustDecode(t *testing.T, line string) reading {
+	t.Helper()
+	r, err := decodeWS(line[21:])
+	if err != nil {
+		t.Fatalf("%s doesn't decode: %s", line, err)
+	}
+	return r
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The inverters reset their daily Wh counter (enecsys_watthours_today)
+// once a day. Every reset is counted, and the last value before the reset
+// is exported and written to the daily_reset_wh history column of the first
+// row after it, so energy accounting pipelines can verify that nothing was
+// lost across the rollover.
+//
+// A reset is unexpected if it happens while the sun is up at the site (if
+// its location is known) or more than once a day, which emits a
+// daily_reset_unexpected event.
+//
+// Both energy counters are gauges, which rate() and increase() can't take.
+// enecsys_energy_produced_watt_hours_total (tracing.go) counts the increases
+// of the lifetime counter, continued across its kWh rollover, and
+// enecsys_daily_energy_watt_hours_total those of the daily counter,
+// continued across its resets: after a reset the new value is added.
+
+var (
+	enecDailyResets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_daily_resets_total",
+		Help: "Resets of the inverter's daily Wh counter.",
+	},
+		[]string{"id", "site"},
+	)
+	enecDailyResetWh = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_daily_reset_previous_watthours",
+		Help: "Value of the daily Wh counter before its last reset.",
+	},
+		[]string{"id", "site"},
+	)
+	enecDailyEnergy = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_daily_energy_watt_hours_total",
+		Help: "Increases of the inverter's daily Wh counter, continued across its resets.",
+	},
+		[]string{"id", "site"},
+	)
+	enecDailyResetTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_daily_reset_timestamp_seconds",
+		Help: "Unix time of the first reading after the last reset of the daily Wh counter.",
+	},
+		[]string{"id", "site"},
+	)
+)
+
+var (
+	resetDayMu sync.Mutex
+	resetDay   = map[string]string{}
+)
+
+func init() {
+	prometheus.MustRegister(enecDailyResets)
+	prometheus.MustRegister(enecDailyResetWh)
+	prometheus.MustRegister(enecDailyResetTime)
+	prometheus.MustRegister(enecDailyEnergy)
+}
+
+// countDailyEnergy adds the increase of the daily counter from prev to r
+// to enecsys_daily_energy_watt_hours_total.
+func countDailyEnergy(prev, r reading) {
+	if !r.valid("wh") {
+		return
+	}
+	wh := r.Wh - prev.Wh
+	if r.DailyReset {
+		wh = r.Wh
+	}
+	if wh > 0 {
+		enecDailyEnergy.WithLabelValues(r.ID, r.Site).Add(wh)
+	}
+}
+
+// detectDailyReset marks r if its daily counter went down since prev.
+func detectDailyReset(prev reading, r *reading) {
+	if !r.valid("wh") || r.Wh >= prev.Wh {
+		return
+	}
+	r.DailyReset = true
+	r.ResetWh = prev.Wh
+}
+
+// recordDailyReset exports the reset marked on r.
+func recordDailyReset(r reading) {
+	if !r.DailyReset {
+		return
+	}
+	fmt.Println("Daily counter of", r.ID, "reset from", r.ResetWh, "to", r.Wh)
+	enecDailyResets.WithLabelValues(r.ID, r.Site).Inc()
+	enecDailyResetWh.WithLabelValues(r.ID, r.Site).Set(r.ResetWh)
+	enecDailyResetTime.WithLabelValues(r.ID, r.Site).Set(float64(r.Time.Unix()))
+
+	day := siteDay(r.Time)
+	resetDayMu.Lock()
+	again := resetDay[r.ID] == day
+	resetDay[r.ID] = day
+	resetDayMu.Unlock()
+
+	reason := ""
+	if daylight, known := isDaylight(r.Site, r.Time); known && daylight {
+		reason = "during daylight"
+	} else if again {
+		reason = "for the second time today"
+	}
+	if reason != "" {
+		emitEvent(event{Kind: "daily_reset_unexpected", Severity: severityWarning, Inverter: r.ID, Time: r.Time,
+			Message: fmt.Sprintf("Daily counter of inverter %s reset %s, from %.0f to %.0f Wh", r.ID, reason, r.ResetWh, r.Wh)})
+	}
+}
+
+func deleteDailyResetSeries(id, siteName string) {
+	enecDailyResets.DeleteLabelValues(id, siteName)
+	enecDailyResetWh.DeleteLabelValues(id, siteName)
+	enecDailyResetTime.DeleteLabelValues(id, siteName)
+	enecDailyEnergy.DeleteLabelValues(id, siteName)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// Debug endpoints, to find memory and goroutine leaks of a long running
+// exporter in place:
+//
+//	GET /debug/pprof/   the Go profiler, e.g.
+//	                    go tool pprof -http=: http://localhost:5041/debug/pprof/heap
+//	GET /debug/vars     runtime stats (memstats) and the command line as JSON
+//
+// They are always served on the admin port, behind the adminToken. With
+//
+//	pprof: true
+//
+// they are served on the public port too, without token - only for
+// exporters whose public port isn't reachable from untrusted networks. The
+// setting takes effect on a config reload.
+
+var debugHandlers = map[string]http.HandlerFunc{
+	"/debug/pprof/":        pprof.Index,
+	"/debug/pprof/cmdline": pprof.Cmdline,
+	"/debug/pprof/profile": pprof.Profile,
+	"/debug/pprof/symbol":  pprof.Symbol,
+	"/debug/pprof/trace":   pprof.Trace,
+	"/debug/vars":          expvar.Handler().ServeHTTP,
+}
+
+func init() {
+	for path, handler := range debugHandlers {
+		adminMux.HandleFunc(path, requireAdminToken(handler))
+		publicMux.HandleFunc(path, requirePprof(handler))
+	}
+}
+
+// requirePprof serves handler only if pprof is enabled.
+func requirePprof(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !currentConfig().Pprof {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// reading holds the values decoded from one WS telegram.
+type reading struct {
+	ID string
+	// Zigbee PAN ID of the network the telegram was relayed through
+	PAN  string
+	Hex  string
+	Time time.Time
+	Site string
+	// when the line was read, for enecsys_frame_processing_seconds
+	Read time.Time
+
+	Temperature float64
+	Wh          float64
+	Kwh         float64
+	LifeWh      float64
+	LifeKwh     float64
+	Time1       float64
+	Time2       float64
+	DCPower     float64
+	DCVolt      float64
+	DCCurrent   float64
+	Efficiency  float64
+	ACPower     float64
+	ACVolt      float64
+	ACCurrent   float64
+	ACFreq      float64
+
+	// values that failed validation, by topic, see validate.go
+	Invalid map[string]string
+
+	// set if the daily counter was reset since the previous reading, with
+	// its last value before the reset, see dailyreset.go
+	DailyReset bool
+	ResetWh    float64
+
+	// implausible increase of the lifetime counter since the previous
+	// reading, excluded from the accounting, see lifetimejump.go
+	LifetimeJump float64
+
+	// trace ID of the frame if tracing is enabled, see tracing.go
+	Trace string
+}
+
+// decodeWS decodes the base64 payload of a WS telegram, i.e. everything
+// after "WS=".
+func decodeWS(data string) (reading, error) {
+	p, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return reading{}, err
+	}
+	hexzigbee := hex.EncodeToString(p)
+	if len(hexzigbee) < 74 {
+		return reading{}, fmt.Errorf("payload too short: %d hex digits", len(hexzigbee))
+	}
+
+	r := reading{
+		ID:   hexzigbee[0:8],
+		PAN:  hexzigbee[8:12],
+		Hex:  hexzigbee,
+		Time: time.Now(),
+	}
+
+	r.Temperature = hexValue(hexzigbee[64:66])
+	r.Wh = hexValue(hexzigbee[66:70])
+	r.Kwh = hexValue(hexzigbee[70:74])
+	r.LifeWh = 1000*r.Kwh + r.Wh
+	r.LifeKwh = r.Kwh + 0.001*r.Wh
+	r.Time1 = hexValue(hexzigbee[18:22])
+	r.Time2 = hexValue(hexzigbee[30:36])
+	r.DCPower = hexValue(hexzigbee[50:54])
+	r.DCCurrent = 0.025 * hexValue(hexzigbee[46:50])
+	r.DCVolt = r.DCPower / r.DCCurrent
+	r.Efficiency = 0.1 * hexValue(hexzigbee[54:58])
+	r.ACPower = r.DCPower * r.Efficiency / 100
+	r.ACVolt = hexValue(hexzigbee[60:64])
+	r.ACCurrent = r.ACPower / r.ACVolt
+	r.ACFreq = hexValue(hexzigbee[58:60])
+
+	return r, nil
+}
+
+// encodeWS is the inverse of decodeWS, used to simulate inverters. Values
+// derived on decoding (volts, AC power and current) are ignored.
+func encodeWS(r reading) string {
+	p := make([]byte, 42)
+	id, _ := hex.DecodeString(r.ID)
+	copy(p, id)
+	pan, _ := hex.DecodeString(r.PAN)
+	copy(p[4:6], pan)
+	putHex := func(offset, digits int, value float64) {
+		v := uint64(value + 0.5)
+		for i := digits/2 - 1; i >= 0; i-- {
+			p[offset/2+i] = byte(v)
+			v >>= 8
+		}
+	}
+	putHex(18, 4, r.Time1)
+	putHex(30, 6, r.Time2)
+	putHex(46, 4, r.DCCurrent/0.025)
+	putHex(50, 4, r.DCPower)
+	putHex(54, 4, r.Efficiency*10)
+	putHex(58, 2, r.ACFreq)
+	putHex(60, 4, r.ACVolt)
+	putHex(64, 2, r.Temperature)
+	putHex(66, 4, r.Wh)
+	putHex(70, 4, r.Kwh)
+	return base64.RawURLEncoding.EncodeToString(p)
+}
+
+// hexValue parses a slice of the hex encoded payload. The input always comes
+// from hex.EncodeToString, so parsing can't fail.
+func hexValue(data string) float64 {
+	dec, _ := strconv.ParseUint(data, 16, 32)
+	return float64(dec)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Decode error burst detection. Telegrams that fail to decode are counted
+// per site and minute. When more than decodeErrorThreshold (default 5)
+// errors per minute persist for decodeErrorPeriod (default 10m) an event is
+// raised - the typical symptom of a gateway firmware change or a failing
+// serial bridge - and another one once the rate drops again.
+
+var (
+	enecDecodeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_decode_errors_total",
+		Help: "Telegrams that failed to decode.",
+	},
+		[]string{"site"},
+	)
+	enecDecodeBurst = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_decode_error_burst",
+		Help: "1 while the decode error rate is above the threshold for the configured period.",
+	},
+		[]string{"site"},
+	)
+
+	decodeErrMu     sync.Mutex
+	decodeErrCounts = map[string]int{}
+)
+
+func init() {
+	prometheus.MustRegister(enecDecodeErrors)
+	prometheus.MustRegister(enecDecodeBurst)
+}
+
+func countDecodeError(siteName string) {
+	enecDecodeErrors.WithLabelValues(siteName).Inc()
+
+	decodeErrMu.Lock()
+	decodeErrCounts[siteName]++
+	decodeErrMu.Unlock()
+}
+
+type burstState struct {
+	aboveSince time.Time
+	burst      bool
+}
+
+// watchDecodeErrors evaluates the error rate every minute. It never
+// returns.
+func watchDecodeErrors() {
+	cfg := currentConfig()
+	threshold := cfg.DecodeErrorThreshold
+	period := cfg.DecodeErrorPeriod
+	states := map[string]*burstState{}
+
+	for now := range time.Tick(time.Minute) {
+		decodeErrMu.Lock()
+		counts := decodeErrCounts
+		decodeErrCounts = map[string]int{}
+		decodeErrMu.Unlock()
+
+		for siteName := range counts {
+			if states[siteName] == nil {
+				states[siteName] = &burstState{}
+			}
+		}
+
+		for siteName, state := range states {
+			n := counts[siteName]
+			if float64(n) <= threshold {
+				state.aboveSince = time.Time{}
+				if state.burst {
+					state.burst = false
+					enecDecodeBurst.WithLabelValues(siteName).Set(0)
+					emitEvent(event{Kind: "decode_errors_recovered", Severity: severityInfo, Site: siteName,
+						Message: fmt.Sprintf("Decode errors back to %d per minute", n)})
+				}
+				continue
+			}
+
+			if state.aboveSince.IsZero() {
+				state.aboveSince = now
+			}
+			if !state.burst && now.Sub(state.aboveSince) >= period {
+				state.burst = true
+				enecDecodeBurst.WithLabelValues(siteName).Set(1)
+				emitEvent(event{Kind: "decode_error_burst", Severity: severityWarning, Site: siteName,
+					Message: fmt.Sprintf("%d decode errors per minute for %s, check the gateway", n, period)})
+			}
+		}
+	}
+}
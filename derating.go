@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Thermal derating: micro inverters reduce their output when they get too
+// hot, which points to a failing thermal interface. An inverter is derating
+// when its temperature is at least deratingTemperature (default 60 °C) and
+// its power is below deratingRatio (default 0.8) of the median of its
+// peers, the other online inverters of the same array (or of the site for
+// inverters without array), while the peers' power is steady, i.e. the
+// irradiance doesn't change. At least two peers are needed. Powers are
+// compared relative to ratedWatts, so inverters of different sizes can be
+// peers; inverters without ratedWatts are only compared in watts with peers
+// that have none either. Readings with an invalid temperature or power are
+// left out. The state
+// clears once the power recovers or the temperature drops 5 °C below the
+// threshold, and both transitions are events.
+//
+// The temperature trend is exported as well, smoothed over the last
+// readings.
+
+const (
+	// peers are steady if their median changed less than that since the
+	// inverter's previous reading
+	peerStability = 0.1
+	// hysteresis of the temperature threshold
+	deratingHysteresis = 5.0
+)
+
+var (
+	enecDerating = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_thermal_derating",
+		Help: "1 if the inverter is hot and produces less than its steady peers.",
+	},
+		[]string{"id", "site"},
+	)
+	enecTemperatureTrend = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_temperature_trend_celsius_per_hour",
+		Help: "Smoothed rate of change of the inverter temperature.",
+	},
+		[]string{"id", "site"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(enecDerating)
+	prometheus.MustRegister(enecTemperatureTrend)
+}
+
+type thermalState struct {
+	trend      float64
+	peerMedian float64
+	derating   bool
+}
+
+var (
+	thermalMu sync.Mutex
+	thermal   = map[string]*thermalState{}
+)
+
+// trackThermal updates the temperature trend and derating state of r's
+// inverter. prev is its previous reading, if hasPrev.
+func trackThermal(prev reading, hasPrev bool, r reading) {
+	if !r.valid("temperature") || !r.valid("acpower") {
+		return
+	}
+	cfg := currentConfig()
+	median, peers := peerPower(r)
+
+	thermalMu.Lock()
+	s := thermal[r.ID]
+	if s == nil {
+		s = &thermalState{}
+		thermal[r.ID] = s
+	}
+
+	if dt := r.Time.Sub(prev.Time); hasPrev && prev.valid("temperature") && dt > 0 && dt <= 15*time.Minute {
+		slope := (r.Temperature - prev.Temperature) / dt.Hours()
+		s.trend = 0.8*s.trend + 0.2*slope
+	}
+	enecTemperatureTrend.WithLabelValues(r.ID, r.Site).Set(s.trend)
+
+	steady := peers >= 2 && s.peerMedian > 0 && math.Abs(median-s.peerMedian)/s.peerMedian < peerStability
+	s.peerMedian = median
+	if peers < 2 {
+		s.peerMedian = 0
+	}
+
+	ratio := 1.0
+	if median > 0 {
+		ratio = relativePower(r) / median
+	}
+	was := s.derating
+	switch {
+	case !s.derating && steady && r.Temperature >= cfg.DeratingTemperature && ratio < cfg.DeratingRatio:
+		s.derating = true
+	case s.derating && (ratio >= cfg.DeratingRatio || r.Temperature < cfg.DeratingTemperature-deratingHysteresis):
+		s.derating = false
+	}
+	derating := s.derating
+	thermalMu.Unlock()
+
+	if derating {
+		enecDerating.WithLabelValues(r.ID, r.Site).Set(1)
+	} else {
+		enecDerating.WithLabelValues(r.ID, r.Site).Set(0)
+	}
+	if derating && !was {
+		emitEvent(event{Kind: "thermal_derating", Severity: severityWarning, Inverter: r.ID, Time: r.Time,
+			Message: fmt.Sprintf("Inverter %s is derating at %.0f °C, producing %.0f%% of its peers", r.ID, r.Temperature, ratio*100)})
+	} else if was && !derating {
+		emitEvent(event{Kind: "thermal_derating_cleared", Severity: severityInfo, Inverter: r.ID, Time: r.Time,
+			Message: fmt.Sprintf("Inverter %s is no longer derating", r.ID)})
+	}
+}
+
+// peerPower returns the median relative power of the peers of r's inverter
+// and their number.
+func peerPower(r reading) (float64, int) {
+	info := inverter(r.ID)
+	var powers []float64
+	for _, peer := range currentReadings() {
+		if peer.ID == r.ID || peer.Site != r.Site || !peer.valid("acpower") {
+			continue
+		}
+		if p := inverter(peer.ID); p.Array != info.Array || (p.RatedWatts > 0) != (info.RatedWatts > 0) {
+			continue
+		}
+		powers = append(powers, relativePower(peer))
+	}
+	if len(powers) == 0 {
+		return 0, 0
+	}
+	sort.Float64s(powers)
+	middle := len(powers) / 2
+	if len(powers)%2 == 0 {
+		return (powers[middle-1] + powers[middle]) / 2, len(powers)
+	}
+	return powers[middle], len(powers)
+}
+
+// relativePower returns the AC power of r as a fraction of the inverter's
+// rated power, or in watts if the rating isn't configured.
+func relativePower(r reading) float64 {
+	if rated := inverter(r.ID).RatedWatts; rated > 0 {
+		return r.ACPower / rated
+	}
+	return r.ACPower
+}
+
+func deleteThermalSeries(id, siteName string) {
+	enecDerating.DeleteLabelValues(id, siteName)
+	enecTemperatureTrend.DeleteLabelValues(id, siteName)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Home Assistant MQTT discovery. With homeAssistant set, the exporter
+// publishes a retained config message to
+// <homeAssistantPrefix>/sensor/enecsys_<id>/<topic>/config (prefix default
+// homeassistant) for every inverter and the values below, along with the
+// metadata. Home Assistant then creates one device per inverter, named
+// after it in the site file, with entities of the right unit and device
+// class that follow the availability topic of the inverter and the bridge
+// state of the exporter: they are unavailable while either is offline.
+
+type discoverySensor struct {
+	topic       string
+	name        string
+	unit        string
+	deviceClass string
+	stateClass  string
+}
+
+var discoverySensors = []discoverySensor{
+	{"acpower", "AC power", "W", "power", "measurement"},
+	{"dcpower", "DC power", "W", "power", "measurement"},
+	{"wh", "Energy today", "Wh", "energy", "total_increasing"},
+	{"lifeWh", "Energy total", "Wh", "energy", "total_increasing"},
+	{"temperature", "Temperature", "°C", "temperature", "measurement"},
+	{"acvolt", "AC voltage", "V", "voltage", "measurement"},
+	{"dcvolt", "DC voltage", "V", "voltage", "measurement"},
+	{"accurrent", "AC current", "A", "current", "measurement"},
+	{"dccurrent", "DC current", "A", "current", "measurement"},
+	{"acfreq", "AC frequency", "Hz", "frequency", "measurement"},
+}
+
+type discoveryDevice struct {
+	Identifiers   []string `json:"identifiers"`
+	Name          string   `json:"name"`
+	Manufacturer  string   `json:"manufacturer"`
+	Model         string   `json:"model,omitempty"`
+	SerialNumber  string   `json:"serial_number,omitempty"`
+	SuggestedArea string   `json:"suggested_area,omitempty"`
+}
+
+type discoveryAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type discoveryConfig struct {
+	Name              string                  `json:"name"`
+	UniqueID          string                  `json:"unique_id"`
+	StateTopic        string                  `json:"state_topic"`
+	ValueTemplate     string                  `json:"value_template,omitempty"`
+	Availability      []discoveryAvailability `json:"availability"`
+	AvailabilityMode  string                  `json:"availability_mode"`
+	UnitOfMeasurement string                  `json:"unit_of_measurement"`
+	DeviceClass       string                  `json:"device_class"`
+	StateClass        string                  `json:"state_class"`
+	Device            discoveryDevice         `json:"device"`
+}
+
+// discoveryNode returns the node ID of inverter id in discovery topics,
+// which only allow letters, digits, underscores and dashes.
+func discoveryNode(id string) string {
+	return "enecsys_" + strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' {
+			return c
+		}
+		return '_'
+	}, id)
+}
+
+// publishDiscovery publishes the discovery config of every sensor of
+// inverter id.
+func publishDiscovery(id string) {
+	cfg := currentConfig()
+	if !cfg.HomeAssistant {
+		return
+	}
+	info := inverter(id)
+	device := discoveryDevice{
+		Identifiers:   []string{discoveryNode(id)},
+		Name:          info.Name,
+		Manufacturer:  "Enecsys",
+		Model:         info.Model,
+		SerialNumber:  info.Serial,
+		SuggestedArea: inverterSite(id),
+	}
+	if device.Name == "" {
+		device.Name = "Enecsys " + id
+	}
+
+	node := discoveryNode(id)
+	for _, s := range discoverySensors {
+		c := discoveryConfig{
+			Name:       s.name,
+			UniqueID:   node + "_" + s.topic,
+			StateTopic: inverterTopic(id, s.topic),
+			Availability: []discoveryAvailability{
+				{Topic: inverterTopic(id, "availability")},
+				{Topic: bridgeStateTopic},
+			},
+			AvailabilityMode:  "all",
+			UnitOfMeasurement: s.unit,
+			DeviceClass:       s.deviceClass,
+			StateClass:        s.stateClass,
+			Device:            device,
+		}
+		// Without the value topics the entities read the state document.
+		if cfg.MqttPayload == "json" {
+			c.StateTopic = inverterTopic(id, "state")
+			c.ValueTemplate = "{{ value_json." + s.topic + " }}"
+		}
+		payload, err := json.Marshal(c)
+		if err != nil {
+			logger.Errorf("Couldn't encode discovery config for %s: %s", id, err)
+			return
+		}
+		publishRetained(cfg.HomeAssistantPrefix+"/sensor/"+node+"/"+s.topic+"/config", string(payload))
+	}
+}
@@ -2,375 +2,483 @@ package main
 
 import (
 	"bufio"
-	"encoding/base64"
-	"encoding/hex"
 	"fmt"
-	"log"
+	"math"
 	"net"
-	"net/http"
 	"os"
-	"strconv"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/goccy/go-yaml"
 	"github.com/juju/loggo"
 	"github.com/juju/loggo/loggocolor"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	config = map[string]string{}
 	logger = loggo.GetLogger("")
 
-	enecTemperature = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_temperature",
-		Help: "Temperature of the solar panel.",
+	// Time from reading a line until every output has its values, observed
+	// by the record worker for telegrams. MQTT publishing is asynchronous
+	// and only counted up to the queues of the brokers.
+	enecFrameDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "enecsys_frame_processing_seconds",
+		Help:    "Processing time of gateway lines, by kind (telegram, other).",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .5},
 	},
-		[]string{"id"},
-	)
-	enecWh = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_watthours_today",
-		Help: "Watt hours produced today.",
-	},
-		[]string{"id"},
-	)
-	enecKwh = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_kilowatthours_history",
-		Help: "Watt hours produced in history.",
-	},
-		[]string{"id"},
-	)
-	enecLifekwh = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_kilowatthours_total",
-		Help: "Watt hours produced in total.",
-	},
-		[]string{"id"},
-	)
-	enecTime1 = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_time1",
-		Help: "Time 1.",
-	},
-		[]string{"id"},
-	)
-	enecTime2 = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_time2",
-		Help: "Time 2.",
-	},
-		[]string{"id"},
-	)
-	enecDcpower = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_dc_power",
-		Help: "DC power.",
-	},
-		[]string{"id"},
-	)
-	enecDcvolt = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_dc_volt",
-		Help: "DC voltage.",
-	},
-		[]string{"id"},
-	)
-	enecDccurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_dc_current",
-		Help: "DC current.",
-	},
-		[]string{"id"},
-	)
-	enecEfficiency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_efficiency",
-		Help: "Inverter efficiency.",
-	},
-		[]string{"id"},
-	)
-	enecAcpower = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_ac_power",
-		Help: "AC power.",
-	},
-		[]string{"id"},
-	)
-	enecAcvolt = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_ac_volt",
-		Help: "AC voltage.",
-	},
-		[]string{"id"},
-	)
-	enecAccurrent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_ac_current",
-		Help: "AC current.",
-	},
-		[]string{"id"},
-	)
-	enecAcfreq = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "enecsys_ac_frequency",
-		Help: "AC frequency.",
-	},
-		[]string{"id"},
+		[]string{"kind"},
 	)
 )
 
+// field describes how one value of a reading is exported: as metric with
+// help by readingCollector (see metricstore.go) and to MQTT. publish, if
+// set, overrides the value sent to MQTT. precision is the default number of
+// decimals in MQTT and JSON outputs, see precision.go.
+type field struct {
+	label     string
+	topic     string
+	metric    string
+	help      string
+	value     func(r *reading) float64
+	publish   func(r *reading) float64
+	precision int
+}
+
+var fields = []field{
+	{label: "Temperature", topic: "temperature", precision: 0, metric: "enecsys_temperature", help: "Temperature of the solar panel.",
+		value: func(r *reading) float64 { return r.Temperature }},
+	{label: "Wh", topic: "wh", precision: 0, metric: "enecsys_watthours_today", help: "Watt hours produced today.",
+		value: func(r *reading) float64 { return r.Wh }},
+	{label: "kWh", topic: "kwh", precision: 0, metric: "enecsys_kilowatthours_history", help: "Watt hours produced in history.",
+		value: func(r *reading) float64 { return r.Kwh }},
+	{label: "life_kWh", topic: "lifeWh", precision: 0, metric: "enecsys_kilowatthours_total", help: "Watt hours produced in total.",
+		value: func(r *reading) float64 { return r.LifeKwh }, publish: func(r *reading) float64 { return r.LifeWh }},
+	{label: "Time 1", topic: "time1", precision: 0, metric: "enecsys_time1", help: "Time 1.",
+		value: func(r *reading) float64 { return r.Time1 }},
+	{label: "Time 2", topic: "time2", precision: 0, metric: "enecsys_time2", help: "Time 2.",
+		value: func(r *reading) float64 { return r.Time2 }},
+	{label: "DCPower", topic: "dcpower", precision: 0, metric: "enecsys_dc_power", help: "DC power.",
+		value: func(r *reading) float64 { return r.DCPower }},
+	{label: "DCVolt", topic: "dcvolt", precision: 1, metric: "enecsys_dc_volt", help: "DC voltage.",
+		value: func(r *reading) float64 { return r.DCVolt }},
+	{label: "DCCurrent", topic: "dccurrent", precision: 2, metric: "enecsys_dc_current", help: "DC current.",
+		value: func(r *reading) float64 { return r.DCCurrent }},
+	{label: "Efficiency", topic: "efficiency", precision: 1, metric: "enecsys_efficiency", help: "Inverter efficiency.",
+		value: func(r *reading) float64 { return r.Efficiency }},
+	{label: "ACPower", topic: "acpower", precision: 0, metric: "enecsys_ac_power", help: "AC power.",
+		value: func(r *reading) float64 { return r.ACPower }},
+	{label: "ACVolt", topic: "acvolt", precision: 0, metric: "enecsys_ac_volt", help: "AC voltage.",
+		value: func(r *reading) float64 { return r.ACVolt }},
+	{label: "ACCurrent", topic: "accurrent", precision: 2, metric: "enecsys_ac_current", help: "AC current.",
+		value: func(r *reading) float64 { return r.ACCurrent }},
+	{label: "ACFreq", topic: "acfreq", precision: 0, metric: "enecsys_ac_frequency", help: "AC frequency.",
+		value: func(r *reading) float64 { return r.ACFreq }},
+}
+
 func init() {
 
 	loggo.ConfigureLoggers("<root>=ERROR")
 	loggo.ReplaceDefaultWriter(loggocolor.NewColorWriter(os.Stderr))
 
 	// Metrics have to be registered to be exposed:
-	prometheus.MustRegister(enecTemperature)
-	prometheus.MustRegister(enecWh)
-	prometheus.MustRegister(enecKwh)
-	prometheus.MustRegister(enecLifekwh)
-	prometheus.MustRegister(enecTime1)
-	prometheus.MustRegister(enecTime2)
-	prometheus.MustRegister(enecDcpower)
-	prometheus.MustRegister(enecDcvolt)
-	prometheus.MustRegister(enecDccurrent)
-	prometheus.MustRegister(enecEfficiency)
-	prometheus.MustRegister(enecAcpower)
-	prometheus.MustRegister(enecAcvolt)
-	prometheus.MustRegister(enecAccurrent)
-	prometheus.MustRegister(enecAcfreq)
+	prometheus.MustRegister(enecFrameDuration)
+	onMqttRepublish(republishValues)
 }
 
+// getCredentials loads the config file. A missing file leaves the defaults
+// in place, an invalid one ends the program.
 func getCredentials(credentialsFile string) {
-
-	osFile, err := os.Open(credentialsFile)
-	if err != nil {
-		logger.Infof(fmt.Sprintf("Couldn't read credentials file: %s", err.Error()))
+	parsed, problems, err := readConfig(credentialsFile)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Criticalf("Couldn't parse config file: %s", err)
+		os.Exit(1)
 	}
-
-	err = yaml.NewDecoder(osFile).Decode(&config)
-
-	config["mqtt"] = "ok"
-
 	if err != nil {
-		logger.Errorf(fmt.Sprintf("Couldn't parse config file: %s", err.Error()))
-		config["mqtt"] = "impossible"
+		logger.Infof("Couldn't read credentials file: %s", err)
+	}
+	if problems = append(problems, parsed.validate()...); len(problems) > 0 {
+		for _, problem := range problems {
+			logger.Criticalf("%s: %s", credentialsFile, problem)
+		}
+		os.Exit(1)
 	}
+	setConfig(parsed)
+	loggo.ConfigureLoggers("<root>=" + parsed.LogLevel)
 
-	_, ok := config["userName"]
-	if !ok {
+	if parsed.UserName == "" {
 		logger.Errorf("userName missing.")
-		config["mqtt"] = "impossible"
 	}
-	_, ok = config["password"]
-	if !ok {
+	if parsed.Password == "" {
 		logger.Errorf("password missing.")
-		config["mqtt"] = "impossible"
 	}
-	_, ok = config["mqttAddress"]
-	if !ok {
+	if parsed.MqttAddress == "" {
 		logger.Errorf("mqttAddress missing.")
-		config["mqtt"] = "impossible"
 	}
-	_, ok = config["clientName"]
-	if !ok {
+	if parsed.ClientName == "" {
 		logger.Errorf("clientName missing.")
-		config["mqtt"] = "impossible"
 	}
-	if config["mqtt"] != "ok" {
+	if !parsed.mqttEnabled() {
 		logger.Errorf("YAML file needs to have this structure:\n\n---\nuserName: valUserName\npassword: valPassword\nmqttAddress: \"tcp://host:1883\"\nclientName: valClientName\n\nNo MQTT publishing will be active")
 	} else {
 		logger.Errorf("MQTT publishing active!")
 	}
 }
 
-func publishMqtt(topic string, value string) {
-	if config["mqtt"] == "ok" {
-
-		mqtt.ERROR = log.New(os.Stdout, "", 0)
-		opts := mqtt.NewClientOptions().AddBroker(config["nmqttAddress"]).SetClientID(config["clientName"])
-		opts.SetUsername(config["userName"])
-		opts.SetPassword(config["password"])
-		opts.SetKeepAlive(2 * time.Second)
-		opts.SetPingTimeout(1 * time.Second)
-
-		client := mqtt.NewClient(opts)
-		if token := client.Connect(); token.Wait() && token.Error() != nil {
-			fmt.Printf("Connection to broker failed: %s", token.Error())
-		} else {
-			fmt.Printf("publishMqtt: pushing to %s value: %s\n", topic, value)
-			token := client.Publish(topic, 0, true, value)
-			token.Wait()
-
-			client.Disconnect(250)
-		}
+// subscribeMqtt keeps a connection to the broker subscribed to topic. The
+// subscription is renewed whenever the client reconnects, and the client
+// rebuilt along with the publishing one. Every subscriber has its own
+// client ID, the clientName followed by role, since brokers drop the older
+// connection of a client ID used twice.
+func subscribeMqtt(role, topic string, handler mqtt.MessageHandler) {
+	if !currentConfig().mqttEnabled() {
+		logger.Errorf("Can't subscribe to %s without MQTT configuration.", topic)
+		return
 	}
+
+	var mu sync.Mutex
+	client := newMqttSubscriber(role, topic, handler)
+	onMqttRestart(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		client.Disconnect(250)
+		client = newMqttSubscriber(role, topic, handler)
+	})
 }
 
-func main() {
+func newMqttSubscriber(role, topic string, handler mqtt.MessageHandler) mqtt.Client {
+	settings := primarySettings()
+	settings.clientID += "-" + role
+	opts := settings.options()
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		if token := client.Subscribe(topic, 0, handler); token.Wait() && token.Error() != nil {
+			logger.Errorf("Subscribing to %s failed: %s", topic, token.Error())
+		}
+	})
 
-	if len(os.Args) > 1 {
-		getCredentials(os.Args[1])
+	client := mqtt.NewClient(opts)
+	client.Connect()
+	return client
+}
+
+// serve receives the gateway connections. It never returns.
+func serve() {
+	cfg := currentConfig()
+	fmt.Println("enecsys-exporter", version, "commit", commit, "built", buildDate)
+	startServices()
+
+	listener, err := net.Listen("tcp", cfg.ListenAddress)
+	if err != nil {
+		fmt.Println("tcp server listener error:", err)
 	} else {
-		logger.Errorf(fmt.Sprintf("If you want MQTT logging, add path to configuration file as first argument to program: %s /path/to/config_file", os.Args[0]))
-		getCredentials("undefined_path_and_file")
+		fmt.Println("listening on", cfg.ListenAddress)
+	}
+
+	for siteName, address := range siteListeners() {
+		s, _ := siteByName(siteName)
+		allow, err := parseAllowlist(s.Allow)
+		if err != nil {
+			fmt.Println("tcp server listener error for site", siteName+":", err)
+			continue
+		}
+		address, err := bindSiteListener(address)
+		if err != nil {
+			fmt.Println("tcp server listener error for site", siteName+":", err)
+			continue
+		}
+		siteListener, err := net.Listen("tcp", address)
+		if err != nil {
+			fmt.Println("tcp server listener error for site", siteName+":", err)
+			continue
+		}
+		fmt.Println("listening for site", siteName, "on", address)
+		startInput(tcpInput{siteListener, ingest{name: "site " + siteName, site: siteName, allow: allow}})
 	}
+	listenTLS()
+	startInput(httpInput{})
+	startInputs()
+
+	plain, err := configIngest("plain", "", "listenAllow", cfg.ListenAllow)
+	if err != nil {
+		logger.Errorf("Ignoring the allowlist: %s", err)
+		plain = ingest{name: "plain"}
+	}
+	if listener != nil {
+		startInput(tcpInput{listener, plain})
+	}
+	select {}
+}
+
+// startServices loads the site file and state and starts the background
+// jobs and HTTP servers, everything but the gateway listeners.
+func startServices() {
+	cfg := currentConfig()
+	if cfg.SiteFile != "" {
+		if err := loadSiteFile(cfg.SiteFile); err != nil {
+			logger.Errorf("Couldn't read site file: %s", err)
+		}
+		go watchSiteFile(cfg.SiteFile, cfg.SiteFileInterval)
+	}
+
+	if cfg.StateFile != "" {
+		if err := restoreSnapshot(cfg.StateFile); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("Couldn't restore state: %s", err)
+		}
+		go saveSnapshots(cfg.StateFile, cfg.SnapshotInterval)
+	}
+	startDay()
 
 	fmt.Println("\nLogging level:")
 	fmt.Println(loggo.LoggerInfo())
 	fmt.Println("")
 
-	listener, err := net.Listen("tcp", "0.0.0.0:5040")
-	if err != nil {
-		fmt.Println("tcp server listener error:", err)
-	} else {
-		fmt.Println("listening...")
+	startMqtt()
+	go watchStaleness(cfg.StaleTimeout)
+	if cfg.SeriesExpiry > 0 {
+		go watchSeriesExpiry(cfg.SeriesExpiry)
 	}
+	startForecast()
+	go watchRollover()
+	startGrid()
+	startCommands()
+	startSleep()
+	go flushHistoryLoop()
+	go watchDecodeErrors()
+	go watchGaps()
+	go watchGateways(cfg.GatewayTimeout)
+	go flushCaptureLoop()
+	go pruneCapturesLoop()
+	startArchive()
+	startPeerSync()
+	startPush()
+	go sendDigests()
+	go shutdownOnSignal()
+
+	startHTTP()
+}
 
-	http.Handle("/metrics", promhttp.Handler())
-	go http.ListenAndServe(":5041", nil)
-
+// acceptGateways hands every connection accepted by listener and allowed
+// by its allowlist to handleConnection. Connections on a listener of a site
+// belong to that site, others to the site listing the gateway's address, if
+// any.
+func acceptGateways(listener net.Listener, in ingest, deliver lineHandler) {
+	trackListener(listener)
 	// Endless listener for TCP connections
 	for {
 		conn, err := listener.Accept()
+		if shuttingDown() {
+			return
+		}
 		if err != nil {
 			fmt.Println("tcp server accept error", err)
+			continue
 		}
-		go handleConnection(conn)
+		if !in.allowed(conn.RemoteAddr()) {
+			logger.Warningf("Rejecting connection from %s on the %s listener", conn.RemoteAddr(), in.name)
+			enecGatewayRejected.WithLabelValues(in.name).Inc()
+			conn.Close()
+			continue
+		}
+		enecConnectionsAccepted.WithLabelValues(in.name).Inc()
+		connSite := in.site
+		if connSite == "" {
+			connSite = siteForGateway(conn.RemoteAddr().String())
+		}
+		go handleConnection(conn, connSite, deliver)
 	}
 }
 
-func handleConnection(conn net.Conn) {
+func handleConnection(conn net.Conn, siteName string, deliver lineHandler) {
+	gateway := gatewayHost(conn.RemoteAddr().String())
+	gatewayConnected(gateway, siteName)
+	defer gatewayDisconnected(gateway, siteName)
+	defer conn.Close()
+	trackConn(conn, true)
+	defer trackConn(conn, false)
+
 	// Test with cat raw.txt | while read line; do echo $line; printf "$line\15" | nc -c 127.0.0.1 5040; done
-	bufferBytes, err := bufio.NewReader(conn).ReadBytes(0x0D)
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(scanCRLines)
+	for line := range stampLines(scanner) {
+		message, now := line.message, line.t
+		gatewayHeartbeat(gateway, siteName, now)
+		deliver(message, gateway, siteName, now)
+		if !isTelegram(message) && isKeepalive(message) {
+			if ack := gatewayKeepalive(gateway, siteName); len(ack) > 0 {
+				conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				if _, err := conn.Write(ack); err != nil {
+					logger.Errorf("Couldn't answer keepalive of %s: %s", gateway, err)
+				}
+			}
+		}
+	}
+}
+
+// isTelegram reports whether a gateway line is a WS telegram.
+func isTelegram(message string) bool {
+	return len(message) == 77 && message[18:20] == "WS"
+}
+
+// handleLine processes one line received at t from gateway of siteName.
+// Lines other than WS telegrams are handed to handleStatusLine.
+func handleLine(message string, gateway string, siteName string, t time.Time) {
+	handleLineRead(message, gateway, siteName, t, t)
+}
 
+// handleLineRead is handleLine for a line read at read, which differs from
+// t when it's replayed.
+func handleLineRead(message string, gateway string, siteName string, t, read time.Time) {
+	enecFramesReceived.WithLabelValues(siteName, frameType(message)).Inc()
+	if !isTelegram(message) {
+		if frameType(message) == "WS" {
+			recordFailure(message, "bad_length", t)
+		}
+		handleStatusLine(message, gateway, siteName, t)
+		enecFrameDuration.WithLabelValues("other").Observe(time.Since(read).Seconds())
+		return
+	}
+
+	fmt.Println(message, "length:", len(message))
+	fmt.Println("Code:", message[18:20])
+
+	r, err := decodeWS(message[21:])
 	if err != nil {
-		conn.Close()
+		logger.Errorf("Couldn't decode WS telegram: %s", err)
+		countDecodeError(siteName)
+		recordFailure(message, "decode_error", t)
+		return
+	}
+	fmt.Println("hex:", r.Hex, "length:", len(r.Hex))
+	fmt.Println("HexID:", r.ID)
+	fmt.Println("PAN:", r.PAN)
+	r.ID = canonicalID(r.ID)
+	r.Site = siteName
+	r.Time = t
+	r.Read = read
+	if foreignPAN(r) {
+		return
+	}
+	markTelegram(t)
+	markDecoded(t)
+	enecFramesDecoded.WithLabelValues(siteName, "WS").Inc()
+
+	validate(&r)
+	startTrace(&r, message, gateway)
+	sampleFrame(message, gateway, r)
+	if len(r.Invalid) > 0 && currentConfig().StrictParse {
+		logger.Errorf("Rejecting telegram of %s: %s", r.ID, r.invalidReasons())
+		countDecodeError(siteName)
+		recordFailure(message, "invalid_values", t)
 		return
 	}
+	if len(r.Invalid) > 0 {
+		logger.Warningf("Ignoring values of %s: %s", r.ID, r.invalidReasons())
+	}
+	queueReading(r)
+}
 
-	message := string(bufferBytes)
-	// Remove trailing \m
-	message = message[:len(message)-1]
+// deleteInverterSeries removes the per-inverter series of id in siteName.
+func deleteInverterSeries(id, siteName string) {
+	deleteMetrics(id, siteName)
+	deleteDailyResetSeries(id, siteName)
+	enecIntegratedWh.DeleteLabelValues(id, siteName)
+	deleteThermalSeries(id, siteName)
+	deleteGapSeries(id, siteName)
+	deleteHourSeries(id, siteName)
+	deleteClippingSeries(id, siteName)
+	enecPerformanceRatio.DeleteLabelValues(id, siteName)
+	enecEnergyProduced.DeleteLabelValues(id, siteName)
+}
 
-	if len(message) == 77 {
-		fmt.Println(message, "length:", len(message))
-		code := message[18:20]
-		if code == "WS" {
-			fmt.Println("Code:", code)
-			data := message[21:]
+// record exports a decoded reading as metrics and MQTT topics. Values that
+// failed validation aren't exported.
+func record(r reading) {
+	markSeen(r.ID, r.Site, r.Time)
+	r.Site = inverterSite(r.ID)
+	enecLastReport.WithLabelValues(r.ID, r.Site).Set(float64(r.Time.Unix()))
 
-			p, err := base64.RawURLEncoding.DecodeString(data)
-			if err != nil {
-				// handle error
-			}
-			hexzigbee := hex.EncodeToString(p)
-			fmt.Println("hex:", hexzigbee, "length:", len(hexzigbee))
-
-			hexid := hexzigbee[0:8]
-			fmt.Println("HexID:", hexid)
-
-			baseTopic := "enecsys/" + hexid + "/"
-
-			data = hexzigbee[64:66]
-			dec, err := strconv.ParseUint(data, 16, 32)
-			temperature := float64(dec)
-			fmt.Println("Temperature:", temperature)
-			enecTemperature.WithLabelValues(hexid).Set(temperature)
-			topic := baseTopic + "temperature"
-			publishMqtt(topic, strconv.FormatFloat(temperature, 'f', 1, 64))
-
-			data = hexzigbee[66:70]
-			dec, err = strconv.ParseUint(data, 16, 32)
-			wh := float64(dec)
-			fmt.Println("Wh:", wh)
-			enecWh.WithLabelValues(hexid).Set(wh)
-			topic = baseTopic + "wh"
-			publishMqtt(topic, strconv.FormatFloat(wh, 'f', 1, 64))
-
-			data = hexzigbee[70:74]
-			dec, err = strconv.ParseUint(data, 16, 32)
-			kwh := float64(dec)
-			fmt.Println("kWh:", kwh)
-			enecKwh.WithLabelValues(hexid).Set(kwh)
-			topic = baseTopic + "kwh"
-			publishMqtt(topic, strconv.FormatFloat(kwh, 'f', 1, 64))
-
-			lifewh := 1000*kwh + wh
-			lifekwh := kwh + 0.001*wh
-			fmt.Println("life_kWh:", lifekwh)
-			enecLifekwh.WithLabelValues(hexid).Set(lifekwh)
-			topic = baseTopic + "lifeWh"
-			publishMqtt(topic, strconv.FormatFloat(lifewh, 'f', 1, 64))
-
-			data = hexzigbee[18:22]
-			dec, err = strconv.ParseUint(data, 16, 32)
-			time1 := float64(dec)
-			fmt.Println("Time 1:", time1)
-			enecTime1.WithLabelValues(hexid).Set(time1)
-			topic = baseTopic + "time1"
-			publishMqtt(topic, strconv.FormatFloat(time1, 'f', 1, 64))
-
-			data = hexzigbee[30:36]
-			dec, err = strconv.ParseUint(data, 16, 32)
-			time2 := float64(dec)
-			fmt.Println("Time 2:", time2)
-			enecTime2.WithLabelValues(hexid).Set(time2)
-			topic = baseTopic + "time2"
-			publishMqtt(topic, strconv.FormatFloat(time2, 'f', 1, 64))
-
-			data = hexzigbee[50:54]
-			dec, err = strconv.ParseUint(data, 16, 32)
-			dcpower := float64(dec)
-			fmt.Println("DCPower:", dcpower)
-			enecDcpower.WithLabelValues(hexid).Set(dcpower)
-			topic = baseTopic + "dcpower"
-			publishMqtt(topic, strconv.FormatFloat(dcpower, 'f', 1, 64))
-
-			data = hexzigbee[46:50]
-			dec, err = strconv.ParseUint(data, 16, 32)
-			dccurrent := 0.025 * float64(dec)
-
-			dcvolt := dcpower / dccurrent
-			fmt.Println("DCVolt:", dcvolt)
-			enecDcvolt.WithLabelValues(hexid).Set(dcvolt)
-			topic = baseTopic + "dcvolt"
-			publishMqtt(topic, strconv.FormatFloat(dcvolt, 'f', 1, 64))
-
-			fmt.Println("DCCurrent:", dccurrent)
-			enecDccurrent.WithLabelValues(hexid).Set(dccurrent)
-			topic = baseTopic + "dccurrent"
-			publishMqtt(topic, strconv.FormatFloat(dccurrent, 'f', 1, 64))
-
-			data = hexzigbee[54:58]
-			dec, err = strconv.ParseUint(data, 16, 32)
-			efficiency := 0.1 * float64(dec)
-			fmt.Println("Efficiency:", efficiency)
-			enecEfficiency.WithLabelValues(hexid).Set(efficiency)
-			topic = baseTopic + "efficiency"
-			publishMqtt(topic, strconv.FormatFloat(efficiency, 'f', 1, 64))
-
-			acpower := dcpower * efficiency / 100
-			fmt.Println("ACPower:", acpower)
-			enecAcpower.WithLabelValues(hexid).Set(acpower)
-			topic = baseTopic + "acpower"
-			publishMqtt(topic, strconv.FormatFloat(acpower, 'f', 1, 64))
-
-			data = hexzigbee[60:64]
-			dec, err = strconv.ParseUint(data, 16, 32)
-			acvolt := float64(dec)
-			fmt.Println("ACVolt:", acvolt)
-			enecAcvolt.WithLabelValues(hexid).Set(acvolt)
-			topic = baseTopic + "acvolt"
-			publishMqtt(topic, strconv.FormatFloat(acvolt, 'f', 1, 64))
-
-			accurrent := acpower / acvolt
-			fmt.Println("ACCurrent:", accurrent)
-			enecAccurrent.WithLabelValues(hexid).Set(accurrent)
-			topic = baseTopic + "accurrent"
-			publishMqtt(topic, strconv.FormatFloat(accurrent, 'f', 1, 64))
-
-			data = hexzigbee[58:60]
-			dec, err = strconv.ParseUint(data, 16, 32)
-			acfreq := float64(dec)
-			fmt.Println("ACFreq:", acfreq)
-			enecAcfreq.WithLabelValues(hexid).Set(acfreq)
-			topic = baseTopic + "acfreq"
-			publishMqtt(topic, strconv.FormatFloat(acfreq, 'f', 1, 64))
+	prev, hasPrev := latestReading(r.ID)
+	if hasPrev && r.Time.Before(prev.Time) {
+		recordOutOfOrder(prev, r)
+		return
+	}
+	if hasPrev {
+		detectLifetimeJump(prev, &r)
+	}
+	selectDayEnergy(&r)
+	if hasPrev {
+		detectDailyReset(prev, &r)
+	}
+	storeHistory(r)
 
+	if hasPrev {
+		r.keepPrevious(prev)
+	} else {
+		r.zeroInvalid()
+	}
+	storeReading(r)
+	if hasPrev {
+		accountEnergy(prev, r)
+		countDailyEnergy(prev, r)
+	}
+	recordDailyReset(r)
+	recordLifetimeJump(prev, r)
+	observeFrame(r)
+	trackThermal(prev, hasPrev, r)
+	trackClipping(prev, hasPrev, r)
+	recordPerformance(r)
+	trackReport(prev, hasPrev, r)
+
+	for _, f := range fields {
+		if r.valid(f.topic) {
+			fmt.Println(f.label+":", f.value(&r))
 		}
 	}
+	storeMetrics(r)
+	pushReading(r)
+	publishReading(r, false)
+}
 
-	handleConnection(conn)
+// publishReading publishes the values of r to MQTT. Unless all is set,
+// values held back by throttling (see throttle.go) are left out.
+func publishReading(r reading, all bool) {
+	cfg := currentConfig()
+	state := map[string]interface{}{"id": r.ID, "time": r.Time.Format(historyTimeFormat)}
+	if r.Site != "" {
+		state["site"] = r.Site
+	}
+	for _, f := range fields {
+		if !r.valid(f.topic) {
+			continue
+		}
+		value := f.value(&r)
+		if f.publish != nil {
+			value = f.publish(&r)
+		}
+		if cfg.MqttPayload != "json" {
+			topic, formatted := inverterTopic(r.ID, f.topic), formatValue(f.topic, value)
+			if all || shouldPublish(topic, f.topic, value, formatted, r.Time) {
+				publishValue(topic, formatted)
+			}
+		}
+		// JSON has no NaN, e.g. the DC voltage while nothing flows
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			state[f.topic] = roundValue(f.topic, value)
+		}
+	}
+	if cfg.MqttPayload != "topics" && (all || shouldPublishState(inverterTopic(r.ID, "state"), state, r.Time)) {
+		publishState(r.ID, state)
+	}
+}
+
+// republishValues publishes the latest values of every inverter again if
+// the broker retains them.
+func republishValues() {
+	if !currentConfig().MqttRetain || !currentConfig().MqttRetainValues {
+		return
+	}
+	for _, s := range allStates() {
+		if s.HasReading {
+			publishReading(s.Reading, true)
+		}
+	}
 }
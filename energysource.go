@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Source of the daily energy (enecsys_watthours_today). Some firmware
+// versions report a bogus Wh field, so the value can instead be derived
+// from the lifetime counter or from the AC power. The energySource config
+// key sets the default, energySource in the site file overrides it per
+// inverter:
+//
+//	frame     the Wh field of the telegram (default)
+//	lifetime  the lifetime counter minus its value at the first reading of
+//	          the day
+//	power     AC power integrated over time
+//
+// The replaced value is exported, published and stored everywhere the
+// frame value would be.
+//
+// The power integration (trapezoidal, over consecutive readings of the day)
+// is always exported as enecsys_integrated_energy_today_watt_hours, independent of
+// the reported counters, to cross-check suspicious jumps in them. Intervals
+// longer than integrationMaxGap (default 15m) aren't integrated, as the
+// power in between is unknown.
+//
+// The lifetime source counts from the first reading of the day with a valid
+// lifetime counter. Both the baseline and the integration are kept in the
+// state snapshot, so a restart doesn't reset them.
+
+var enecIntegratedWh = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "enecsys_integrated_energy_today_watt_hours",
+	Help: "Watt hours produced today, integrated from the AC power.",
+},
+	[]string{"id", "site"},
+)
+
+func init() {
+	prometheus.MustRegister(enecIntegratedWh)
+}
+
+type energyDay struct {
+	Day         string    `json:"day"`
+	StartLifeWh float64   `json:"startLifeWh"`
+	HasStart    bool      `json:"hasStart"`
+	PowerWh     float64   `json:"powerWh"`
+	LastTime    time.Time `json:"lastTime"`
+	LastPower   float64   `json:"lastPower"`
+	HasPower    bool      `json:"hasPower"`
+}
+
+var (
+	energyMu   sync.Mutex
+	energyDays = map[string]*energyDay{}
+)
+
+// checkEnergySource returns an error unless source names an energy source.
+func checkEnergySource(source string) error {
+	switch source {
+	case "", "frame", "lifetime", "power":
+		return nil
+	}
+	return fmt.Errorf("energySource: expected frame, lifetime or power, got %q", source)
+}
+
+func energySource(id string) string {
+	if source := inverter(id).EnergySource; source != "" {
+		return source
+	}
+	return currentConfig().EnergySource
+}
+
+// selectDayEnergy replaces the daily energy of r according to the energy
+// source of its inverter.
+func selectDayEnergy(r *reading) {
+	source := energySource(r.ID)
+	day := siteDay(r.Time)
+
+	energyMu.Lock()
+	defer energyMu.Unlock()
+
+	e := energyDays[r.ID]
+	if e == nil || e.Day != day {
+		e = &energyDay{Day: day}
+		energyDays[r.ID] = e
+	}
+	switch {
+	case !r.valid("lifeWh"):
+		// no baseline from a counter the inverter didn't report
+	case !e.HasStart:
+		e.StartLifeWh, e.HasStart = r.LifeWh, true
+		// Energy credited today before a restart stays in today's total.
+		dayMu.Lock()
+		if today.Day == day {
+			e.StartLifeWh -= today.Inverters[r.ID]
+		}
+		dayMu.Unlock()
+	case r.LifetimeJump > 0:
+		e.StartLifeWh += r.LifetimeJump
+	}
+
+	if r.valid("acpower") {
+		maxGap := currentConfig().IntegrationMaxGap
+		if e.HasPower && r.Time.After(e.LastTime) && r.Time.Sub(e.LastTime) <= maxGap {
+			e.PowerWh += (e.LastPower + r.ACPower) / 2 * r.Time.Sub(e.LastTime).Hours()
+		}
+		e.LastTime, e.LastPower, e.HasPower = r.Time, r.ACPower, true
+	}
+	enecIntegratedWh.WithLabelValues(r.ID, r.Site).Set(e.PowerWh)
+
+	switch source {
+	case "lifetime":
+		if !r.valid("lifeWh") {
+			return
+		}
+		r.Wh = r.LifeWh - e.StartLifeWh
+	case "power":
+		r.Wh = e.PowerWh
+	default:
+		return
+	}
+	delete(r.Invalid, "wh")
+}
+
+// lateDayEnergy replaces the daily energy of r, received before the latest
+// reading of its inverter, like selectDayEnergy but leaves the state of the
+// live readings alone. The power integration of a late reading is unknown,
+// so its Wh is invalid with the power source.
+func lateDayEnergy(r *reading) {
+	switch energySource(r.ID) {
+	case "lifetime":
+		energyMu.Lock()
+		var e energyDay
+		if current := energyDays[r.ID]; current != nil {
+			e = *current
+		}
+		energyMu.Unlock()
+		if e.Day != siteDay(r.Time) || !e.HasStart || !r.valid("lifeWh") {
+			r.invalidate("wh", "energy of a late reading unknown")
+			return
+		}
+		r.Wh = r.LifeWh - e.StartLifeWh
+		delete(r.Invalid, "wh")
+	case "power":
+		r.invalidate("wh", "energy of a late reading unknown")
+	}
+}
+
+// energyDayOf returns a copy of the daily energy state of id.
+func energyDayOf(id string) *energyDay {
+	energyMu.Lock()
+	defer energyMu.Unlock()
+	if e := energyDays[id]; e != nil {
+		c := *e
+		return &c
+	}
+	return nil
+}
+
+// restoreEnergyDay replaces the daily energy state of id with e, restored
+// from a snapshot.
+func restoreEnergyDay(id string, e energyDay) {
+	energyMu.Lock()
+	energyDays[id] = &e
+	energyMu.Unlock()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event log: every event passing emitEvent is kept, in memory for the last
+// eventMemory events and, with historyDir configured, appended to
+// <historyDir>/<day>.events.jsonl next to the readings so it survives
+// restarts and is part of backups. GET /api/v1/events returns the logged
+// events in chronological order, filtered by the query parameters:
+//
+//	site, inverter   only events of that site or inverter
+//	kind             comma separated kinds, e.g. inverter_offline,inverter_online
+//	severity         minimum severity (info, warning, critical)
+//	from, to         RFC 3339 time or day (2021-06-01), default the last 7 days
+//	limit            at most that many of the newest events, default 1000
+
+const eventMemory = 1000
+
+var (
+	eventLogMu sync.Mutex
+	eventLog   []event
+)
+
+func init() {
+	publicMux.HandleFunc("/api/v1/events", serveEvents)
+}
+
+// storeEvent adds e to the event log.
+func storeEvent(e event) {
+	eventLogMu.Lock()
+	defer eventLogMu.Unlock()
+
+	eventLog = append(eventLog, e)
+	if len(eventLog) > eventMemory {
+		eventLog = append([]event{}, eventLog[len(eventLog)-eventMemory:]...)
+	}
+
+	dir := currentConfig().HistoryDir
+	if dir == "" {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorf("Couldn't encode event: %s", err)
+		return
+	}
+	if err := appendEvent(dir, siteDay(e.Time), line); err != nil {
+		logger.Errorf("Couldn't write event log: %s", err)
+	}
+}
+
+func appendEvent(dir, day string, line []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	osFile, err := os.OpenFile(filepath.Join(dir, day+".events.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := osFile.Write(append(line, '\n')); err != nil {
+		osFile.Close()
+		return err
+	}
+	return osFile.Close()
+}
+
+type eventFilter struct {
+	site, inverter string
+	kinds          map[string]bool
+	severity       int
+	from, to       time.Time
+}
+
+func (f eventFilter) match(e event) bool {
+	return (f.site == "" || e.Site == f.site) &&
+		(f.inverter == "" || e.Inverter == f.inverter) &&
+		(len(f.kinds) == 0 || f.kinds[e.Kind]) &&
+		severityRank[e.Severity] >= f.severity &&
+		!e.Time.Before(f.from) && e.Time.Before(f.to)
+}
+
+// parseEventTime parses an RFC 3339 time or a day, which stands for its
+// start or, with end set, the start of the next day.
+func parseEventTime(value string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	now := time.Now()
+	filter := eventFilter{site: query.Get("site"), inverter: query.Get("inverter"),
+		from: now.AddDate(0, 0, -7), to: now.Add(time.Second)}
+	if kinds := splitList(query.Get("kind")); len(kinds) > 0 {
+		filter.kinds = map[string]bool{}
+		for _, kind := range kinds {
+			filter.kinds[kind] = true
+		}
+	}
+	if severity := query.Get("severity"); severity != "" {
+		rank, ok := severityRank[severity]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown severity %q", severity), http.StatusBadRequest)
+			return
+		}
+		filter.severity = rank
+	}
+	for _, bound := range []struct {
+		key string
+		t   *time.Time
+	}{{"from", &filter.from}, {"to", &filter.to}} {
+		if value := query.Get(bound.key); value != "" {
+			t, err := parseEventTime(value, bound.key == "to")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			*bound.t = t
+		}
+	}
+	limit := 1000
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", value), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	events, err := loggedEvents(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// loggedEvents returns the logged events matching filter, from the files of
+// the history store if configured and from memory otherwise.
+func loggedEvents(filter eventFilter) ([]event, error) {
+	events := []event{}
+	dir := currentConfig().HistoryDir
+	if dir == "" {
+		eventLogMu.Lock()
+		for _, e := range eventLog {
+			if filter.match(e) {
+				events = append(events, e)
+			}
+		}
+		eventLogMu.Unlock()
+		return events, nil
+	}
+
+	eventLogMu.Lock()
+	defer eventLogMu.Unlock()
+	files, err := filepath.Glob(filepath.Join(dir, "????-??-??.events.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	// Days are those of the site, allow for a day of difference to the
+	// filter's time zone.
+	first, last := filter.from.AddDate(0, 0, -1).Format("2006-01-02"), filter.to.AddDate(0, 0, 1).Format("2006-01-02")
+	for _, file := range files {
+		day := strings.TrimSuffix(filepath.Base(file), ".events.jsonl")
+		if day < first || day > last {
+			continue
+		}
+		if events, err = readEvents(file, filter, events); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, nil
+}
+
+func readEvents(file string, filter eventFilter, events []event) ([]event, error) {
+	osFile, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer osFile.Close()
+
+	scanner := bufio.NewScanner(osFile)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a line cut short by a crash
+			continue
+		}
+		if filter.match(e) {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
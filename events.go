@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events are notable things happening at a site, like inverters going
+// offline. They are logged and sent to the notifiers of the inverter's site
+// (or the top-level notify list) configured in the site file:
+//
+//	notifiers:
+//	  phone:
+//	    webhook: https://ntfy.sh/my-roof   # POSTs the event as JSON
+//	    minSeverity: warning               # default
+//	  bus:
+//	    mqttTopic: enecsys/events           # publishes the event as JSON
+//	    minSeverity: info
+//
+// Notifiers can have quiet hours (quietFrom/quietTo, wrapping around
+// midnight if from is later than to) and quiet days (quietDays, whole
+// days). Events below critical arriving while a notifier is quiet are held
+// and sent as one digest event, listing them under events, once the quiet
+// time is over:
+//
+//	    quietFrom: "22:00"
+//	    quietTo: "07:00"
+//	    quietDays: [sat, sun]
+//
+// The quiet times are in the time zone of the event's site (timeZone in its
+// entry under sites), or the exporter's local time zone. Events of each
+// site are held and digested separately.
+
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+var severityRank = map[string]int{severityInfo: 0, severityWarning: 1, severityCritical: 2}
+
+type event struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Severity string    `json:"severity"`
+	Site     string    `json:"site,omitempty"`
+	Inverter string    `json:"inverter,omitempty"`
+	Message  string    `json:"message"`
+	// the held events of a digest
+	Events []event `json:"events,omitempty"`
+}
+
+type notifierInfo struct {
+	Webhook     string   `yaml:"webhook"`
+	MqttTopic   string   `yaml:"mqttTopic"`
+	MinSeverity string   `yaml:"minSeverity"`
+	QuietFrom   string   `yaml:"quietFrom"`
+	QuietTo     string   `yaml:"quietTo"`
+	QuietDays   []string `yaml:"quietDays"`
+
+	name string
+}
+
+var (
+	notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+	// events held during quiet hours, by notifier and site
+	heldMu sync.Mutex
+	held   = map[heldKey][]event{}
+)
+
+type heldKey struct {
+	notifier, site string
+}
+
+// check validates the quiet time settings.
+func (n notifierInfo) check() error {
+	if (n.QuietFrom == "") != (n.QuietTo == "") {
+		return fmt.Errorf("quietFrom and quietTo must be set together")
+	}
+	if _, err := parseClock(n.QuietFrom, 0); err != nil {
+		return err
+	}
+	if _, err := parseClock(n.QuietTo, 0); err != nil {
+		return err
+	}
+	for _, day := range n.QuietDays {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("unknown day %q", day)
+		}
+	}
+	return nil
+}
+
+// quietAt reports whether the notifier is quiet at t at siteName.
+func (n notifierInfo) quietAt(t time.Time, siteName string) bool {
+	t = t.In(siteTimeZone(siteName))
+	for _, day := range n.QuietDays {
+		if weekdays[strings.ToLower(day)] == t.Weekday() {
+			return true
+		}
+	}
+	if n.QuietFrom == "" {
+		return false
+	}
+	from, _ := parseClock(n.QuietFrom, 0)
+	to, _ := parseClock(n.QuietTo, 0)
+	minute := t.Hour()*60 + t.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// emitEvent logs e, stores it in the event log and dispatches it to the
+// notifiers of its site. The time and, for inverter events, the site are
+// filled in if missing.
+func emitEvent(e event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Site == "" && e.Inverter != "" {
+		e.Site = inverterSite(e.Inverter)
+	}
+	fmt.Println("Event:", e.Severity, e.Kind, e.Message)
+	storeEvent(e)
+	go annotateEvent(e)
+	go forwardAlert(e)
+
+	if silenced(e) {
+		return
+	}
+	for _, n := range notifiersFor(e.Site) {
+		if severityRank[e.Severity] < severityRank[n.MinSeverity] {
+			continue
+		}
+		if e.Severity != severityCritical && n.quietAt(e.Time, e.Site) {
+			key := heldKey{n.name, e.Site}
+			heldMu.Lock()
+			held[key] = append(held[key], e)
+			heldMu.Unlock()
+			continue
+		}
+		go notify(n, e)
+	}
+}
+
+// sendDigests sends the events held by every notifier that isn't quiet
+// anymore as one digest event. It never returns.
+func sendDigests() {
+	for now := range time.Tick(time.Minute) {
+		siteMu.RLock()
+		notifiers := make(map[string]notifierInfo, len(site.Notifiers))
+		for name, n := range site.Notifiers {
+			n.name = name
+			notifiers[name] = n
+		}
+		siteMu.RUnlock()
+
+		heldMu.Lock()
+		for key, events := range held {
+			n, ok := notifiers[key.notifier]
+			if ok && n.quietAt(now, key.site) {
+				continue
+			}
+			delete(held, key)
+			if ok {
+				d := digest(now, events)
+				d.Site = key.site
+				go notify(n, d)
+			}
+		}
+		heldMu.Unlock()
+	}
+}
+
+// digest combines events into one event with the highest severity among
+// them.
+func digest(now time.Time, events []event) event {
+	d := event{Time: now, Kind: "digest", Severity: severityInfo, Events: events,
+		Message: fmt.Sprintf("%d events during quiet hours", len(events))}
+	for _, e := range events {
+		if severityRank[e.Severity] > severityRank[d.Severity] {
+			d.Severity = e.Severity
+		}
+	}
+	return d
+}
+
+// notifiersFor returns the notifiers of siteName, or the top-level ones if
+// the site is empty or unknown.
+func notifiersFor(siteName string) []notifierInfo {
+	siteMu.RLock()
+	defer siteMu.RUnlock()
+
+	targets := site.Notify
+	if s, ok := site.Sites[siteName]; ok {
+		targets = s.Notify
+	}
+	var notifiers []notifierInfo
+	for _, target := range targets {
+		n := site.Notifiers[target]
+		n.name = target
+		if n.MinSeverity == "" {
+			n.MinSeverity = severityWarning
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers
+}
+
+func notify(n notifierInfo, e event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorf("Couldn't encode event: %s", err)
+		return
+	}
+
+	if n.MqttTopic != "" {
+		publishMqtt(n.MqttTopic, string(payload))
+	}
+	if n.Webhook != "" {
+		resp, err := notifyClient.Post(n.Webhook, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			logger.Errorf("Notification to %s failed: %s", n.Webhook, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			logger.Errorf("Notification to %s failed: %s", n.Webhook, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Series expiry. Gauges keep the last value of an inverter forever, so
+// dashboards show power at night and for inverters long removed. With
+// seriesExpiry set, the series of an inverter that hasn't reported for that
+// long are deleted from the metric vectors, and Prometheus marks them stale
+// on its next scrape. They come back with its next report; counters among
+// them start over from 0, which rate() and increase() take as a reset.
+//
+//	seriesExpiry: 30m
+
+var (
+	expiredMu sync.Mutex
+	// last report of the inverters whose series were deleted
+	expiredAt = map[string]time.Time{}
+
+	enecSeriesExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "enecsys_series_expired_total",
+		Help: "Times the series of a silent inverter were deleted after seriesExpiry.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(enecSeriesExpired)
+}
+
+// expireSeries deletes the series of the inverters not seen since deadline,
+// once per silence, and returns their IDs.
+func expireSeries(deadline time.Time) []string {
+	var expired []string
+	expiredMu.Lock()
+	defer expiredMu.Unlock()
+	for _, s := range allStates() {
+		if s.LastSeen.IsZero() || !s.LastSeen.Before(deadline) || expiredAt[s.ID].Equal(s.LastSeen) {
+			continue
+		}
+		deleteInverterSeries(s.ID, inverterSite(s.ID))
+		expiredAt[s.ID] = s.LastSeen
+		enecSeriesExpired.Inc()
+		expired = append(expired, s.ID)
+	}
+	return expired
+}
+
+// watchSeriesExpiry periodically deletes the series of inverters silent for
+// longer than expiry. It never returns.
+func watchSeriesExpiry(expiry time.Duration) {
+	interval := expiry / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	for range time.Tick(interval) {
+		for _, id := range expireSeries(time.Now().Add(-expiry)) {
+			fmt.Println("Deleted the series of inverter", id, "after no report for", expiry)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Production forecasts from Forecast.Solar or Solcast, fetched per array of
+// the site file and exported next to the actual AC power of the inverters
+// assigned to that array.
+//
+// Configuration:
+//
+//	forecastProvider: forecast.solar   # or solcast
+//	forecastApiKey: optional for Forecast.Solar, required for Solcast
+//	forecastInterval: 1h
+//	latitude: "52.52"                  # Forecast.Solar only
+//	longitude: "13.40"
+
+var (
+	enecForecastPower = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_forecast_power",
+		Help: "Forecast power of the array right now.",
+	},
+		[]string{"array"},
+	)
+	enecForecastWhToday = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_forecast_watthours_today",
+		Help: "Forecast watt hours for the array today.",
+	},
+		[]string{"array"},
+	)
+	enecForecastError = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_forecast_error",
+		Help: "Actual AC power minus forecast power of the array.",
+	},
+		[]string{"array"},
+	)
+
+	forecastClient = &http.Client{Timeout: 30 * time.Second}
+
+	forecastMu sync.Mutex
+	forecasts  = map[string]forecast{}
+)
+
+func init() {
+	prometheus.MustRegister(enecForecastPower)
+	prometheus.MustRegister(enecForecastWhToday)
+	prometheus.MustRegister(enecForecastError)
+}
+
+// forecastPoint is the forecast average power in watts at a point in time.
+type forecastPoint struct {
+	time  time.Time
+	watts float64
+}
+
+type forecast struct {
+	points []forecastPoint
+	// watt hours per day, keyed by date in local time
+	days map[string]float64
+}
+
+// powerAt interpolates the forecast power at t.
+func (f forecast) powerAt(t time.Time) float64 {
+	i := sort.Search(len(f.points), func(i int) bool { return !f.points[i].time.Before(t) })
+	if i == 0 || i == len(f.points) {
+		return 0
+	}
+	prev, next := f.points[i-1], f.points[i]
+	share := float64(t.Sub(prev.time)) / float64(next.time.Sub(prev.time))
+	return prev.watts + share*(next.watts-prev.watts)
+}
+
+type forecastFetcher func(name string, a arrayInfo) (forecast, error)
+
+// startForecast starts polling the configured forecast provider, if any.
+func startForecast() {
+	cfg := currentConfig()
+	provider := cfg.ForecastProvider
+	if provider == "" {
+		return
+	}
+
+	var fetch forecastFetcher
+	interval := time.Hour
+	switch provider {
+	case "forecast.solar":
+		if cfg.Latitude == nil || cfg.Longitude == nil {
+			logger.Errorf("Forecast.Solar needs latitude and longitude, forecasts disabled.")
+			return
+		}
+		lat, lon := *cfg.Latitude, *cfg.Longitude
+		fetch = func(name string, a arrayInfo) (forecast, error) {
+			return fetchForecastSolar(lat, lon, a)
+		}
+	case "solcast":
+		if cfg.ForecastAPIKey == "" {
+			logger.Errorf("Solcast needs forecastApiKey, forecasts disabled.")
+			return
+		}
+		// The free Solcast plan allows only a handful of requests per day.
+		interval = 3 * time.Hour
+		fetch = func(name string, a arrayInfo) (forecast, error) {
+			if a.SolcastSite == "" {
+				return forecast{}, fmt.Errorf("no solcastSite configured")
+			}
+			return fetchSolcast(a.SolcastSite)
+		}
+	default:
+		logger.Errorf("Unknown forecastProvider %q, forecasts disabled.", provider)
+		return
+	}
+
+	if cfg.ForecastInterval > 0 {
+		interval = cfg.ForecastInterval
+	}
+	go pollForecasts(fetch, interval)
+	go updateForecastMetrics()
+}
+
+func pollForecasts(fetch forecastFetcher, interval time.Duration) {
+	for {
+		var failed error
+		for name, a := range siteArrays() {
+			f, err := fetch(name, a)
+			if err != nil {
+				logger.Errorf("Couldn't fetch forecast for array %s: %s", name, err)
+				failed = fmt.Errorf("array %s: %s", name, err)
+				continue
+			}
+			forecastMu.Lock()
+			forecasts[name] = f
+			forecastMu.Unlock()
+		}
+		reportHealth("forecast", failed)
+		time.Sleep(interval)
+	}
+}
+
+// updateForecastMetrics refreshes the forecast gauges every minute. When
+// only one array is configured every inverter counts towards it, so simple
+// installations don't need to assign inverters to arrays.
+func updateForecastMetrics() {
+	for range sleepyTick(time.Minute) {
+		now := time.Now()
+		arrays := siteArrays()
+
+		actual := map[string]float64{}
+		for _, r := range currentReadings() {
+			array := inverter(r.ID).Array
+			if len(arrays) == 1 {
+				for name := range arrays {
+					array = name
+				}
+			}
+			actual[array] += r.ACPower
+		}
+
+		forecastMu.Lock()
+		for name, f := range forecasts {
+			if _, ok := arrays[name]; !ok {
+				continue
+			}
+			power := f.powerAt(now)
+			enecForecastPower.WithLabelValues(name).Set(power)
+			enecForecastWhToday.WithLabelValues(name).Set(f.days[siteDay(now)])
+			enecForecastError.WithLabelValues(name).Set(actual[name] - power)
+		}
+		forecastMu.Unlock()
+	}
+}
+
+func getJSON(req *http.Request, v interface{}) error {
+	resp, err := forecastClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fetchForecastSolar queries the Forecast.Solar estimate API. Timestamps in
+// the response are local time of the location; the exporter is assumed to
+// run in the same time zone.
+func fetchForecastSolar(lat, lon float64, a arrayInfo) (forecast, error) {
+	url := "https://api.forecast.solar"
+	if key := currentConfig().ForecastAPIKey; key != "" {
+		url += "/" + key
+	}
+	url += fmt.Sprintf("/estimate/%g/%g/%g/%g/%g", lat, lon, a.Declination, a.Azimuth, a.Kwp)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return forecast{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	var body struct {
+		Result struct {
+			Watts        map[string]float64 `json:"watts"`
+			WattHoursDay map[string]float64 `json:"watt_hours_day"`
+		} `json:"result"`
+	}
+	if err := getJSON(req, &body); err != nil {
+		return forecast{}, err
+	}
+
+	f := forecast{days: body.Result.WattHoursDay}
+	for stamp, watts := range body.Result.Watts {
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", stamp, time.Local)
+		if err != nil {
+			return forecast{}, err
+		}
+		f.points = append(f.points, forecastPoint{time: t, watts: watts})
+	}
+	sort.Slice(f.points, func(i, j int) bool { return f.points[i].time.Before(f.points[j].time) })
+	return f, nil
+}
+
+// fetchSolcast queries the forecasts of a Solcast rooftop site. Each
+// forecast is the average power in kW over the period ending at period_end.
+func fetchSolcast(resource string) (forecast, error) {
+	url := "https://api.solcast.com.au/rooftop_sites/" + resource + "/forecasts?format=json"
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return forecast{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+currentConfig().ForecastAPIKey)
+
+	var body struct {
+		Forecasts []struct {
+			PvEstimate float64   `json:"pv_estimate"`
+			PeriodEnd  time.Time `json:"period_end"`
+			Period     string    `json:"period"`
+		} `json:"forecasts"`
+	}
+	if err := getJSON(req, &body); err != nil {
+		return forecast{}, err
+	}
+
+	f := forecast{days: map[string]float64{}}
+	for _, p := range body.Forecasts {
+		period, err := parseISODuration(p.Period)
+		if err != nil {
+			return forecast{}, err
+		}
+		watts := 1000 * p.PvEstimate
+		middle := p.PeriodEnd.Add(-period / 2).Local()
+		f.points = append(f.points, forecastPoint{time: middle, watts: watts})
+		f.days[siteDay(middle)] += watts * period.Hours()
+	}
+	sort.Slice(f.points, func(i, j int) bool { return f.points[i].time.Before(f.points[j].time) })
+	return f, nil
+}
+
+// parseISODuration parses the minute based ISO 8601 periods Solcast uses,
+// e.g. PT30M or PT1H.
+func parseISODuration(period string) (time.Duration, error) {
+	var d time.Duration
+	var n int
+	if _, err := fmt.Sscanf(period, "PT%dM", &n); err == nil {
+		d = time.Duration(n) * time.Minute
+	} else if _, err := fmt.Sscanf(period, "PT%dH", &n); err == nil {
+		d = time.Duration(n) * time.Hour
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("unsupported period %q", period)
+	}
+	return d, nil
+}
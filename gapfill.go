@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Gap filling. With gapEstimate set, the energy an inverter produced
+// during a reporting gap (see gaps.go) is estimated when it reports again,
+// and the part its lifetime counter doesn't account for - the counter of
+// an inverter that lost its link keeps counting, one that was down
+// doesn't - is added to the daily report as estimated energy:
+//
+//	samples  the mean AC power of the readings before and after the gap
+//	peers    the energy the other inverters of its site and array produced
+//	         in the hours of the gap, scaled by the inverter's share today
+//
+// The report keeps the measured totals in totalWh and inverters and lists
+// the estimates apart, in estimatedWh and the gaps of each inverter.
+
+// fillGap adds the estimated energy of the gap between prev and r the
+// lifetime counter didn't account for to today's report.
+func fillGap(prev, r reading, gapSeconds float64) {
+	dayMu.Lock()
+	defer dayMu.Unlock()
+
+	measured := math.Max(0, r.LifeWh-prev.LifeWh)
+	if r.LifetimeJump > 0 {
+		measured = 0
+	}
+	missing := estimateGap(prev, r, gapSeconds) - measured
+	if missing <= 0 {
+		return
+	}
+	g := today.Gaps[r.ID]
+	if g == nil {
+		return
+	}
+	g.EstimatedWh += missing
+	today.EstimatedWh += missing
+	fmt.Printf("Estimated %.0f Wh for the gap of inverter %s\n", missing, r.ID)
+}
+
+// estimateGap returns the energy in Wh inverter r.ID produced during the
+// gap of gapSeconds daylight between prev and r. dayMu must be held.
+func estimateGap(prev, r reading, gapSeconds float64) float64 {
+	switch currentConfig().GapEstimate {
+	case "samples":
+		return (prev.ACPower + r.ACPower) / 2 * gapSeconds / 3600
+	case "peers":
+		return estimateFromPeers(prev, r, gapSeconds)
+	}
+	return 0
+}
+
+// estimateFromPeers estimates the gap of r.ID from the hourly energy of the
+// inverters in the same site and array. It falls back to the samples
+// estimate without peers. dayMu must be held.
+func estimateFromPeers(prev, r reading, gapSeconds float64) float64 {
+	array := inverter(r.ID).Array
+	var peers []string
+	for id := range today.Hours {
+		if id != r.ID && inverterSite(id) == r.Site && inverter(id).Array == array {
+			peers = append(peers, id)
+		}
+	}
+	if len(peers) == 0 || !prev.Time.Before(r.Time) {
+		return (prev.ACPower + r.ACPower) / 2 * gapSeconds / 3600
+	}
+
+	// The share of the inverter compared to its peers, from the hours
+	// before the gap.
+	own, others := 0.0, 0.0
+	for h := 0; h < prev.Time.Hour(); h++ {
+		own += hourWh(r.ID, h)
+		others += medianHourWh(peers, h)
+	}
+	share := 1.0
+	if others > 0 && own > 0 {
+		share = own / others
+	}
+
+	// The peers' median energy in each hour, prorated by the part of the
+	// hour the gap lasted, and scaled to the gap's daylight.
+	var wh, span float64
+	for t := prev.Time; t.Before(r.Time); {
+		next := t.Truncate(time.Hour).Add(time.Hour)
+		if next.After(r.Time) {
+			next = r.Time
+		}
+		if siteDay(t) == today.Day {
+			wh += medianHourWh(peers, t.Hour()) * next.Sub(t).Hours()
+		}
+		span += next.Sub(t).Seconds()
+		t = next
+	}
+	if span > 0 {
+		wh *= math.Min(1, gapSeconds/span)
+	}
+	return wh * share
+}
+
+func hourWh(id string, h int) float64 {
+	if hours := today.Hours[id]; h < len(hours) {
+		return hours[h]
+	}
+	return 0
+}
+
+func medianHourWh(ids []string, h int) float64 {
+	values := make([]float64, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, hourWh(id, h))
+	}
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
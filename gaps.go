@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reporting gap detection. Each inverter's usual reporting interval is
+// learned from the time between its reports. A pause that covers more than
+// gapFactor intervals of daylight counts as a gap; only the daylight part
+// of a pause counts towards its duration, so nights are never gaps. Without
+// a configured location, pauses longer than two hours are taken to be
+// night.
+//
+// Gap counts and durations per day feed the daily report, together with an
+// availability percentage: the share of the time between an inverter's
+// first and last report of the day not lost to gaps. With gapEstimate set
+// the energy lost to a gap is estimated as well, see gapfill.go.
+
+const (
+	gapFactor      = 3
+	gapMinSamples  = 5
+	gapMaxInterval = time.Hour
+	gapNoLocation  = 2 * time.Hour
+	daylightStep   = 5 * time.Minute
+)
+
+var (
+	enecGaps = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_gaps_today",
+		Help: "Reporting gaps of the inverter during daylight today.",
+	},
+		[]string{"id", "site"},
+	)
+	enecGapSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_gap_seconds_today",
+		Help: "Duration of the reporting gaps of the inverter today.",
+	},
+		[]string{"id", "site"},
+	)
+	enecAvailability = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_availability_today_percent",
+		Help: "Share of the inverter's reporting day not lost to gaps.",
+	},
+		[]string{"id", "site"},
+	)
+
+	gapMu       sync.Mutex
+	gapTrackers = map[string]*gapTracker{}
+)
+
+func init() {
+	prometheus.MustRegister(enecGaps)
+	prometheus.MustRegister(enecGapSeconds)
+	prometheus.MustRegister(enecAvailability)
+}
+
+func deleteGapSeries(id, siteName string) {
+	enecGaps.DeleteLabelValues(id, siteName)
+	enecGapSeconds.DeleteLabelValues(id, siteName)
+	enecAvailability.DeleteLabelValues(id, siteName)
+}
+
+type gapTracker struct {
+	interval float64 // learned reporting interval in seconds
+	samples  int
+	last     time.Time
+	open     bool // gap already counted while it was ongoing
+}
+
+type gapTotal struct {
+	Count               int       `json:"count"`
+	Seconds             float64   `json:"seconds"`
+	First               time.Time `json:"first"`
+	Last                time.Time `json:"last"`
+	AvailabilityPercent float64   `json:"availabilityPercent"`
+	// energy estimated for the gaps, not part of the measured totals
+	EstimatedWh float64 `json:"estimatedWh,omitempty"`
+}
+
+func (g *gapTotal) updateAvailability() {
+	span := g.Last.Sub(g.First).Seconds()
+	g.AvailabilityPercent = 100
+	if span > 0 {
+		g.AvailabilityPercent = math.Max(0, 100*(1-g.Seconds/span))
+	}
+}
+
+// daylightSeconds estimates how much of the time between from and to the
+// sun was up at siteName.
+func daylightSeconds(siteName string, from, to time.Time) float64 {
+	if !to.After(from) {
+		return 0
+	}
+	if _, known := isDaylight(siteName, from); !known {
+		if to.Sub(from) > gapNoLocation {
+			return 0
+		}
+		return to.Sub(from).Seconds()
+	}
+
+	var seconds float64
+	for t := from; t.Before(to); t = t.Add(daylightStep) {
+		step := daylightStep
+		if rest := to.Sub(t); rest < step {
+			step = rest
+		}
+		if daylight, _ := isDaylight(siteName, t.Add(step/2)); daylight {
+			seconds += step.Seconds()
+		}
+	}
+	return seconds
+}
+
+// trackReport learns the reporting interval of the inverter of r and
+// accounts a gap if the pause since its previous report was too long.
+func trackReport(prev reading, hasPrev bool, r reading) {
+	id, siteName, t := r.ID, r.Site, r.Time
+	gapMu.Lock()
+	g := gapTrackers[id]
+	if g == nil {
+		g = &gapTracker{}
+		gapTrackers[id] = g
+	}
+	last, wasOpen := g.last, g.open
+	g.last, g.open = t, false
+
+	var gapSeconds float64
+	if !last.IsZero() {
+		delta := t.Sub(last).Seconds()
+		if g.samples >= gapMinSamples && delta > gapFactor*g.interval {
+			gapSeconds = daylightSeconds(siteName, last.Add(time.Duration(g.interval)*time.Second), t)
+			if gapSeconds < (gapFactor-1)*g.interval {
+				gapSeconds = 0
+			}
+		} else if delta < gapMaxInterval.Seconds() {
+			if g.samples == 0 {
+				g.interval = delta
+			} else {
+				g.interval = 0.9*g.interval + 0.1*delta
+			}
+			g.samples++
+		}
+	}
+	gapMu.Unlock()
+
+	accountReport(id, siteName, t, gapSeconds > 0 && !wasOpen, gapSeconds)
+	if gapSeconds > 0 && hasPrev && currentConfig().GapEstimate != "" {
+		fillGap(prev, r, gapSeconds)
+	}
+}
+
+// accountReport updates the day's gap totals of inverter id.
+func accountReport(id, siteName string, t time.Time, newGap bool, seconds float64) {
+	finished := rollover(t)
+	if finished != nil {
+		defer publishReport(finished)
+	}
+
+	day := siteDay(t)
+	dayMu.Lock()
+	if day != today.Day {
+		dayMu.Unlock()
+		return
+	}
+	g := today.Gaps[id]
+	if g == nil {
+		g = &gapTotal{First: t}
+		today.Gaps[id] = g
+	}
+	if t.After(g.Last) {
+		g.Last = t
+	}
+	if newGap {
+		g.Count++
+	}
+	g.Seconds += seconds
+	g.updateAvailability()
+	total := *g
+	dayMu.Unlock()
+
+	enecGaps.WithLabelValues(id, siteName).Set(float64(total.Count))
+	enecGapSeconds.WithLabelValues(id, siteName).Set(total.Seconds)
+	enecAvailability.WithLabelValues(id, siteName).Set(total.AvailabilityPercent)
+}
+
+// watchGaps counts ongoing gaps of inverters that stopped reporting during
+// daylight. Their duration is added once they report again. It never
+// returns.
+func watchGaps() {
+	for now := range time.Tick(time.Minute) {
+		type open struct {
+			id, siteName string
+		}
+		var opened []open
+
+		gapMu.Lock()
+		for id, g := range gapTrackers {
+			if g.open || g.samples < gapMinSamples {
+				continue
+			}
+			overdue := now.Sub(g.last).Seconds() - g.interval
+			if overdue <= 0 {
+				continue
+			}
+			siteName := inverterSite(id)
+			if daylightSeconds(siteName, g.last.Add(time.Duration(g.interval)*time.Second), now) >= (gapFactor-1)*g.interval {
+				g.open = true
+				opened = append(opened, open{id, siteName})
+			}
+		}
+		gapMu.Unlock()
+
+		for _, o := range opened {
+			fmt.Println("Inverter", o.id, "has a reporting gap")
+			dayMu.Lock()
+			g := today.Gaps[o.id]
+			if g == nil {
+				g = &gapTotal{First: now, Last: now}
+				today.Gaps[o.id] = g
+			}
+			g.Count++
+			count := g.Count
+			dayMu.Unlock()
+			enecGaps.WithLabelValues(o.id, o.siteName).Set(float64(count))
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Per-gateway heartbeat. Every accepted connection and every line read
+// updates the heartbeat of the gateway's address, so a TCP session that
+// silently stalled (heartbeat stops) can be told apart from inverters that
+// don't report because there is no sun (heartbeat continues as long as the
+// gateway sends anything).
+//
+// The gateway sends periodic keepalive/status lines between the telegrams.
+// Lines that aren't telegrams and match gatewayKeepalive (a regular
+// expression, default any non-empty line) count as keepalives. With
+// gatewayAck set, e.g. to 'OK\r' (Go escapes are interpreted), it is
+// written back after every keepalive for firmware that expects an answer. A gateway is up while it has an open
+// connection and sent something within gatewayTimeout (default 5m), going
+// down and up again is raised as an event.
+
+var (
+	enecGatewayHeartbeat = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_gateway_heartbeat",
+		Help: "Unix time of the last connection or line from the gateway.",
+	},
+		[]string{"gateway", "site"},
+	)
+	enecGatewayConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_gateway_connections",
+		Help: "Open TCP connections from the gateway.",
+	},
+		[]string{"gateway", "site"},
+	)
+	enecGatewayKeepalives = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_gateway_keepalives_total",
+		Help: "Keepalive lines received from the gateway.",
+	},
+		[]string{"gateway", "site"},
+	)
+	enecGatewayUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_gateway_up",
+		Help: "1 if the gateway is connected and sent something within gatewayTimeout.",
+	},
+		[]string{"gateway", "site"},
+	)
+)
+
+type gatewayKey struct {
+	gateway, site string
+}
+
+type gatewayState struct {
+	connections int
+	lastLine    time.Time
+	up          bool
+}
+
+var (
+	gatewayMu sync.Mutex
+	gateways  = map[gatewayKey]*gatewayState{}
+
+	keepaliveOnce    sync.Once
+	keepalivePattern *regexp.Regexp
+	keepaliveAck     []byte
+)
+
+func init() {
+	prometheus.MustRegister(enecGatewayHeartbeat)
+	prometheus.MustRegister(enecGatewayConnections)
+	prometheus.MustRegister(enecGatewayKeepalives)
+	prometheus.MustRegister(enecGatewayUp)
+}
+
+// gatewayEntry returns the state of gateway in siteName. gatewayMu must be
+// held.
+func gatewayEntry(gateway, siteName string) *gatewayState {
+	key := gatewayKey{gateway, siteName}
+	g := gateways[key]
+	if g == nil {
+		g = &gatewayState{}
+		gateways[key] = g
+	}
+	return g
+}
+
+// gatewayHost returns the host part of a remote address.
+func gatewayHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+func gatewayConnected(gateway, siteName string) {
+	enecGatewayConnections.WithLabelValues(gateway, siteName).Inc()
+	gatewayMu.Lock()
+	gatewayEntry(gateway, siteName).connections++
+	gatewayMu.Unlock()
+	gatewayHeartbeat(gateway, siteName, time.Now())
+}
+
+func gatewayDisconnected(gateway, siteName string) {
+	enecGatewayConnections.WithLabelValues(gateway, siteName).Dec()
+	gatewayMu.Lock()
+	gatewayEntry(gateway, siteName).connections--
+	gatewayMu.Unlock()
+}
+
+// gatewayHeartbeat records a line received at t from gateway of siteName.
+func gatewayHeartbeat(gateway, siteName string, t time.Time) {
+	enecGatewayHeartbeat.WithLabelValues(gateway, siteName).Set(float64(t.Unix()))
+	gatewayMu.Lock()
+	gatewayEntry(gateway, siteName).lastLine = t
+	gatewayMu.Unlock()
+}
+
+func loadKeepalive() {
+	cfg := currentConfig()
+	if pattern := cfg.GatewayKeepalive; pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			logger.Errorf("Invalid gatewayKeepalive %q: %s", pattern, err)
+		} else {
+			keepalivePattern = re
+		}
+	}
+	if ack := cfg.GatewayAck; ack != "" {
+		keepaliveAck = []byte(ack)
+		if unquoted, err := strconv.Unquote(`"` + ack + `"`); err == nil {
+			keepaliveAck = []byte(unquoted)
+		}
+	}
+}
+
+// isKeepalive reports whether a line that isn't a telegram is a keepalive.
+func isKeepalive(line string) bool {
+	keepaliveOnce.Do(loadKeepalive)
+	if keepalivePattern != nil {
+		return keepalivePattern.MatchString(line)
+	}
+	return line != ""
+}
+
+// gatewayKeepalive counts a keepalive and returns the answer to send, if
+// any.
+func gatewayKeepalive(gateway, siteName string) []byte {
+	enecGatewayKeepalives.WithLabelValues(gateway, siteName).Inc()
+	keepaliveOnce.Do(loadKeepalive)
+	return keepaliveAck
+}
+
+// watchGateways updates enecsys_gateway_up and raises events when gateways
+// go down or come back. It never returns.
+func watchGateways(timeout time.Duration) {
+	interval := timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for now := range time.Tick(interval) {
+		var changed []gatewayKey
+		var ups []bool
+		gatewayMu.Lock()
+		for key, g := range gateways {
+			up := g.connections > 0 && now.Sub(g.lastLine) < timeout
+			if up != g.up {
+				g.up = up
+				changed = append(changed, key)
+				ups = append(ups, up)
+			}
+			if up {
+				enecGatewayUp.WithLabelValues(key.gateway, key.site).Set(1)
+			} else {
+				enecGatewayUp.WithLabelValues(key.gateway, key.site).Set(0)
+			}
+		}
+		gatewayMu.Unlock()
+
+		for i, key := range changed {
+			if ups[i] {
+				emitEvent(event{Kind: "gateway_up", Severity: severityInfo, Site: key.site,
+					Message: fmt.Sprintf("Gateway %s is up", key.gateway)})
+			} else {
+				emitEvent(event{Kind: "gateway_down", Severity: severityWarning, Site: key.site,
+					Message: fmt.Sprintf("Gateway %s is down, nothing received for %s", key.gateway, timeout)})
+			}
+		}
+	}
+}
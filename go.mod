@@ -7,4 +7,6 @@ require (
 	github.com/goccy/go-yaml v1.9.2
 	github.com/juju/loggo v0.0.0-20210728185423-eebad3a902c4
 	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.26.0
 )
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Grafana annotations: with grafanaUrl and grafanaApiKey (a service account
+// token with the annotations:write permission) configured, events are
+// pushed to Grafana's annotation API so they show up on the graphs. The
+// annotations are organization wide and tagged with enecsys, the event
+// kind, the site and the inverter; a dashboard shows them with a "filter
+// by tags" annotation query for enecsys. grafanaEvents selects the event
+// kinds (comma separated), by default inverter_offline, inverter_online,
+// inverter_new and daily_reset_unexpected.
+
+const defaultGrafanaEvents = "inverter_offline,inverter_online,inverter_new,daily_reset_unexpected"
+
+type grafanaAnnotation struct {
+	Time int64    `json:"time"`
+	Tags []string `json:"tags"`
+	Text string   `json:"text"`
+}
+
+// annotateEvent pushes e to Grafana if annotations are configured for its
+// kind.
+func annotateEvent(e event) {
+	cfg := currentConfig()
+	if cfg.GrafanaURL == "" || cfg.GrafanaAPIKey == "" {
+		return
+	}
+	selected := false
+	for _, kind := range splitList(cfg.GrafanaEvents) {
+		selected = selected || kind == e.Kind
+	}
+	if !selected {
+		return
+	}
+
+	tags := []string{"enecsys", e.Kind}
+	if e.Site != "" {
+		tags = append(tags, "site:"+e.Site)
+	}
+	if e.Inverter != "" {
+		tags = append(tags, "inverter:"+e.Inverter)
+	}
+	payload, err := json.Marshal(grafanaAnnotation{Time: e.Time.UnixNano() / 1e6, Tags: tags, Text: e.Message})
+	if err != nil {
+		logger.Errorf("Couldn't encode annotation: %s", err)
+		return
+	}
+	err = postAnnotation(payload)
+	if err != nil {
+		logger.Errorf("Grafana annotation failed: %s", err)
+	}
+	reportHealth("grafana", err)
+}
+
+func postAnnotation(payload []byte) error {
+	cfg := currentConfig()
+	url := strings.TrimRight(cfg.GrafanaURL, "/") + "/api/annotations"
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+cfg.GrafanaAPIKey)
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Household grid meter ingest. The meter power is positive while importing
+// from the grid and negative while exporting; set gridInvert if the meter
+// reports it the other way round. Samples arrive either via MQTT
+//
+//	gridTopic: tele/meter/SENSOR
+//	gridJsonField: ENERGY.Power   # dotted path, if the payload is JSON
+//
+// or as HTTP POST to /api/v1/grid on the admin port, with the adminToken as
+// bearer token, with a plain number or {"power": watts}. Combined with the
+// PV power of all online inverters this yields household consumption, grid
+// export, self-consumption and autarky. The metrics are removed when the
+// meter sent nothing for gridTimeout.
+
+var (
+	enecGridPower = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_grid_power",
+		Help: "Grid meter power, positive when importing.",
+	}, nil)
+	enecGridExport = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_grid_export_power",
+		Help: "Power exported to the grid.",
+	}, nil)
+	enecConsumption = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_house_consumption_power",
+		Help: "Household consumption, PV power plus grid power.",
+	}, nil)
+	enecSelfConsumption = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_self_consumption_percent",
+		Help: "Share of the PV power consumed in the household.",
+	}, nil)
+	enecAutarky = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_autarky_percent",
+		Help: "Share of the household consumption covered by PV power.",
+	}, nil)
+
+	gridMu     sync.Mutex
+	gridPower  float64
+	gridUpdate time.Time
+)
+
+func init() {
+	prometheus.MustRegister(enecGridPower)
+	prometheus.MustRegister(enecGridExport)
+	prometheus.MustRegister(enecConsumption)
+	prometheus.MustRegister(enecSelfConsumption)
+	prometheus.MustRegister(enecAutarky)
+}
+
+// startGrid subscribes to the grid meter topic, if configured, and serves
+// the HTTP push endpoint.
+func startGrid() {
+	cfg := currentConfig()
+	if topic := cfg.GridTopic; topic != "" {
+		subscribeMqtt("grid", topic, func(client mqtt.Client, msg mqtt.Message) {
+			watts, err := parseGridPayload(msg.Payload(), cfg.GridJSONField)
+			if err != nil {
+				logger.Errorf("Couldn't parse grid meter message on %s: %s", msg.Topic(), err)
+				return
+			}
+			updateGrid(watts)
+		})
+	}
+
+	adminMux.HandleFunc("/api/v1/grid", requireAdminToken(handleGridPush))
+	go func() {
+		for range time.Tick(30 * time.Second) {
+			updateGridMetrics()
+		}
+	}()
+}
+
+func handleGridPush(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "POST a grid meter reading", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, 4096))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	field := currentConfig().GridJSONField
+	if field == "" {
+		field = "power"
+	}
+	watts, err := parseGridPayload(body, field)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	updateGrid(watts)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseGridPayload accepts a plain number or a JSON object containing the
+// number at the dotted path field.
+func parseGridPayload(payload []byte, field string) (float64, error) {
+	text := strings.TrimSpace(string(payload))
+	if watts, err := strconv.ParseFloat(text, 64); err == nil {
+		return watts, nil
+	}
+	if field == "" {
+		return 0, fmt.Errorf("payload %q is not a number", text)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return 0, err
+	}
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("no field %s in payload", field)
+		}
+		value = object[key]
+	}
+	watts, ok := value.(float64)
+	if !ok {
+		return 0, fmt.Errorf("field %s is not a number", field)
+	}
+	return watts, nil
+}
+
+func updateGrid(watts float64) {
+	if currentConfig().GridInvert {
+		watts = -watts
+	}
+
+	gridMu.Lock()
+	gridPower = watts
+	gridUpdate = time.Now()
+	gridMu.Unlock()
+
+	updateGridMetrics()
+}
+
+// updateGridMetrics combines the latest grid meter sample with the current
+// PV power. Nothing is exported until the first sample arrived, and samples
+// older than gridTimeout remove the metrics.
+func updateGridMetrics() {
+	gridMu.Lock()
+	grid, updated := gridPower, gridUpdate
+	gridMu.Unlock()
+
+	if updated.IsZero() || time.Since(updated) > currentConfig().GridTimeout {
+		for _, g := range []*prometheus.GaugeVec{enecGridPower, enecGridExport, enecConsumption, enecSelfConsumption, enecAutarky} {
+			g.Reset()
+		}
+		return
+	}
+
+	var pv float64
+	for _, r := range currentReadings() {
+		pv += r.ACPower
+	}
+
+	consumption := pv + grid
+	export := math.Max(-grid, 0)
+	selfConsumed := pv - export
+
+	enecGridPower.WithLabelValues().Set(grid)
+	enecGridExport.WithLabelValues().Set(export)
+	enecConsumption.WithLabelValues().Set(consumption)
+	if pv > 0 {
+		enecSelfConsumption.WithLabelValues().Set(100 * selfConsumed / pv)
+	} else {
+		enecSelfConsumption.WithLabelValues().Set(0)
+	}
+	if consumption > 0 {
+		enecAutarky.WithLabelValues().Set(100 * selfConsumed / consumption)
+	} else {
+		enecAutarky.WithLabelValues().Set(0)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Group suggestion for installations of unknown layout. GET
+// /api/v1/groups/suggest on the admin port, protected by the adminToken,
+// analyses the AC power stored in the history store over the last days
+// (default 14, at most groupingMaxDays) and groups inverters whose power curves
+// rise and fall together: panels of one string or orientation see the same
+// sun and shade. Each inverter's power is averaged per 5 minutes, the
+// Pearson correlation computed for every pair over the intervals both
+// reported in, and inverters joined by average linkage while groups
+// correlate by at least threshold (default 0.95). The power weighted mean
+// time of day (peak) hints at the orientation, east facing groups peak
+// earlier than west facing ones.
+//
+//	/api/v1/groups/suggest?site=home&days=30&threshold=0.97
+
+const (
+	groupingBucket = 5 * time.Minute
+	// intervals two inverters need in common to be compared
+	groupingMinOverlap = 36
+	// each day adds a history file to read for every request
+	groupingMaxDays = 90
+)
+
+type groupSuggestion struct {
+	Name        string   `json:"name"`
+	Inverters   []string `json:"inverters"`
+	Correlation float64  `json:"correlation"`
+	Peak        string   `json:"peak"`
+	// arrays the inverters are assigned to in the site file
+	Arrays []string `json:"arrays,omitempty"`
+}
+
+func init() {
+	adminMux.HandleFunc("/api/v1/groups/suggest", requireAdminToken(serveGroupSuggestions))
+}
+
+func serveGroupSuggestions(w http.ResponseWriter, r *http.Request) {
+	dir := currentConfig().HistoryDir
+	if dir == "" {
+		http.Error(w, "historyDir not configured", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	days, threshold := 14, 0.95
+	if value := query.Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > groupingMaxDays {
+			http.Error(w, fmt.Sprintf("invalid days %q", value), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	if value := query.Get("threshold"); value != "" {
+		t, err := strconv.ParseFloat(value, 64)
+		if err != nil || t <= 0 || t > 1 {
+			http.Error(w, fmt.Sprintf("invalid threshold %q", value), http.StatusBadRequest)
+			return
+		}
+		threshold = t
+	}
+
+	now := time.Now()
+	series, err := powerSeries(dir, query.Get("site"), siteDay(now.AddDate(0, 0, -days)), siteDay(now))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestGroups(series, threshold))
+}
+
+// powerSeries returns the mean AC power per interval of every inverter of
+// siteName (all if empty) stored between the days from and to.
+func powerSeries(dir, siteName, from, to string) (map[string]map[int64]float64, error) {
+	days, err := historyDays(dir, from, to)
+	if err != nil {
+		return nil, err
+	}
+	type sum struct {
+		total float64
+		n     int
+	}
+	sums := map[string]map[int64]*sum{}
+	bucket := int64(groupingBucket / time.Second)
+	for _, day := range days {
+		err := readHistoryDay(dir, day, func(row historyRow) error {
+			power, ok := row.Values["ac_power"]
+			if !ok || siteName != "" && row.Site != siteName {
+				return nil
+			}
+			if sums[row.ID] == nil {
+				sums[row.ID] = map[int64]*sum{}
+			}
+			b := row.Time.Unix() / bucket
+			if sums[row.ID][b] == nil {
+				sums[row.ID][b] = &sum{}
+			}
+			sums[row.ID][b].total += power
+			sums[row.ID][b].n++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	series := make(map[string]map[int64]float64, len(sums))
+	for id, buckets := range sums {
+		series[id] = make(map[int64]float64, len(buckets))
+		for b, s := range buckets {
+			series[id][b] = s.total / float64(s.n)
+		}
+	}
+	return series, nil
+}
+
+// correlation returns the Pearson correlation of a and b over their common
+// intervals in daylight, and false if there are too few of them to tell.
+func correlation(a, b map[int64]float64) (float64, bool) {
+	var n, sa, sb, saa, sbb, sab float64
+	for t, x := range a {
+		y, ok := b[t]
+		if !ok || x <= 0 && y <= 0 {
+			continue
+		}
+		n++
+		sa += x
+		sb += y
+		saa += x * x
+		sbb += y * y
+		sab += x * y
+	}
+	if n < groupingMinOverlap {
+		return 0, false
+	}
+	cov := sab/n - sa/n*sb/n
+	va, vb := saa/n-sa/n*sa/n, sbb/n-sb/n*sb/n
+	if va <= 0 || vb <= 0 {
+		return 0, false
+	}
+	return cov / math.Sqrt(va*vb), true
+}
+
+// suggestGroups clusters the inverters of series by average linkage until
+// no two groups correlate by threshold or more.
+func suggestGroups(series map[string]map[int64]float64, threshold float64) []groupSuggestion {
+	ids := make([]string, 0, len(series))
+	for id := range series {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	type pairKey struct{ a, b string }
+	corr := map[pairKey]float64{}
+	for i, a := range ids {
+		for _, b := range ids[i+1:] {
+			if c, ok := correlation(series[a], series[b]); ok {
+				corr[pairKey{a, b}], corr[pairKey{b, a}] = c, c
+			}
+		}
+	}
+	// linkage is the mean correlation of all pairs between two groups, or
+	// false if any pair couldn't be compared.
+	linkage := func(x, y []string) (float64, bool) {
+		total := 0.0
+		for _, a := range x {
+			for _, b := range y {
+				c, ok := corr[pairKey{a, b}]
+				if !ok {
+					return 0, false
+				}
+				total += c
+			}
+		}
+		return total / float64(len(x)*len(y)), true
+	}
+
+	clusters := make([][]string, len(ids))
+	for i, id := range ids {
+		clusters[i] = []string{id}
+	}
+	for {
+		best, bi, bj := threshold, -1, -1
+		for i := range clusters {
+			for j := i + 1; j < len(clusters); j++ {
+				if c, ok := linkage(clusters[i], clusters[j]); ok && c >= best {
+					best, bi, bj = c, i, j
+				}
+			}
+		}
+		if bi < 0 {
+			break
+		}
+		clusters[bi] = append(clusters[bi], clusters[bj]...)
+		clusters = append(clusters[:bj], clusters[bj+1:]...)
+	}
+
+	arrays := map[string]bool{}
+	suggestions := make([]groupSuggestion, 0, len(clusters))
+	for _, members := range clusters {
+		sort.Strings(members)
+		g := groupSuggestion{Inverters: members, Correlation: 1, Peak: peakTime(series, members)}
+		if len(members) > 1 {
+			total, pairs := 0.0, 0
+			for i, a := range members {
+				for _, b := range members[i+1:] {
+					total += corr[pairKey{a, b}]
+					pairs++
+				}
+			}
+			g.Correlation = math.Round(total/float64(pairs)*1000) / 1000
+		}
+		for k := range arrays {
+			delete(arrays, k)
+		}
+		for _, id := range members {
+			if a := inverter(id).Array; a != "" && !arrays[a] {
+				arrays[a] = true
+				g.Arrays = append(g.Arrays, a)
+			}
+		}
+		sort.Strings(g.Arrays)
+		suggestions = append(suggestions, g)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Peak != suggestions[j].Peak {
+			return suggestions[i].Peak < suggestions[j].Peak
+		}
+		return suggestions[i].Inverters[0] < suggestions[j].Inverters[0]
+	})
+	for i := range suggestions {
+		suggestions[i].Name = fmt.Sprintf("group%d", i+1)
+	}
+	return suggestions
+}
+
+// peakTime returns the power weighted mean local time of day of the
+// inverters' production as HH:MM.
+func peakTime(series map[string]map[int64]float64, ids []string) string {
+	var weighted, total float64
+	for _, id := range ids {
+		for b, power := range series[id] {
+			if power <= 0 {
+				continue
+			}
+			t := time.Unix(b*int64(groupingBucket/time.Second), 0).Add(groupingBucket / 2)
+			minutes := float64(t.Hour()*60 + t.Minute())
+			weighted += power * minutes
+			total += power
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	m := int(weighted / total)
+	return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health checks for Kubernetes and Docker, on both HTTP ports and without
+// token. GET /healthz answers 200 as long as the process serves HTTP. GET
+// /ready answers 200 once a gateway input (anything but the HTTP ingest and
+// capture files) is running and the exporter decoded a telegram within
+// readyTimeout (default 1h) or, e.g. at night, the publishing client is
+// connected to an MQTT broker; 503 otherwise. Both return the state as
+// JSON:
+//
+//	{"ready":true,"inputs":["plain"],"lastTelegram":"2021-06-01T12:00:00Z","mqttConnected":true}
+
+type readiness struct {
+	Ready         bool       `json:"ready"`
+	Inputs        []string   `json:"inputs"`
+	LastTelegram  *time.Time `json:"lastTelegram,omitempty"`
+	MqttConnected bool       `json:"mqttConnected"`
+}
+
+var (
+	decodedMu   sync.Mutex
+	lastDecoded time.Time
+)
+
+func init() {
+	for _, mux := range []*http.ServeMux{publicMux, adminMux} {
+		mux.HandleFunc("/healthz", serveHealthz)
+		mux.HandleFunc("/ready", serveReady)
+	}
+}
+
+// markDecoded records a telegram received at t that decoded.
+func markDecoded(t time.Time) {
+	decodedMu.Lock()
+	if t.After(lastDecoded) {
+		lastDecoded = t
+	}
+	decodedMu.Unlock()
+}
+
+// checkReadiness returns the readiness at now.
+func checkReadiness(now time.Time) readiness {
+	r := readiness{Inputs: runningInputs("http", "file"), MqttConnected: mqttConnected()}
+	if r.Inputs == nil {
+		r.Inputs = []string{}
+	}
+	decodedMu.Lock()
+	last := lastDecoded
+	decodedMu.Unlock()
+	recent := false
+	if !last.IsZero() {
+		r.LastTelegram = &last
+		recent = now.Sub(last) <= currentConfig().ReadyTimeout
+	}
+	r.Ready = len(r.Inputs) > 0 && (recent || r.MqttConnected)
+	return r
+}
+
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+func serveReady(w http.ResponseWriter, r *http.Request) {
+	state := checkReadiness(time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if !state.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(state)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Production heat maps, the hour of day by day view of the old Enecsys
+// portal. GET /api/v1/heatmap reads the history store of the last days
+// (default 365) and returns for every inverter the energy produced in each
+// hour of each day, from the increases of its lifetime counter between
+// stored readings, credited to the hour of the later one like the daily
+// report does. id and site restrict the inverters, format=svg or png
+// renders the heat map of one inverter, days left to right and hours top
+// to bottom, from dark (nothing) to light yellow (the best hour). The heat
+// map of an inverter that replaced others (see replacement.go) is that of
+// its logical ID and covers them all.
+//
+//	/api/v1/heatmap?site=home&days=90
+//	/api/v1/heatmap?id=0f2a91cc&format=svg
+
+const (
+	// size of a day's hour in the rendered heat maps, in pixels
+	heatmapCellWidth  = 3
+	heatmapCellHeight = 10
+	// room for the labels of the SVG heat map
+	heatmapMargin = 30
+)
+
+type heatmap struct {
+	ID   string   `json:"id"`
+	Site string   `json:"site,omitempty"`
+	Days []string `json:"days"`
+	// energy per day and hour of day
+	Wh    [][24]float64 `json:"wh"`
+	MaxWh float64       `json:"maxWh"`
+}
+
+// heatmapColors are the stops of the color scale, from no production to
+// the maximum.
+var heatmapColors = []color.RGBA{
+	{20, 11, 52, 255},
+	{120, 28, 109, 255},
+	{212, 72, 66, 255},
+	{250, 160, 30, 255},
+	{252, 255, 164, 255},
+}
+
+func init() {
+	publicMux.HandleFunc("/api/v1/heatmap", serveHeatmap)
+}
+
+func serveHeatmap(w http.ResponseWriter, r *http.Request) {
+	dir := currentConfig().HistoryDir
+	if dir == "" {
+		http.Error(w, "historyDir not configured", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	days := 365
+	if value := query.Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("invalid days %q", value), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	id, format := query.Get("id"), query.Get("format")
+	switch format {
+	case "", "json":
+	case "svg", "png":
+		if id == "" {
+			http.Error(w, "format "+format+" needs an id", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("invalid format %q, expected json, svg or png", format), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	maps, err := heatmaps(dir, id, query.Get("site"), siteDay(now.AddDate(0, 0, 1-days)), siteDay(now))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if format == "" || format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(maps)
+		return
+	}
+	if len(maps) == 0 {
+		http.Error(w, "no history of inverter "+id, http.StatusNotFound)
+		return
+	}
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(heatmapSVG(maps[0]))
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, heatmapImage(maps[0])); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// heatmaps returns the heat maps of the inverters stored between the days
+// from and to, of inverter id and of siteName if not empty, ordered by ID.
+// All of them cover the same days.
+func heatmaps(dir, id, siteName, from, to string) ([]heatmap, error) {
+	days, err := historyDays(dir, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" {
+		id = logicalID(id)
+	}
+	maps := map[string]*heatmap{}
+	// latest reading by physical ID
+	last := map[string]reading{}
+	for i, day := range days {
+		err := readHistoryDay(dir, day, func(row historyRow) error {
+			logical := logicalID(row.ID)
+			if id != "" && logical != id || siteName != "" && row.Site != siteName {
+				return nil
+			}
+			kwh, ok := row.Values["kilowatthours_history"]
+			wh, ok2 := row.Values["watthours_today"]
+			if !ok || !ok2 {
+				return nil
+			}
+			r := reading{ID: row.ID, Time: row.Time, Kwh: kwh, Wh: wh, LifeWh: 1000*kwh + wh}
+			m := maps[logical]
+			if m == nil {
+				m = &heatmap{ID: logical, Days: days, Wh: make([][24]float64, len(days))}
+				maps[logical] = m
+			}
+			m.Site = row.Site
+			prev, seen := last[row.ID]
+			last[row.ID] = r
+			if !seen {
+				return nil
+			}
+			// jumps are left out as in the energy metrics
+			detectLifetimeJump(prev, &r)
+			if delta := lifetimeDelta(prev, r); delta > 0 && r.LifetimeJump == 0 {
+				m.Wh[i][r.Time.Hour()] += delta
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]heatmap, 0, len(maps))
+	for _, m := range maps {
+		for _, hours := range m.Wh {
+			for _, wh := range hours {
+				if wh > m.MaxWh {
+					m.MaxWh = wh
+				}
+			}
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// heatmapColor returns the color of wh on the scale up to max.
+func heatmapColor(wh, max float64) color.RGBA {
+	if max <= 0 || wh <= 0 {
+		return heatmapColors[0]
+	}
+	f := wh / max * float64(len(heatmapColors)-1)
+	i := int(f)
+	if i >= len(heatmapColors)-1 {
+		return heatmapColors[len(heatmapColors)-1]
+	}
+	a, b, frac := heatmapColors[i], heatmapColors[i+1], f-float64(i)
+	mix := func(x, y uint8) uint8 { return uint8(float64(x) + (float64(y)-float64(x))*frac) }
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 255}
+}
+
+// heatmapImage renders m without labels.
+func heatmapImage(m heatmap) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, len(m.Days)*heatmapCellWidth, 24*heatmapCellHeight))
+	for d, hours := range m.Wh {
+		for h, wh := range hours {
+			c := heatmapColor(wh, m.MaxWh)
+			for x := d * heatmapCellWidth; x < (d+1)*heatmapCellWidth; x++ {
+				for y := h * heatmapCellHeight; y < (h+1)*heatmapCellHeight; y++ {
+					img.SetRGBA(x, y, c)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// heatmapSVG renders m with the hours of the day and the first days of the
+// months as labels, and the energy of each cell as its title.
+func heatmapSVG(m heatmap) []byte {
+	var buf bytes.Buffer
+	width := len(m.Days)*heatmapCellWidth + heatmapMargin
+	height := 24*heatmapCellHeight + heatmapMargin
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="9">`+"\n", width, height)
+	fmt.Fprintf(&buf, "<title>%s</title>\n", m.ID)
+	for h := 0; h < 24; h += 3 {
+		fmt.Fprintf(&buf, `<text x="%d" y="%d" text-anchor="end">%02d</text>`+"\n", heatmapMargin-4, h*heatmapCellHeight+heatmapCellHeight-1, h)
+	}
+	for d, day := range m.Days {
+		x := heatmapMargin + d*heatmapCellWidth
+		if day[8:] == "01" || d == 0 {
+			fmt.Fprintf(&buf, `<text x="%d" y="%d">%s</text>`+"\n", x, height-heatmapMargin/2, day[:7])
+		}
+		for h, wh := range m.Wh[d] {
+			c := heatmapColor(wh, m.MaxWh)
+			fmt.Fprintf(&buf, `<rect x="%d" y="%d" width="%d" height="%d" fill="#%02x%02x%02x"><title>%s %02d:00 %.0f Wh</title></rect>`+"\n",
+				x, h*heatmapCellHeight, heatmapCellWidth, heatmapCellHeight, c.R, c.G, c.B, day, h, wh)
+		}
+	}
+	buf.WriteString("</svg>\n")
+	return buf.Bytes()
+}
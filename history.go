@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Embedded history store: with historyDir configured every reading is
+// appended to <historyDir>/<day>.csv. The columns are the time, the
+// inverter ID, its site and the exported values, named after their metric
+// without the enecsys_ prefix. The last column, daily_reset_wh, is only set
+// on the first row after a reset of the daily counter, see dailyreset.go.
+
+const historyTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+var (
+	historyMu     sync.Mutex
+	historyDay    string
+	historyFile   *os.File
+	historyWriter *csv.Writer
+)
+
+func historyColumns() []string {
+	columns := []string{"time", "id", "site"}
+	for _, f := range fields {
+		columns = append(columns, strings.TrimPrefix(f.metric, "enecsys_"))
+	}
+	return append(columns, "daily_reset_wh")
+}
+
+// storeHistory appends r to the history file of its day.
+func storeHistory(r reading) {
+	dir := currentConfig().HistoryDir
+	if dir == "" {
+		return
+	}
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	if day := siteDay(r.Time); day != historyDay || historyWriter == nil {
+		if err := openHistory(dir, day); err != nil {
+			logger.Errorf("Couldn't open history file: %s", err)
+			reportHealth("history", err)
+			return
+		}
+	}
+
+	record := []string{r.Time.Format(historyTimeFormat), r.ID, r.Site}
+	for _, f := range fields {
+		if r.valid(f.topic) {
+			record = append(record, strconv.FormatFloat(f.value(&r), 'g', -1, 64))
+		} else {
+			record = append(record, "")
+		}
+	}
+	if r.DailyReset {
+		record = append(record, strconv.FormatFloat(r.ResetWh, 'g', -1, 64))
+	} else {
+		record = append(record, "")
+	}
+	err := historyWriter.Write(record)
+	if err != nil {
+		logger.Errorf("Couldn't write history: %s", err)
+	}
+	reportHealth("history", err)
+}
+
+// openHistory switches to the history file of day, writing the header if
+// the file is new. historyMu must be held.
+func openHistory(dir, day string) error {
+	closeHistory()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, day+".csv")
+	header, err := lastHistoryHeader(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	osFile, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	historyFile = osFile
+	historyWriter = csv.NewWriter(bufio.NewWriter(osFile))
+	historyDay = day
+	// A new header starts the file, and is repeated when the columns changed
+	// since the file was started, e.g. after an upgrade.
+	if columns := historyColumns(); strings.Join(header, ",") != strings.Join(columns, ",") {
+		return historyWriter.Write(columns)
+	}
+	return nil
+}
+
+// lastHistoryHeader returns the header that applies to rows appended to the
+// history file at path.
+func lastHistoryHeader(path string) ([]string, error) {
+	osFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer osFile.Close()
+
+	var header []string
+	scanner := bufio.NewScanner(osFile)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "time,") {
+			header = strings.Split(line, ",")
+		}
+	}
+	return header, scanner.Err()
+}
+
+// closeHistory flushes and closes the current history file. historyMu must
+// be held.
+func closeHistory() {
+	if historyFile == nil {
+		return
+	}
+	flushHistory()
+	historyFile.Close()
+	historyFile = nil
+	historyWriter = nil
+}
+
+// flushHistory writes buffered rows to disk. historyMu must be held.
+func flushHistory() {
+	if historyWriter == nil {
+		return
+	}
+	historyWriter.Flush()
+	if err := historyWriter.Error(); err != nil {
+		logger.Errorf("Couldn't write history: %s", err)
+	}
+}
+
+// flushHistoryLoop flushes the history every ten seconds, less often in
+// deep sleep. It never returns.
+func flushHistoryLoop() {
+	for range sleepyTick(10 * time.Second) {
+		historyMu.Lock()
+		flushHistory()
+		historyMu.Unlock()
+	}
+}
+
+// historyRow is one reading read back from the history store.
+type historyRow struct {
+	Time   time.Time
+	ID     string
+	Site   string
+	Values map[string]float64
+}
+
+// historyDays returns the days stored in dir between from and to
+// (inclusive, as YYYY-MM-DD, empty for no limit), oldest first.
+func historyDays(dir, from, to string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "????-??-??.csv"))
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, match := range matches {
+		day := strings.TrimSuffix(filepath.Base(match), ".csv")
+		if (from == "" || day >= from) && (to == "" || day <= to) {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// readHistoryDay calls fn for every row stored for day.
+func readHistoryDay(dir, day string, fn func(row historyRow) error) error {
+	osFile, err := os.Open(filepath.Join(dir, day+".csv"))
+	if err != nil {
+		return err
+	}
+	defer osFile.Close()
+
+	reader := csv.NewReader(osFile)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	if len(header) < 2 || header[0] != "time" || header[1] != "id" {
+		return fmt.Errorf("%s.csv: unexpected header", day)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record[0] == "time" {
+			header = record
+			continue
+		}
+		if len(record) != len(header) {
+			return fmt.Errorf("%s.csv: row has %d columns, header %d", day, len(record), len(header))
+		}
+
+		t, err := time.Parse(historyTimeFormat, record[0])
+		if err != nil {
+			return err
+		}
+		row := historyRow{Time: t, ID: record[1], Values: make(map[string]float64, len(record)-2)}
+		for i, column := range header[2:] {
+			// Files written before sites existed have no site column.
+			if column == "site" {
+				row.Site = record[i+2]
+			} else if value, err := strconv.ParseFloat(record[i+2], 64); err == nil {
+				row.Values[column] = value
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
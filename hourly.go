@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Hourly energy breakdown. The energy credited to the day is also split by
+// the clock hour of the reading. enecsys_watthours_hour keeps the total of
+// the most recent completed instance of every hour of the day, which is
+// what hour-of-day heatmaps need.
+
+var (
+	enecWhCurrentHour = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_watthours_current_hour",
+		Help: "Watt hours produced in the current hour.",
+	},
+		[]string{"id", "site"},
+	)
+	enecWhHour = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_watthours_hour",
+		Help: "Watt hours produced in the last completed instance of the hour of day.",
+	},
+		[]string{"id", "site", "hour"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(enecWhCurrentHour)
+	prometheus.MustRegister(enecWhHour)
+}
+
+func deleteHourSeries(id, siteName string) {
+	enecWhCurrentHour.DeleteLabelValues(id, siteName)
+	for hour := 0; hour < 24; hour++ {
+		enecWhHour.DeleteLabelValues(id, siteName, fmt.Sprintf("%02d", hour))
+	}
+}
+
+// creditHour adds wh to the hour of t in report. dayMu must be held.
+func creditHour(report *dailyReport, id string, t time.Time, wh float64) {
+	hours := report.Hours[id]
+	if hours == nil {
+		hours = make([]float64, 24)
+		report.Hours[id] = hours
+	}
+	hours[t.Hour()] += wh
+}
+
+// updateHourlyMetrics exports the hours of report completed before now; all
+// of them if the day is over. dayMu must be held.
+func updateHourlyMetrics(report *dailyReport, now time.Time, dayOver bool) {
+	for id, hours := range report.Hours {
+		siteName := inverterSite(id)
+		completed := now.Hour()
+		if dayOver {
+			completed = 24
+		} else {
+			enecWhCurrentHour.WithLabelValues(id, siteName).Set(hours[now.Hour()])
+		}
+		for h := 0; h < completed && h < len(hours); h++ {
+			enecWhHour.WithLabelValues(id, siteName, fmt.Sprintf("%02d", h)).Set(hours[h])
+		}
+	}
+}
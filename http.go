@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The exporter serves two HTTP ports: the public one with /metrics and the
+// API (metricsAddress, default :5041), and an optional admin port
+// (adminAddress) for management endpoints, see admin.go. Setting
+// metricsOnAdmin moves /metrics to the admin port, and an empty
+// metricsAddress disables the public port entirely. privacy hides the
+// inverter IDs on the public port, see privacy.go.
+//
+// On a shared network the public port can be served with TLS, and /metrics
+// and the aggregate protected with basic auth, a bearer token or both:
+//
+//	metricsTlsCert: /etc/enecsys/metrics.crt
+//	metricsTlsKey: /etc/enecsys/metrics.key
+//	metricsUser: prometheus
+//	metricsPassword: secret
+//	metricsToken: another-secret
+//
+// with the matching tls_config, basic_auth or authorization in the scrape
+// config of Prometheus. The health checks and the API stay open. The
+// credentials take effect on a config reload, the certificate needs a
+// restart.
+
+var (
+	publicMux = http.NewServeMux()
+	adminMux  = http.NewServeMux()
+)
+
+func startHTTP() {
+	cfg := currentConfig()
+	metricsPath := cfg.MetricsPath
+	adminAddress, admin := cfg.AdminAddress, cfg.AdminAddress != ""
+
+	metrics := requireMetricsAuth(promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(renamingGatherer(inverterLabelGatherer(prometheus.DefaultGatherer)),
+			promhttp.HandlerOpts{EnableOpenMetrics: tracingEnabled()})))
+	if admin && cfg.MetricsOnAdmin {
+		adminMux.Handle(metricsPath, metrics)
+	} else {
+		publicMux.Handle(metricsPath, metrics)
+	}
+
+	startAggregate()
+
+	if address := cfg.MetricsAddress; address != "" {
+		go serveHTTP("metrics", address, privateHandler(publicMux), cfg.MetricsTLSCert, cfg.MetricsTLSKey)
+	}
+	if admin {
+		allow, err := parseAllowlist(splitList(cfg.AdminAllow))
+		if err != nil {
+			logger.Errorf("Not serving admin: adminAllow: %s", err)
+			return
+		}
+		go serveHTTP("admin", adminAddress, allowOnly(allow, adminMux), "", "")
+	}
+}
+
+// serveHTTP serves handler on address, with TLS if certFile and keyFile
+// are set.
+func serveHTTP(name, address string, handler http.Handler, certFile, keyFile string) {
+	server := &http.Server{Addr: address, Handler: handler}
+	trackServer(server)
+	var err error
+	if certFile != "" {
+		fmt.Println("serving", name, "with TLS on", address)
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		fmt.Println("serving", name, "on", address)
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		logger.Errorf("%s server on %s failed: %s", name, address, err)
+	}
+}
+
+// requireMetricsAuth serves handler to clients with the metricsUser and
+// metricsPassword or the metricsToken, to all if neither is set.
+func requireMetricsAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, token := currentConfig().MetricsUser, currentConfig().MetricsPassword, currentConfig().MetricsToken
+		if user == "" && token == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if token != "" {
+			given := r.Header.Get("Authorization")
+			if strings.HasPrefix(given, "Bearer ") &&
+				subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(given, "Bearer ")), []byte(token)) == 1 {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		if user != "" {
+			givenUser, givenPassword, ok := r.BasicAuth()
+			if ok && subtle.ConstantTimeCompare([]byte(givenUser), []byte(user)) == 1 &&
+				subtle.ConstantTimeCompare([]byte(givenPassword), []byte(password)) == 1 {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="enecsys-exporter"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Inverter IDs are normalized to one canonical form, chosen with idFormat,
+// used for metrics, MQTT topics, the site file and the stored state alike:
+//
+//	hex       8 lowercase hex digits as sent by the inverter (default)
+//	upper     8 uppercase hex digits
+//	reversed  8 lowercase hex digits in reversed byte order, as some tools
+//	          show them
+//	decimal   the ID as decimal number
+//
+// IDs in the site file are read in the configured form, ignoring case, a
+// 0x prefix and missing leading zeros. Changing idFormat changes every
+// series and topic, and the stored state of the old IDs is lost.
+
+func idFormat() string {
+	return currentConfig().IDFormat
+}
+
+// canonicalID converts the ID of a decoded telegram, 8 lowercase hex digits,
+// to the canonical form.
+func canonicalID(hexID string) string {
+	switch idFormat() {
+	case "upper":
+		return strings.ToUpper(hexID)
+	case "reversed":
+		return reverseHexBytes(hexID)
+	case "decimal":
+		if v, err := strconv.ParseUint(hexID, 16, 32); err == nil {
+			return strconv.FormatUint(v, 10)
+		}
+	}
+	return hexID
+}
+
+// telegramID converts a canonical ID back to the form used in telegrams.
+func telegramID(id string) (string, error) {
+	id = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(id), "0x"), "0X"))
+	if idFormat() == "decimal" {
+		v, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid inverter ID %q, expected a decimal number", id)
+		}
+		return fmt.Sprintf("%08x", v), nil
+	}
+	if len(id) == 0 || len(id) > 8 {
+		return "", fmt.Errorf("invalid inverter ID %q, expected up to 8 hex digits", id)
+	}
+	if _, err := strconv.ParseUint(id, 16, 32); err != nil {
+		return "", fmt.Errorf("invalid inverter ID %q, expected up to 8 hex digits", id)
+	}
+	id = strings.Repeat("0", 8-len(id)) + id
+	if idFormat() == "reversed" {
+		id = reverseHexBytes(id)
+	}
+	return id, nil
+}
+
+// normalizeID returns id, as written by a user, in canonical form.
+func normalizeID(id string) (string, error) {
+	hexID, err := telegramID(id)
+	if err != nil {
+		return "", err
+	}
+	return canonicalID(hexID), nil
+}
+
+func reverseHexBytes(h string) string {
+	out := make([]byte, 0, len(h))
+	for i := len(h) - 2; i >= 0; i -= 2 {
+		out = append(out, h[i], h[i+1])
+	}
+	return string(out)
+}
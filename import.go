@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The import subcommand decodes raw captures into the history store with
+// their original timestamps, without touching metrics, MQTT or the state,
+// e.g. to rebuild the history of days captured before historyDir was set.
+// Days that already have a history file are skipped unless -append is given,
+// so importing twice doesn't duplicate rows.
+
+func runImport(args []string) int {
+	cfg := currentConfig()
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	appendRows := flags.Bool("append", false, "also import into days that already have history")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import [flags] /path/to/config_file capture_file...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return 2
+	}
+	getCredentials(flags.Arg(0))
+	dir := cfg.HistoryDir
+	if dir == "" {
+		fmt.Println("No historyDir configured, nothing to import into.")
+		return 1
+	}
+	if siteFile := cfg.SiteFile; siteFile != "" {
+		if err := loadSiteFile(siteFile); err != nil {
+			fmt.Println("Couldn't read site file:", err)
+			return 1
+		}
+	}
+
+	existing := map[string]bool{}
+	if !*appendRows {
+		files, _ := filepath.Glob(filepath.Join(dir, "????-??-??.csv"))
+		for _, file := range files {
+			existing[filepath.Base(file[:len(file)-len(".csv")])] = true
+		}
+	}
+
+	imported, skipped := 0, 0
+	for _, file := range flags.Args()[1:] {
+		err := readCapture(file, func(c captureRecord) error {
+			if !isTelegram(c.Line) {
+				return nil
+			}
+			if existing[siteDay(c.Time)] {
+				skipped++
+				return nil
+			}
+			r, err := decodeWS(c.Line[21:])
+			if err != nil {
+				skipped++
+				return nil
+			}
+			r.ID = canonicalID(r.ID)
+			r.Time = c.Time
+			r.Site = c.Site
+			if siteName := inverter(r.ID).Site; siteName != "" {
+				r.Site = siteName
+			}
+			validate(&r)
+			if len(r.Invalid) > 0 && cfg.StrictParse {
+				skipped++
+				return nil
+			}
+			storeHistory(r)
+			imported++
+			return nil
+		})
+		if err != nil {
+			fmt.Println("Import failed:", err)
+			return 1
+		}
+	}
+
+	historyMu.Lock()
+	closeHistory()
+	historyMu.Unlock()
+	fmt.Println("Imported", imported, "readings, skipped", skipped)
+	return 0
+}
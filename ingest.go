@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP ingest for remote relays that can't hold a TCP connection to the
+// exporter: POST /api/v1/ingest takes gateway lines, separated by CR or LF,
+// and handles them like lines of a gateway connection. Every request needs
+// an API key of a site as bearer token, and the key determines the site the
+// frames are attributed to, so relays of different customers can't write
+// into each other's data. Telegrams of inverters that belong to another
+// site, assigned in the site file or first heard there, are rejected.
+//
+//	sites:
+//	  smith:
+//	    apiKeys: ["9f86d081884c7d65"]
+//
+// The endpoint is disabled while no site has an API key.
+
+const ingestMaxBody = 1 << 20
+
+type ingestResult struct {
+	Site      string `json:"site"`
+	Lines     int    `json:"lines"`
+	Telegrams int    `json:"telegrams"`
+	// telegrams of inverters of other sites
+	Rejected int `json:"rejected"`
+}
+
+var (
+	ingestMu      sync.Mutex
+	ingestDeliver lineHandler
+)
+
+func init() {
+	publicMux.HandleFunc("/api/v1/ingest", serveIngest)
+}
+
+// httpInput is the ingest endpoint as input. It's served by the public
+// HTTP server, so run only connects the endpoint and never returns.
+type httpInput struct{}
+
+func (httpInput) name() string { return "http" }
+func (httpInput) kind() string { return "http" }
+
+func (httpInput) run(deliver lineHandler) error {
+	ingestMu.Lock()
+	ingestDeliver = deliver
+	ingestMu.Unlock()
+	select {}
+}
+
+// siteForAPIKey returns the site key belongs to.
+func siteForAPIKey(key string) (string, bool) {
+	siteMu.RLock()
+	defer siteMu.RUnlock()
+
+	found, match := "", false
+	for name, s := range site.Sites {
+		for _, k := range s.APIKeys {
+			// compare with every key, so the time taken doesn't tell
+			// how close a guess was
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+				found, match = name, true
+			}
+		}
+	}
+	return found, match
+}
+
+func apiKeysConfigured() bool {
+	siteMu.RLock()
+	defer siteMu.RUnlock()
+	for _, s := range site.Sites {
+		if len(s.APIKeys) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func serveIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST gateway lines", http.StatusMethodNotAllowed)
+		return
+	}
+	if !apiKeysConfigured() {
+		http.Error(w, "no site has apiKeys configured", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	siteName, ok := siteForAPIKey(key)
+	if key == "" || !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ingestMu.Lock()
+	deliver := ingestDeliver
+	ingestMu.Unlock()
+	if deliver == nil {
+		http.Error(w, "ingest not running", http.StatusServiceUnavailable)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, ingestMaxBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// All lines of the body have arrived by now.
+	received := time.Now()
+
+	gateway := gatewayHost(r.RemoteAddr)
+	result := ingestResult{Site: siteName}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Split(scanGatewayLines)
+	for scanner.Scan() {
+		message := scanner.Text()
+		if message == "" {
+			continue
+		}
+		result.Lines++
+		if isTelegram(message) {
+			// An inverter of another site would move its series over
+			// to this one.
+			if ws, err := decodeWS(message[21:]); err == nil {
+				if other := inverterSite(canonicalID(ws.ID)); other != "" && other != siteName {
+					result.Rejected++
+					continue
+				}
+			}
+			result.Telegrams++
+		}
+		deliver(message, gateway, siteName, received)
+	}
+	fmt.Println("Ingested", result.Lines, "lines for site", siteName, "from", gateway)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// scanCRLines is a bufio.SplitFunc for lines ending in CR, as gateways
+// send them. A last line without CR is dropped.
+func scanCRLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, '\r'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	return 0, nil, nil
+}
+
+// scanGatewayLines is a bufio.SplitFunc for lines ending in CR, LF or both.
+func scanGatewayLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
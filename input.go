@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Frame sources. Everything delivering gateway lines - the TCP and TLS
+// listeners, the HTTP ingest endpoint and the inputs below - implements
+// input and hands its lines to the decoding core through the lineHandler
+// it's run with, which also keeps the per-input metrics. A new transport
+// only needs an input implementation and an entry in inputKinds.
+//
+// Further inputs are configured as a comma separated list of URLs, with an
+// optional site the lines are attributed to:
+//
+//	inputs: "udp://:5041?site=smith, serial:///dev/ttyUSB0, mqtt://enecsys/gateway/+, file:///var/lib/enecsys/2021-06-01.capture.gz"
+//
+//	udp     datagrams of gateway lines, separated by CR or LF
+//	serial  a gateway on a serial port, set up beforehand, e.g. with
+//	        stty -F /dev/ttyUSB0 115200 raw
+//	mqtt    gateway lines published to the topic by a relay
+//	file    a capture file (see capture.go), read once at start
+//
+// Inputs that fail are restarted after inputRetry.
+
+const inputRetry = 10 * time.Second
+
+// An input delivers gateway lines from one source.
+type input interface {
+	// name labels the input's metrics and log messages.
+	name() string
+	// kind is the transport, e.g. tcp or udp.
+	kind() string
+	// run delivers the lines of the input to deliver. It returns when the
+	// input failed or, like a file, is exhausted.
+	run(deliver lineHandler) error
+}
+
+// lineHandler processes a line received at t from gateway of siteName. t
+// is taken when the line's delimiter is read and carried through to all
+// outputs - metrics, MQTT, history, captures and events - instead of the
+// time they get to the line, so they agree even when the decoding core
+// falls behind.
+type lineHandler func(message, gateway, siteName string, t time.Time)
+
+// stampedLine is a gateway line with the time its delimiter was read.
+type stampedLine struct {
+	message string
+	t       time.Time
+}
+
+// stampLines scans the lines of scanner in the background, so each is
+// stamped as soon as its delimiter is read rather than after the lines
+// before it are processed. The channel is closed when scanning ends, then
+// scanner.Err tells why.
+func stampLines(scanner *bufio.Scanner) <-chan stampedLine {
+	lines := make(chan stampedLine, 100)
+	go func() {
+		defer close(lines)
+		for scanner.Scan() {
+			lines <- stampedLine{scanner.Text(), time.Now()}
+		}
+	}()
+	return lines
+}
+
+// inputKinds build the inputs of the inputs config key from their URL
+// without scheme and site.
+var inputKinds = map[string]func(target, siteName string) (input, error){
+	"udp":    newUDPInput,
+	"serial": newSerialInput,
+	"mqtt":   newMqttInput,
+	"file":   newFileInput,
+}
+
+var (
+	enecInputUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_input_up",
+		Help: "1 while the frame input is running.",
+	},
+		[]string{"input", "kind"},
+	)
+	enecInputLines = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_input_lines_total",
+		Help: "Gateway lines delivered by the frame input.",
+	},
+		[]string{"input", "kind"},
+	)
+	enecInputFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_input_failures_total",
+		Help: "Times the frame input failed and was restarted.",
+	},
+		[]string{"input", "kind"},
+	)
+	enecInputLastLine = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_input_last_line_timestamp_seconds",
+		Help: "Time the frame input delivered its last line.",
+	},
+		[]string{"input", "kind"},
+	)
+)
+
+var (
+	runningMu sync.Mutex
+	// inputs running, by name and kind
+	running = map[[2]string]bool{}
+)
+
+func init() {
+	prometheus.MustRegister(enecInputUp)
+	prometheus.MustRegister(enecInputLines)
+	prometheus.MustRegister(enecInputFailures)
+	prometheus.MustRegister(enecInputLastLine)
+}
+
+// inputDeliverer returns the lineHandler of input in: it counts the line
+// and hands it to the capture and the decoding core.
+func inputDeliverer(in input) lineHandler {
+	lines := enecInputLines.WithLabelValues(in.name(), in.kind())
+	last := enecInputLastLine.WithLabelValues(in.name(), in.kind())
+	return func(message, gateway, siteName string, t time.Time) {
+		if shuttingDown() {
+			return
+		}
+		lines.Inc()
+		last.Set(float64(t.Unix()))
+		captureLine(t, gateway, siteName, message)
+		handleLine(message, gateway, siteName, t)
+	}
+}
+
+// startInput runs in in the background, restarting it when it fails.
+func startInput(in input) {
+	up := enecInputUp.WithLabelValues(in.name(), in.kind())
+	deliver := inputDeliverer(in)
+	go func() {
+		for {
+			up.Set(1)
+			setRunning(in, true)
+			err := in.run(deliver)
+			setRunning(in, false)
+			up.Set(0)
+			if err == nil {
+				fmt.Println("Input", in.name(), "finished")
+				return
+			}
+			logger.Errorf("Input %s failed, restarting in %s: %s", in.name(), inputRetry, err)
+			enecInputFailures.WithLabelValues(in.name(), in.kind()).Inc()
+			time.Sleep(inputRetry)
+		}
+	}()
+}
+
+func setRunning(in input, up bool) {
+	runningMu.Lock()
+	if up {
+		running[[2]string{in.name(), in.kind()}] = true
+	} else {
+		delete(running, [2]string{in.name(), in.kind()})
+	}
+	runningMu.Unlock()
+}
+
+// runningInputs returns the names of the running inputs of kind other than
+// the excluded ones, ordered.
+func runningInputs(exclude ...string) []string {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	var names []string
+next:
+	for key := range running {
+		for _, kind := range exclude {
+			if key[1] == kind {
+				continue next
+			}
+		}
+		names = append(names, key[0])
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseInput splits an entry of the inputs config key into kind, target
+// and site.
+func parseInput(spec string) (kind, target, siteName string, err error) {
+	parts := strings.SplitN(spec, "://", 2)
+	if len(parts) != 2 || inputKinds[parts[0]] == nil {
+		return "", "", "", fmt.Errorf("invalid input %q, expected udp://, serial://, mqtt:// or file://", spec)
+	}
+	kind, target = parts[0], parts[1]
+	if i := strings.LastIndex(target, "?site="); i >= 0 {
+		target, siteName = target[:i], target[i+len("?site="):]
+	}
+	if target == "" {
+		return "", "", "", fmt.Errorf("invalid input %q, nothing to read from", spec)
+	}
+	return kind, target, siteName, nil
+}
+
+// configInputs returns the inputs of the inputs config key.
+func configInputs() ([]input, error) {
+	var inputs []input
+	for _, spec := range splitList(currentConfig().Inputs) {
+		kind, target, siteName, err := parseInput(spec)
+		if err != nil {
+			return nil, err
+		}
+		in, err := inputKinds[kind](target, siteName)
+		if err != nil {
+			return nil, fmt.Errorf("input %s: %s", spec, err)
+		}
+		inputs = append(inputs, in)
+	}
+	return inputs, nil
+}
+
+// startInputs starts the inputs of the inputs config key.
+func startInputs() {
+	inputs, err := configInputs()
+	if err != nil {
+		logger.Errorf("Not starting the inputs: %s", err)
+		return
+	}
+	for _, in := range inputs {
+		fmt.Println("reading", in.kind(), "input", in.name())
+		startInput(in)
+	}
+}
+
+// lineSite returns siteName, or else the site listing gateway.
+func lineSite(siteName, gateway string) string {
+	if siteName != "" {
+		return siteName
+	}
+	return siteForGateway(gateway)
+}
+
+type udpInput struct {
+	address, site string
+}
+
+func newUDPInput(target, siteName string) (input, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, err
+	}
+	return udpInput{address: target, site: siteName}, nil
+}
+
+func (in udpInput) name() string { return "udp " + in.address }
+func (in udpInput) kind() string { return "udp" }
+
+func (in udpInput) run(deliver lineHandler) error {
+	conn, err := net.ListenPacket("udp", in.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		gateway := gatewayHost(addr.String())
+		siteName := lineSite(in.site, addr.String())
+		now := time.Now()
+		scanner := bufio.NewScanner(strings.NewReader(string(buf[:n])))
+		scanner.Split(scanGatewayLines)
+		for scanner.Scan() {
+			if message := scanner.Text(); message != "" {
+				deliver(message, gateway, siteName, now)
+			}
+		}
+	}
+}
+
+type serialInput struct {
+	device, site string
+}
+
+func newSerialInput(target, siteName string) (input, error) {
+	return serialInput{device: target, site: siteName}, nil
+}
+
+func (in serialInput) name() string { return "serial " + in.device }
+func (in serialInput) kind() string { return "serial" }
+
+func (in serialInput) run(deliver lineHandler) error {
+	f, err := os.Open(in.device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gatewayConnected(in.device, in.site)
+	defer gatewayDisconnected(in.device, in.site)
+	scanner := bufio.NewScanner(f)
+	scanner.Split(scanGatewayLines)
+	for line := range stampLines(scanner) {
+		if line.message != "" {
+			gatewayHeartbeat(in.device, in.site, line.t)
+			deliver(line.message, in.device, in.site, line.t)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s closed", in.device)
+}
+
+type mqttInput struct {
+	topic, site string
+}
+
+func newMqttInput(target, siteName string) (input, error) {
+	if !currentConfig().mqttEnabled() {
+		return nil, fmt.Errorf("MQTT isn't configured")
+	}
+	return mqttInput{topic: target, site: siteName}, nil
+}
+
+func (in mqttInput) name() string { return "mqtt " + in.topic }
+func (in mqttInput) kind() string { return "mqtt" }
+
+// run subscribes to the topic. The subscription follows the MQTT client,
+// so it never returns.
+func (in mqttInput) run(deliver lineHandler) error {
+	var mu sync.Mutex
+	// the topic tells the client IDs of several MQTT inputs apart
+	h := fnv.New32a()
+	h.Write([]byte(in.topic))
+	role := fmt.Sprintf("input-%08x", h.Sum32())
+	subscribeMqtt(role, in.topic, func(client mqtt.Client, msg mqtt.Message) {
+		// Messages of one relay are processed in order.
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		scanner := bufio.NewScanner(strings.NewReader(string(msg.Payload())))
+		scanner.Split(scanGatewayLines)
+		for scanner.Scan() {
+			if message := scanner.Text(); message != "" {
+				deliver(message, msg.Topic(), in.site, now)
+			}
+		}
+	})
+	select {}
+}
+
+type fileInput struct {
+	file, site string
+}
+
+func newFileInput(target, siteName string) (input, error) {
+	return fileInput{file: target, site: siteName}, nil
+}
+
+func (in fileInput) name() string { return "file " + in.file }
+func (in fileInput) kind() string { return "file" }
+
+// run feeds the lines of the capture file through as fast as possible,
+// stamped with the time they are read.
+func (in fileInput) run(deliver lineHandler) error {
+	return readCapture(in.file, func(c captureRecord) error {
+		siteName := c.Site
+		if in.site != "" {
+			siteName = in.site
+		}
+		deliver(c.Line, c.Gateway, siteName, time.Now())
+		return nil
+	})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Bulk inverter edits. PATCH /admin/inverters updates the name, model,
+// rated power, array and labels of many inverters at once, e.g. for a new
+// site of 40 inverters, without editing the site file and restarting. It
+// takes a list of updates, each applied to the inverters in its ids, and
+// requires the adminToken as bearer token:
+//
+//	curl -X PATCH -H "Authorization: Bearer $TOKEN" http://localhost:5042/admin/inverters -d '[
+//	  {"ids": ["0f2a91cc", "0f2a91d0", "0f2a91d4"], "array": "east", "ratedWatts": 240},
+//	  {"ids": ["0f2a91cc"], "name": "Garage East 1"}
+//	]'
+//
+// Fields left out keep their value; an empty value removes the edit, so the
+// site file applies again. The edits take precedence over the site file,
+// survive its reloads and are kept in the stateFile, which is saved right
+// away. The update is applied entirely or, if any ID or value is invalid,
+// not at all. GET /admin/inverters returns the registry with the edits
+// applied, both return the inverters updated or all.
+
+// inverterEdit overrides fields of an inverter in the site file.
+type inverterEdit struct {
+	Name       *string           `json:"name,omitempty"`
+	Model      *string           `json:"model,omitempty"`
+	RatedWatts *float64          `json:"ratedWatts,omitempty"`
+	Array      *string           `json:"array,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+type inverterUpdate struct {
+	IDs []string `json:"ids"`
+	inverterEdit
+}
+
+var (
+	// inverters of the site file without the edits, and the edits by
+	// inverter, both guarded by siteMu
+	siteFileInverters = map[string]inverterInfo{}
+	inverterEdits     = map[string]inverterEdit{}
+)
+
+func init() {
+	adminMux.HandleFunc("/admin/inverters", requireAdminToken(serveInverters))
+}
+
+// apply returns info with the fields of e.
+func (e inverterEdit) apply(info inverterInfo) inverterInfo {
+	if e.Name != nil {
+		info.Name = *e.Name
+	}
+	if e.Model != nil {
+		info.Model = *e.Model
+	}
+	if e.RatedWatts != nil {
+		info.RatedWatts = *e.RatedWatts
+	}
+	if e.Array != nil {
+		info.Array = *e.Array
+	}
+	if e.Labels != nil {
+		info.Labels = e.Labels
+	}
+	return info
+}
+
+// merge returns e updated by u, without the fields u empties.
+func (e inverterEdit) merge(u inverterEdit) inverterEdit {
+	if u.Name != nil {
+		e.Name = u.Name
+		if *u.Name == "" {
+			e.Name = nil
+		}
+	}
+	if u.Model != nil {
+		e.Model = u.Model
+		if *u.Model == "" {
+			e.Model = nil
+		}
+	}
+	if u.RatedWatts != nil {
+		e.RatedWatts = u.RatedWatts
+		if *u.RatedWatts == 0 {
+			e.RatedWatts = nil
+		}
+	}
+	if u.Array != nil {
+		e.Array = u.Array
+		if *u.Array == "" {
+			e.Array = nil
+		}
+	}
+	if u.Labels != nil {
+		e.Labels = u.Labels
+		if len(u.Labels) == 0 {
+			e.Labels = nil
+		}
+	}
+	return e
+}
+
+func (e inverterEdit) empty() bool {
+	return reflect.DeepEqual(e, inverterEdit{})
+}
+
+// editedInverters returns the inverters of the site file with the edits
+// applied. siteMu must be held.
+func editedInverters() map[string]inverterInfo {
+	inverters := make(map[string]inverterInfo, len(siteFileInverters)+len(inverterEdits))
+	for id, info := range siteFileInverters {
+		inverters[id] = info
+	}
+	for id, e := range inverterEdits {
+		inverters[id] = e.apply(inverters[id])
+	}
+	return inverters
+}
+
+// editInverters applies updates, all or none of them, and returns the IDs
+// updated.
+func editInverters(updates []inverterUpdate) ([]string, error) {
+	updated := map[string]bool{}
+	err := updateInverterEdits(func(edits map[string]inverterEdit) error {
+		for i, u := range updates {
+			if len(u.IDs) == 0 {
+				return fmt.Errorf("update %d: no ids", i+1)
+			}
+			if u.RatedWatts != nil && *u.RatedWatts < 0 {
+				return fmt.Errorf("update %d: ratedWatts must be positive, got %g", i+1, *u.RatedWatts)
+			}
+			if err := checkLabelNames(u.Labels); err != nil {
+				return fmt.Errorf("update %d: %s", i+1, err)
+			}
+			for _, raw := range u.IDs {
+				id, err := normalizeID(raw)
+				if err != nil {
+					return fmt.Errorf("update %d: %s", i+1, err)
+				}
+				edits[id] = edits[id].merge(u.inverterEdit)
+				if edits[id].empty() {
+					delete(edits, id)
+				}
+				updated[id] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(updated))
+	for id := range updated {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// allInverterEdits returns a copy of the edits.
+func allInverterEdits() map[string]inverterEdit {
+	siteMu.RLock()
+	defer siteMu.RUnlock()
+	if len(inverterEdits) == 0 {
+		return nil
+	}
+	edits := make(map[string]inverterEdit, len(inverterEdits))
+	for id, e := range inverterEdits {
+		edits[id] = e
+	}
+	return edits
+}
+
+// setInverterEdits replaces all edits, e.g. from a snapshot, and publishes
+// the metadata of the inverters changed.
+func setInverterEdits(edits map[string]inverterEdit) {
+	err := updateInverterEdits(func(current map[string]inverterEdit) error {
+		for id := range current {
+			delete(current, id)
+		}
+		for id, e := range edits {
+			current[id] = e
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("Ignoring the inverter edits: %s", err)
+	}
+}
+
+// updateInverterEdits has fn change a copy of the edits and stores it,
+// unless fn fails or the edited inverters can't share topics by name, see
+// checkTopicNames. The whole update holds siteMu, so concurrent updates
+// don't lose each other's changes. The metadata of the inverters changed
+// is published.
+func updateInverterEdits(fn func(edits map[string]inverterEdit) error) error {
+	before := map[string]inverterInfo{}
+	for _, id := range knownInverters() {
+		before[id] = inverter(id)
+	}
+
+	siteMu.Lock()
+	previous := inverterEdits
+	edits := make(map[string]inverterEdit, len(previous))
+	for id, e := range previous {
+		edits[id] = e
+	}
+	err := fn(edits)
+	if err == nil {
+		inverterEdits = edits
+		inverters := editedInverters()
+		if err = checkTopicNames(currentConfig().MqttTopicTemplate, inverters); err == nil {
+			site.Inverters = inverters
+		} else {
+			inverterEdits = previous
+		}
+	}
+	siteMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for id, old := range before {
+		if !reflect.DeepEqual(inverter(id), old) {
+			publishMeta(id)
+		}
+	}
+	return nil
+}
+
+func serveInverters(w http.ResponseWriter, r *http.Request) {
+	entries := registry()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var updates []inverterUpdate
+		if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ids, err := editInverters(updates)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		message := fmt.Sprintf("Inverters %s edited", strings.Join(ids, ", "))
+		fmt.Println(message)
+		emitEvent(event{Kind: "admin_inverters", Severity: severityInfo, Message: message})
+		if path := currentConfig().StateFile; path != "" {
+			if err := saveSnapshot(path); err != nil {
+				logger.Errorf("Couldn't save state: %s", err)
+			}
+		}
+
+		all := registry()
+		entries = make(map[string]registryEntry, len(ids))
+		for _, id := range ids {
+			entries[id] = all[id]
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Inverter labels. Every exported series with an id label also gets the
+// labels of the inverter listed in inverterLabels (default name) from the
+// site file, so dashboards can show "Garage East 3" instead of 0f2a91cc
+// and break down by array or roof without joining an info metric:
+//
+//	name         the name of the inverter
+//	array        the array (string) it belongs to
+//	azimuth      the azimuth of its panels, 0 is south, -90 east
+//	tilt         the tilt of its panels, 0 is flat
+//	rated_watts  its rated power
+//	logical_id   the ID it continues after replacements, see replacement.go
+//
+// Azimuth and tilt are those of the inverter in the site file, or else the
+// azimuth and declination of its array, e.g.
+//
+//	inverterLabels: name,array,azimuth,tilt
+//
+// They are added when scraped, so a reloaded site file takes effect with the
+// next scrape. Inverters without the value don't get the label. An empty
+// inverterLabels adds none.
+
+// inverterLabelValues return the value of an inverter label of inverter id
+// with info.
+var inverterLabelValues = map[string]func(id string, info inverterInfo) string{
+	"name":  func(id string, info inverterInfo) string { return info.Name },
+	"array": func(id string, info inverterInfo) string { return info.Array },
+	"azimuth": func(id string, info inverterInfo) string {
+		if info.Azimuth != nil {
+			return formatLabelNumber(*info.Azimuth)
+		}
+		if a, ok := siteArrays()[info.Array]; ok && info.Array != "" {
+			return formatLabelNumber(a.Azimuth)
+		}
+		return ""
+	},
+	"tilt": func(id string, info inverterInfo) string {
+		if info.Tilt != nil {
+			return formatLabelNumber(*info.Tilt)
+		}
+		if a, ok := siteArrays()[info.Array]; ok && info.Array != "" {
+			return formatLabelNumber(a.Declination)
+		}
+		return ""
+	},
+	"rated_watts": func(id string, info inverterInfo) string {
+		if info.RatedWatts > 0 {
+			return formatLabelNumber(info.RatedWatts)
+		}
+		return ""
+	},
+	"logical_id": func(id string, info inverterInfo) string { return logicalID(id) },
+}
+
+func formatLabelNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseInverterLabels checks a comma separated list of inverter labels.
+func parseInverterLabels(value string) ([]string, error) {
+	labels := splitList(value)
+	for _, label := range labels {
+		if inverterLabelValues[label] == nil {
+			return nil, fmt.Errorf("unknown label %q", label)
+		}
+	}
+	return labels, nil
+}
+
+// inverterLabelGatherer adds the inverterLabels to the series of g with an
+// id label.
+func inverterLabelGatherer(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		labels, _ := parseInverterLabels(currentConfig().InverterLabels)
+		if len(labels) == 0 {
+			return families, err
+		}
+
+		added := map[string][]*dto.LabelPair{}
+		for _, mf := range families {
+			for _, m := range mf.Metric {
+				id := labelValue(m, "id")
+				if id == "" {
+					continue
+				}
+				pairs, ok := added[id]
+				if !ok {
+					pairs = inverterLabelPairs(id, labels)
+					added[id] = pairs
+				}
+				for _, pair := range pairs {
+					if labelValue(m, pair.GetName()) == "" {
+						m.Label = append(m.Label, pair)
+					}
+				}
+				sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+			}
+		}
+		return families, err
+	})
+}
+
+// inverterLabelPairs returns the non-empty labels of inverter id.
+func inverterLabelPairs(id string, labels []string) []*dto.LabelPair {
+	info := inverter(id)
+	var pairs []*dto.LabelPair
+	for _, label := range labels {
+		name, value := label, inverterLabelValues[label](id, info)
+		if value != "" {
+			pairs = append(pairs, &dto.LabelPair{Name: &name, Value: &value})
+		}
+	}
+	return pairs
+}
+
+// labelValue returns the value of label name of m, empty if it has none.
+func labelValue(m *dto.Metric, name string) string {
+	for _, pair := range m.Label {
+		if pair.GetName() == name {
+			return pair.GetValue()
+		}
+	}
+	return ""
+}
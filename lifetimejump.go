@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Implausible jumps of the lifetime counter. A corrupted frame or an
+// inverter swapped under the same ID can make the lifetime counter leap by
+// more than the inverter could have produced since its previous reading,
+// which would end up in the daily report, the energy counters and the
+// lifetime energy source for good. An increase is a jump if it exceeds what
+// 1.5 times the rated power (1000 W without a rating) yields over the
+// elapsed time, plus lifetimeJumpSlack for the Wh and kWh fields not
+// advancing together. The jump is excluded from all of them, counted and
+// raised as a lifetime_jump event; later readings count from the new value.
+
+// one kWh step of the counter arriving before the Wh field wrapped
+const lifetimeJumpSlack = 1000
+
+var enecLifetimeJumps = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "enecsys_lifetime_jumps_total",
+	Help: "Implausible increases of the inverter's lifetime counter, excluded from the energy accounting.",
+},
+	[]string{"id", "site"},
+)
+
+func init() {
+	prometheus.MustRegister(enecLifetimeJumps)
+}
+
+// detectLifetimeJump marks r if its lifetime counter rose implausibly since
+// prev, with the size of the jump.
+func detectLifetimeJump(prev reading, r *reading) {
+	if !r.valid("lifeWh") {
+		return
+	}
+	maxPower := float64(defaultMaxDCPower)
+	if rated := inverter(r.ID).RatedWatts; rated > 0 {
+		maxPower = 1.5 * rated
+	}
+	hours := r.Time.Sub(prev.Time).Hours()
+	if hours < 0 {
+		hours = 0
+	}
+	if wh := lifetimeDelta(prev, *r); wh > maxPower*hours+lifetimeJumpSlack {
+		r.LifetimeJump = wh
+	}
+}
+
+// recordLifetimeJump exports the jump marked on r.
+func recordLifetimeJump(prev, r reading) {
+	if r.LifetimeJump <= 0 {
+		return
+	}
+	enecLifetimeJumps.WithLabelValues(r.ID, r.Site).Inc()
+	emitEvent(event{Kind: "lifetime_jump", Severity: severityWarning, Inverter: r.ID, Time: r.Time,
+		Message: fmt.Sprintf("Lifetime counter of inverter %s jumped from %.0f to %.0f Wh in %s, not counting %.0f Wh",
+			r.ID, prev.LifeWh, r.LifeWh, r.Time.Sub(prev.Time).Round(time.Second), r.LifetimeJump)})
+}
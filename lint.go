@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The lint subcommand runs raw captures or plain gateway dumps through the
+// parser without exporting anything and reports a verdict per line plus a
+// summary with the frequency of every line code, for validating new gateway
+// firmware before deploying it. It exits with 1 if any telegram failed to
+// decode or validate.
+
+func runLint(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	quiet := flags.Bool("q", false, "only print the summary")
+	configFile := flags.String("config", "", "config file whose site file provides the rated power for validation")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s lint [flags] capture_file...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	if *configFile != "" {
+		getCredentials(*configFile)
+		if siteFile := currentConfig().SiteFile; siteFile != "" {
+			if err := loadSiteFile(siteFile); err != nil {
+				fmt.Println("Couldn't read site file:", err)
+				return 1
+			}
+		}
+	}
+
+	verdicts := map[string]int{}
+	codes := map[string]int{}
+	failed := false
+	for _, file := range flags.Args() {
+		err := lintFile(file, func(n int, line string) {
+			code := lineCode(line)
+			codes[code]++
+			verdict, detail := lintLine(line)
+			verdicts[verdict]++
+			if verdict == "undecodable" || verdict == "invalid" {
+				failed = true
+			}
+			if !*quiet {
+				fmt.Printf("%s:%d: %s %s %s\n", file, n, code, verdict, detail)
+			}
+		})
+		if err != nil {
+			fmt.Println("Couldn't read capture:", err)
+			return 1
+		}
+	}
+
+	fmt.Println("\nVerdicts:")
+	printCounts(verdicts)
+	fmt.Println("\nLine codes:")
+	printCounts(codes)
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// lintFile calls fn with every line of a capture or a plain dump of gateway
+// lines separated by CR or LF.
+func lintFile(file string, fn func(n int, line string)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var in io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		in = zr
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1024*1024)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		for i, b := range data {
+			if b == '\r' || b == '\n' {
+				return i + 1, data[:i], nil
+			}
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	n := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		// Capture lines carry the raw line in the last field.
+		if i := strings.LastIndexByte(line, '\t'); i >= 0 {
+			line = line[i+1:]
+		}
+		n++
+		fn(n, line)
+	}
+	return scanner.Err()
+}
+
+// lineCode returns the two letter code of a gateway line like WS, or "-".
+func lineCode(line string) string {
+	if len(line) > 20 && line[20] == '=' {
+		return line[18:20]
+	}
+	return "-"
+}
+
+// lintLine returns the verdict for a line and its details.
+func lintLine(line string) (verdict, detail string) {
+	if !isTelegram(line) {
+		if t, ok := parseGatewayTime(line); ok {
+			return "status", "gateway time " + t.Format("2006-01-02 15:04:05")
+		}
+		if lineCode(line) == "WS" {
+			return "undecodable", fmt.Sprintf("telegram of %d characters, expected 77", len(line))
+		}
+		if lineCode(line) != "-" {
+			return "unknown", fmt.Sprintf("%d characters", len(line))
+		}
+		return "keepalive", fmt.Sprintf("%q", line)
+	}
+
+	r, err := decodeWS(line[21:])
+	if err != nil {
+		return "undecodable", err.Error()
+	}
+	r.ID = canonicalID(r.ID)
+	validate(&r)
+
+	var values []string
+	for _, f := range fields {
+		values = append(values, fmt.Sprintf("%s=%g", f.topic, f.value(&r)))
+	}
+	detail = "id=" + r.ID + " " + strings.Join(values, " ")
+	if len(r.Invalid) > 0 {
+		return "invalid", detail + " (" + r.invalidReasons() + ")"
+	}
+	return "ok", detail
+}
+
+func printCounts(counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	for _, k := range keys {
+		fmt.Printf("  %-12s %d\n", k, counts[k])
+	}
+}
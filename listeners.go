@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Gateways connect to the plaintext listener (listenAddress, default
+// 0.0.0.0:5040), to the listener of their site (see site.go) or, for remote
+// relays, to a TLS listener:
+//
+//	tlsListen: ":5443"
+//	tlsCert: /etc/enecsys/cert.pem
+//	tlsKey: /etc/enecsys/key.pem
+//	tlsClientCA: /etc/enecsys/relays.pem   # optional, requires client certificates
+//	tlsSite: remote                        # optional, site of its connections
+//
+// Every listener has its own allowlist of addresses and networks, listenAllow
+// and tlsAllow (comma separated) in the config and allow in the site file for
+// site listeners. Connections from other addresses are closed right away.
+// Other transports are configured as inputs, see input.go.
+//
+// With bindInterface set to a network interface, the plaintext, TLS,
+// metrics, admin and site listeners that don't name a host (or use 0.0.0.0
+// or ::) are bound to the first address of that interface instead, which
+// keeps several instances on one host apart and the admin API off the other
+// interfaces.
+
+// ingest describes the connections accepted by one listener.
+type ingest struct {
+	name  string
+	site  string
+	allow []*net.IPNet
+}
+
+// tcpInput is a TCP or TLS listener for gateway connections.
+type tcpInput struct {
+	listener net.Listener
+	accepts  ingest
+}
+
+func (in tcpInput) name() string { return in.accepts.name }
+
+func (in tcpInput) kind() string {
+	if in.accepts.name == "tls" {
+		return "tls"
+	}
+	return "tcp"
+}
+
+// run accepts connections, it never returns.
+func (in tcpInput) run(deliver lineHandler) error {
+	acceptGateways(in.listener, in.accepts, deliver)
+	return nil
+}
+
+var enecGatewayRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "enecsys_gateway_rejected_total",
+	Help: "Connections closed because the address isn't on the listener's allowlist.",
+},
+	[]string{"listener"},
+)
+
+func init() {
+	prometheus.MustRegister(enecGatewayRejected)
+}
+
+// parseAllowlist parses addresses and CIDR networks. An empty list allows
+// everything.
+func parseAllowlist(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q in allowlist", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q in allowlist", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (in ingest) allowed(addr net.Addr) bool {
+	if len(in.allow) == 0 {
+		return true
+	}
+	ip := net.ParseIP(gatewayHost(addr.String()))
+	for _, n := range in.allow {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// configIngest returns the ingest of a listener configured by the
+// comma separated allowlist value of allowKey.
+func configIngest(name, siteName, allowKey, value string) (ingest, error) {
+	allow, err := parseAllowlist(splitList(value))
+	if err != nil {
+		return ingest{}, fmt.Errorf("%s: %s", allowKey, err)
+	}
+	return ingest{name: name, site: siteName, allow: allow}, nil
+}
+
+// listenTLS starts the TLS listener if tlsListen is configured.
+func listenTLS() {
+	cfg := currentConfig()
+	address := cfg.TLSListen
+	if address == "" {
+		return
+	}
+	in, err := configIngest("tls", cfg.TLSSite, "tlsAllow", cfg.TLSAllow)
+	if err != nil {
+		logger.Errorf("Not starting the TLS listener: %s", err)
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		logger.Errorf("Not starting the TLS listener: %s", err)
+		return
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile := cfg.TLSClientCA; caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			logger.Errorf("Not starting the TLS listener: %s", err)
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			logger.Errorf("Not starting the TLS listener: no certificates in %s", caFile)
+			return
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	listener, err := tls.Listen("tcp", address, tlsConfig)
+	if err != nil {
+		fmt.Println("tls server listener error:", err)
+		return
+	}
+	fmt.Println("listening with TLS on", address)
+	startInput(tcpInput{listener, in})
+}
+
+// bindInterface binds the configured listen addresses without host to the
+// first address of bindInterface in c.
+func bindInterface(c *configuration) error {
+	if c.BindInterface == "" {
+		return nil
+	}
+	host, err := interfaceHost(c.BindInterface)
+	if err != nil {
+		return err
+	}
+	for _, address := range []*string{&c.ListenAddress, &c.TLSListen, &c.MetricsAddress, &c.AdminAddress} {
+		if *address == "" {
+			continue
+		}
+		if *address, err = bindHost(*address, host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindSiteListener binds the listen address of a site like bindInterface
+// binds the ones of the config.
+func bindSiteListener(address string) (string, error) {
+	name := currentConfig().BindInterface
+	if name == "" {
+		return address, nil
+	}
+	host, err := interfaceHost(name)
+	if err != nil {
+		return "", err
+	}
+	return bindHost(address, host)
+}
+
+// interfaceHost returns the first address of the interface name, IPv4 if it
+// has one.
+func interfaceHost(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	var host string
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && (host == "" || ipnet.IP.To4() != nil) {
+			host = ipnet.IP.String()
+			if ipnet.IP.To4() != nil {
+				break
+			}
+		}
+	}
+	if host == "" {
+		return "", fmt.Errorf("interface %s has no address", name)
+	}
+	return host, nil
+}
+
+// bindHost replaces a missing or unspecified host of address by host.
+func bindHost(address, host string) (string, error) {
+	h, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(h); h == "" || ip != nil && ip.IsUnspecified() {
+		return net.JoinHostPort(host, port), nil
+	}
+	return address, nil
+}
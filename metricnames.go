@@ -0,0 +1,143 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Metric names following the Prometheus naming conventions (base unit
+// suffix, no _total on gauges) replace the original ones. metricNames
+// selects what is exported:
+//
+//	legacy  only the original names (default)
+//	both    original and new names
+//	new     only the new names
+//
+// The default keeps existing dashboards working; set both to migrate.
+// With metricNamesUntil (YYYY-MM-DD) set, "both" switches to "new" at the
+// start of that day, giving dashboards and recording rules a fixed period to
+// migrate. While the original names are exported enecsys_metric_deprecated_info
+// maps each of them to its replacement.
+//
+// metricNamespace (default enecsys) replaces the enecsys prefix of all
+// exported names, e.g. to tell several exporters apart in one Prometheus
+// or to follow a site's naming scheme. The Go and process metrics keep
+// their names.
+
+const defaultNamespace = "enecsys"
+
+var metricNamespacePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// namespaced returns the metric name, starting with enecsys_, in the
+// configured namespace.
+func namespaced(name string) string {
+	ns := currentConfig().MetricNamespace
+	if ns == "" || ns == defaultNamespace || !strings.HasPrefix(name, defaultNamespace+"_") {
+		return name
+	}
+	return ns + strings.TrimPrefix(name, defaultNamespace)
+}
+
+var metricRenames = map[string]string{
+	"enecsys_temperature":           "enecsys_temperature_celsius",
+	"enecsys_watthours_today":       "enecsys_energy_today_watt_hours",
+	"enecsys_kilowatthours_history": "enecsys_energy_history_kilowatt_hours",
+	"enecsys_kilowatthours_total":   "enecsys_energy_lifetime_kilowatt_hours",
+	"enecsys_dc_power":              "enecsys_dc_power_watts",
+	"enecsys_dc_volt":               "enecsys_dc_voltage_volts",
+	"enecsys_dc_current":            "enecsys_dc_current_amperes",
+	"enecsys_efficiency":            "enecsys_efficiency_percent",
+	"enecsys_ac_power":              "enecsys_ac_power_watts",
+	"enecsys_ac_volt":               "enecsys_ac_voltage_volts",
+	"enecsys_ac_current":            "enecsys_ac_current_amperes",
+	"enecsys_ac_frequency":          "enecsys_ac_frequency_hertz",
+}
+
+// metricNameMode reports whether the original and the new names are
+// exported at t.
+func metricNameMode(t time.Time) (legacy, renamed bool) {
+	cfg := currentConfig()
+	mode := cfg.MetricNames
+	if mode == "both" {
+		if until := cfg.MetricNamesUntil; until != "" {
+			end, err := time.ParseInLocation("2006-01-02", until, time.Local)
+			if err != nil {
+				logger.Errorf("Invalid metricNamesUntil %q: %s", until, err)
+			} else if !t.Before(end) {
+				mode = "new"
+			}
+		}
+	}
+	switch mode {
+	case "legacy":
+		return true, false
+	case "new":
+		return false, true
+	case "both":
+	default:
+		logger.Errorf("Unknown metricNames %q, exporting both", mode)
+	}
+	return true, true
+}
+
+// renamingGatherer exports the renamed metrics of g under the names selected
+// by metricNames, in the metricNamespace.
+func renamingGatherer(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		legacy, renamed := metricNameMode(time.Now())
+
+		out := make([]*dto.MetricFamily, 0, len(families))
+		add := func(mf *dto.MetricFamily, name string) {
+			if name = namespaced(name); name != mf.GetName() {
+				mf = &dto.MetricFamily{Name: &name, Help: mf.Help, Type: mf.Type, Metric: mf.Metric}
+			}
+			out = append(out, mf)
+		}
+		for _, mf := range families {
+			name, ok := metricRenames[mf.GetName()]
+			if !ok {
+				add(mf, mf.GetName())
+				continue
+			}
+			if legacy {
+				add(mf, mf.GetName())
+			}
+			if renamed {
+				add(mf, name)
+			}
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+		return out, err
+	})
+}
+
+// deprecationCollector exports enecsys_metric_deprecated_info while the
+// original names are exported.
+type deprecationCollector struct{}
+
+var deprecatedDesc = prometheus.NewDesc("enecsys_metric_deprecated_info",
+	"Deprecated metric names and their replacements.", []string{"metric", "replacement", "until"}, nil)
+
+func (deprecationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- deprecatedDesc
+}
+
+func (deprecationCollector) Collect(ch chan<- prometheus.Metric) {
+	if legacy, _ := metricNameMode(time.Now()); !legacy {
+		return
+	}
+	until := currentConfig().MetricNamesUntil
+	for old, replacement := range metricRenames {
+		ch <- prometheus.MustNewConstMetric(deprecatedDesc, prometheus.GaugeValue, 1, namespaced(old), namespaced(replacement), until)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(deprecationCollector{})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics of the readings. The values of the fields aren't kept in
+// GaugeVecs changed as the telegrams come in, but in a store of the latest
+// valid value of each field of each inverter and the time it was received,
+// which readingCollector exports at every scrape. The values of a reading
+// are stored under one lock, so a scrape never sees half of it. A field
+// that's invalid in a reading keeps the value of an earlier one, with the
+// time that was received, as the gauges did. The decoding core doesn't
+// need the prometheus registry: storeMetrics and metricValues work on
+// plain data.
+//
+// With metricTimestamps: true the values are exported with the time they
+// were received instead of the time of the scrape. Prometheus then stops
+// returning the series of an inverter that stopped reporting after its
+// lookback delta (5 minutes by default), instead of repeating the last
+// values until it's offline; mind that it rejects samples older than about
+// an hour.
+
+type metricKey struct {
+	id, site string
+}
+
+// metricSample is the value of a field and the time it was received.
+type metricSample struct {
+	value float64
+	time  time.Time
+}
+
+var (
+	metricStoreMu sync.RWMutex
+	// values of the fields by inverter and site, and topic
+	metricStore = map[metricKey]map[string]metricSample{}
+
+	fieldDescs = map[string]*prometheus.Desc{}
+)
+
+func init() {
+	for _, f := range fields {
+		fieldDescs[f.topic] = prometheus.NewDesc(f.metric, f.help, []string{"id", "site"}, nil)
+	}
+	prometheus.MustRegister(readingCollector{})
+}
+
+// storeMetrics stores the valid values of r.
+func storeMetrics(r reading) {
+	metricStoreMu.Lock()
+	defer metricStoreMu.Unlock()
+	key := metricKey{r.ID, r.Site}
+	values := metricStore[key]
+	if values == nil {
+		values = map[string]metricSample{}
+		metricStore[key] = values
+	}
+	for _, f := range fields {
+		if r.valid(f.topic) {
+			values[f.topic] = metricSample{f.value(&r), r.Time}
+		}
+	}
+}
+
+// deleteMetrics removes the values of id in siteName.
+func deleteMetrics(id, siteName string) {
+	metricStoreMu.Lock()
+	delete(metricStore, metricKey{id, siteName})
+	metricStoreMu.Unlock()
+}
+
+// metricValues returns a copy of the stored values.
+func metricValues() map[metricKey]map[string]metricSample {
+	metricStoreMu.RLock()
+	defer metricStoreMu.RUnlock()
+	out := make(map[metricKey]map[string]metricSample, len(metricStore))
+	for key, values := range metricStore {
+		copied := make(map[string]metricSample, len(values))
+		for topic, sample := range values {
+			copied[topic] = sample
+		}
+		out[key] = copied
+	}
+	return out
+}
+
+// readingCollector exports the stored values of the fields.
+type readingCollector struct{}
+
+func (readingCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range fieldDescs {
+		ch <- desc
+	}
+}
+
+func (readingCollector) Collect(ch chan<- prometheus.Metric) {
+	timestamps := currentConfig().MetricTimestamps
+	for key, values := range metricValues() {
+		for topic, sample := range values {
+			m := prometheus.MustNewConstMetric(fieldDescs[topic], prometheus.GaugeValue, sample.value, key.id, key.site)
+			if timestamps {
+				m = prometheus.NewMetricWithTimestamp(sample.time, m)
+			}
+			ch <- m
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestStoreMetrics(t *testing.T) {
+	at := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	first := simulatedReading(0, at, 200)
+	first.Time, first.Site = at, "test"
+	defer deleteMetrics(first.ID, first.Site)
+	storeMetrics(first)
+
+	next := first
+	next.Time = first.Time.Add(time.Minute)
+	next.Temperature, next.ACPower = 200, first.ACPower+10
+	next.Invalid = nil
+	next.invalidate("temperature", "200 outside -40..120")
+	storeMetrics(next)
+
+	values := metricValues()[metricKey{first.ID, first.Site}]
+	if got := values["acpower"]; got.value != next.ACPower || !got.time.Equal(next.Time) {
+		t.Errorf("AC power %g at %s, want %g at %s", got.value, got.time, next.ACPower, next.Time)
+	}
+	if got := values["temperature"]; got.value != first.Temperature || !got.time.Equal(first.Time) {
+		t.Errorf("temperature %g at %s, want %g of the earlier reading at %s", got.value, got.time, first.Temperature, first.Time)
+	}
+}
+
+func TestReadingCollector(t *testing.T) {
+	c := defaultConfig()
+	c.MetricTimestamps = true
+	setConfig(c)
+	defer setConfig(defaultConfig())
+
+	at := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	r := simulatedReading(1, at, 200)
+	r.Time, r.Site = at, "test"
+	defer deleteMetrics(r.ID, r.Site)
+	storeMetrics(r)
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(readingCollector{})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, family := range families {
+		if family.GetName() != "enecsys_ac_power" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["id"] != r.ID || labels["site"] != r.Site {
+				continue
+			}
+			found = true
+			if got := m.GetGauge().GetValue(); got != r.ACPower {
+				t.Errorf("AC power %g, want %g", got, r.ACPower)
+			}
+			if got := m.GetTimestampMs(); got != r.Time.UnixNano()/int64(time.Millisecond) {
+				t.Errorf("timestamp %d, want the time of the reading", got)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no enecsys_ac_power of %s", r.ID)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeBroker is a publishing client that records what it publishes while
+// it's up.
+type fakeBroker struct {
+	mqtt.Client
+
+	mu        sync.Mutex
+	up        bool
+	published map[string][]string
+}
+
+func newFakeBroker(up bool) *fakeBroker {
+	return &fakeBroker{up: up, published: map[string][]string{}}
+}
+
+func (c *fakeBroker) setUp(up bool) {
+	c.mu.Lock()
+	c.up = up
+	c.mu.Unlock()
+}
+
+func (c *fakeBroker) IsConnected() bool      { return c.IsConnectionOpen() }
+func (c *fakeBroker) IsConnectionOpen() bool { c.mu.Lock(); defer c.mu.Unlock(); return c.up }
+func (c *fakeBroker) Disconnect(uint)        {}
+
+func (c *fakeBroker) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	c.published[topic] = append(c.published[topic], payload.(string))
+	c.mu.Unlock()
+	return doneToken{}
+}
+
+// count returns the number of messages published to topic.
+func (c *fakeBroker) count(topic string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.published[topic])
+}
+
+// total returns the number of messages published.
+func (c *fakeBroker) total() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, values := range c.published {
+		n += len(values)
+	}
+	return n
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// startFakeBrokers publishes to the clients instead of real brokers.
+func startFakeBrokers(t *testing.T, clients map[string]*fakeBroker) {
+	c := defaultConfig()
+	c.UserName, c.Password, c.MqttAddress, c.ClientName = "user", "secret", "tcp://localhost:1883", "test"
+	c.MqttPublishTimeout = 200 * time.Millisecond
+	setConfig(c)
+	t.Cleanup(func() { setConfig(defaultConfig()) })
+
+	// keep queueMqtt from starting the real brokers
+	mqttQueueOnce.Do(func() {})
+	var brokers []*mqttBroker
+	for name, client := range clients {
+		client := client
+		brokers = append(brokers, &mqttBroker{name: name, connect: func() mqtt.Client { return client }})
+	}
+	startBrokers(brokers)
+	t.Cleanup(func() { stopMqtt(time.Now().Add(time.Second)) })
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// burst publishes what n inverters waking up at once publish: metadata,
+// availability and the values of a reading.
+func burst(n int) (messages int) {
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("%08x", 0x100000+i)
+		publishRetained("enecsys/"+id+"/meta", `{"id":"`+id+`"}`)
+		publishRetained("enecsys/"+id+"/availability", availabilityOnline)
+		for _, f := range fields {
+			publishValue("enecsys/"+id+"/"+f.topic, "1")
+		}
+		messages += 2 + len(fields)
+	}
+	return messages
+}
+
+func TestMorningBurst(t *testing.T) {
+	local := newFakeBroker(true)
+	startFakeBrokers(t, map[string]*fakeBroker{primaryBroker: local})
+
+	acknowledged := enecMqttPublished.WithLabelValues(primaryBroker)
+	before := testutil.ToFloat64(acknowledged)
+	sent := burst(60)
+	waitFor(t, "the burst to be published", func() bool { return testutil.ToFloat64(acknowledged)-before == float64(sent) })
+	if n := local.total(); n != sent {
+		t.Fatalf("%d messages published, want %d", n, sent)
+	}
+
+	// Metadata the broker acknowledged isn't queued again.
+	burst(60)
+	waitFor(t, "the values to be published", func() bool { return local.total() == sent+60*len(fields) })
+	if n := local.count("enecsys/00100000/meta"); n != 1 {
+		t.Errorf("metadata published %d times, want once", n)
+	}
+}
+
+func TestRetainedAfterDrop(t *testing.T) {
+	local, cloud := newFakeBroker(true), newFakeBroker(false)
+	startFakeBrokers(t, map[string]*fakeBroker{primaryBroker: local, "cloud": cloud})
+
+	const topic = "enecsys/0f2a91cc/meta"
+	publishRetained(topic, "v1")
+	waitFor(t, "the metadata to reach the local broker", func() bool { return local.count(topic) == 1 })
+	// The cloud broker drops it while it's down.
+	time.Sleep(300 * time.Millisecond)
+
+	cloud.setUp(true)
+	publishRetained(topic, "v1")
+	waitFor(t, "the metadata to reach the cloud broker", func() bool { return cloud.count(topic) == 1 })
+	if n := local.count(topic); n != 1 {
+		t.Errorf("metadata published %d times to the local broker, want once", n)
+	}
+}
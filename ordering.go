@@ -0,0 +1,114 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Per-inverter ordering. Decoded readings are recorded by recordWorkers
+// (default 4) workers, each with a queue of up to recordQueueSize (default
+// 1000) readings. The readings of one inverter always go to the same
+// worker, so the state store, the metrics, MQTT, remote_write and the
+// history get them in the order they were received, even with several
+// gateways hearing the same inverter or a replay running next to the live
+// inputs. Readings of different inverters are recorded in parallel.
+//
+// Inputs wait while the queue of a worker is full instead of dropping
+// readings. A reading received before the latest one of its inverter, e.g.
+// a replayed one after an outage, is only written to the history; it would
+// overwrite newer values everywhere else. enecsys_readings_out_of_order_total
+// counts them.
+
+var (
+	recordOnce   sync.Once
+	recordQueues []chan reading
+	recording    sync.WaitGroup
+	// recordMu guards recordClosed, closing the queues
+	recordMu     sync.RWMutex
+	recordClosed bool
+
+	enecRecordQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_record_queue_depth",
+		Help: "Readings waiting to be recorded, by worker.",
+	},
+		[]string{"worker"},
+	)
+	enecOutOfOrder = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_readings_out_of_order_total",
+		Help: "Readings received before the latest one of their inverter, only written to the history.",
+	},
+		[]string{"site"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(enecRecordQueued)
+	prometheus.MustRegister(enecOutOfOrder)
+}
+
+// startRecordWorkers starts the workers recording the queued readings.
+func startRecordWorkers() {
+	cfg := currentConfig()
+	recordQueues = make([]chan reading, cfg.RecordWorkers)
+	for i := range recordQueues {
+		queue := make(chan reading, cfg.RecordQueueSize)
+		recordQueues[i] = queue
+		depth := enecRecordQueued.WithLabelValues(strconv.Itoa(i))
+		recording.Add(1)
+		go func() {
+			defer recording.Done()
+			for r := range queue {
+				depth.Set(float64(len(queue)))
+				record(r)
+				if !r.Read.IsZero() {
+					enecFrameDuration.WithLabelValues("telegram").Observe(time.Since(r.Read).Seconds())
+				}
+			}
+		}()
+	}
+}
+
+// queueReading hands r to the worker of its inverter, waiting while its
+// queue is full. Readings queued after the queues were drained are dropped.
+func queueReading(r reading) {
+	recordOnce.Do(startRecordWorkers)
+	h := fnv.New32a()
+	h.Write([]byte(r.ID))
+	i := h.Sum32() % uint32(len(recordQueues))
+	recordMu.RLock()
+	defer recordMu.RUnlock()
+	if recordClosed {
+		return
+	}
+	recordQueues[i] <- r
+	enecRecordQueued.WithLabelValues(strconv.Itoa(int(i))).Set(float64(len(recordQueues[i])))
+}
+
+// drainRecordQueues waits until the queued readings are recorded, e.g.
+// before a replay exits. Readings can't be queued anymore after.
+func drainRecordQueues() {
+	recordOnce.Do(startRecordWorkers)
+	recordMu.Lock()
+	if !recordClosed {
+		recordClosed = true
+		for _, queue := range recordQueues {
+			close(queue)
+		}
+	}
+	recordMu.Unlock()
+	recording.Wait()
+}
+
+// recordOutOfOrder writes r, received before prev, the latest reading of
+// its inverter, to the history only.
+func recordOutOfOrder(prev, r reading) {
+	enecOutOfOrder.WithLabelValues(r.Site).Inc()
+	logger.Warningf("Reading of %s received at %s is older than the latest one of %s, only storing it in the history",
+		r.ID, r.Time.Format(historyTimeFormat), prev.Time.Format(historyTimeFormat))
+	lateDayEnergy(&r)
+	storeHistory(r)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PAN filtering. Every telegram carries the 16 bit PAN ID of the Zigbee
+// network it was relayed through, the two bytes following the inverter ID.
+// Where the mesh of a neighbour's Enecsys system overlaps with one's own,
+// its telegrams reach the gateway as well. With panIds set (comma separated,
+// 4 hex digits each) telegrams of other networks are dropped before they
+// turn into metrics, and counted by PAN:
+//
+//	panIds: "1a2b"
+//
+// Each foreign PAN is logged once, which also helps finding one's own.
+
+var (
+	enecForeignFrames = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_frames_foreign_total",
+		Help: "Telegrams dropped because they came through a Zigbee network not in panIds.",
+	},
+		[]string{"site", "pan"},
+	)
+
+	foreignMu   sync.Mutex
+	foreignPANs = map[string]bool{}
+)
+
+func init() {
+	prometheus.MustRegister(enecForeignFrames)
+}
+
+// parsePANs parses the comma separated PAN IDs of panIds.
+func parsePANs(value string) (map[string]bool, error) {
+	pans := map[string]bool{}
+	for _, pan := range splitList(value) {
+		pan = strings.ToLower(pan)
+		if b, err := hex.DecodeString(pan); err != nil || len(b) != 2 {
+			return nil, fmt.Errorf("invalid PAN ID %q, expected 4 hex digits", pan)
+		}
+		pans[pan] = true
+	}
+	return pans, nil
+}
+
+// foreignPAN reports whether r came through a network not in panIds, and
+// counts it if so.
+func foreignPAN(r reading) bool {
+	cfg := currentConfig()
+	if cfg.PanIDs == "" {
+		return false
+	}
+	pans, err := parsePANs(cfg.PanIDs)
+	if err != nil || pans[r.PAN] {
+		return false
+	}
+	enecForeignFrames.WithLabelValues(r.Site, r.PAN).Inc()
+
+	foreignMu.Lock()
+	first := !foreignPANs[r.PAN]
+	foreignPANs[r.PAN] = true
+	foreignMu.Unlock()
+	if first {
+		logger.Infof("Dropping telegrams of Zigbee network %s, first from inverter %s", r.PAN, r.ID)
+	}
+	return true
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Exporters running as peers (e.g. an active and a standby instance) keep
+// their inverter registry in sync, so both present identical metadata after
+// a failover. Each serves its registry (site file data and first seen time
+// of every inverter) at GET /api/v1/registry on the admin port, protected by
+// the adminToken, and polls the registries of its peers:
+//
+//	peers: "http://pi-a:5042,http://pi-b:5042"
+//	peerToken: ...             # adminToken of the peers, default own adminToken
+//	peerSyncInterval: 1m
+//
+// Metadata from the local site file always wins; peers only fill in fields
+// left empty locally. For inverters the site file doesn't define, each sync
+// replaces what an earlier one brought, so changes on a peer propagate. The
+// earliest first seen time wins.
+
+type registryEntry struct {
+	inverterInfo
+	FirstSeen *time.Time `json:"firstSeen,omitempty"`
+}
+
+var (
+	// metadata of the peers, as of the last sync
+	peerInverters = map[string]inverterInfo{}
+
+	enecPeerUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_peer_up",
+		Help: "1 if the last registry sync with the peer succeeded.",
+	},
+		[]string{"peer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(enecPeerUp)
+	adminMux.HandleFunc("/api/v1/registry", requireAdminToken(serveRegistry))
+}
+
+// mergeInfo fills the empty fields of info from other.
+func mergeInfo(info, other inverterInfo) inverterInfo {
+	if info.Name == "" {
+		info.Name = other.Name
+	}
+	if info.Model == "" {
+		info.Model = other.Model
+	}
+	if info.RatedWatts == 0 {
+		info.RatedWatts = other.RatedWatts
+	}
+	if info.Serial == "" {
+		info.Serial = other.Serial
+	}
+	if info.Array == "" {
+		info.Array = other.Array
+	}
+	if info.Azimuth == nil {
+		info.Azimuth = other.Azimuth
+	}
+	if info.Tilt == nil {
+		info.Tilt = other.Tilt
+	}
+	if info.Site == "" {
+		info.Site = other.Site
+	}
+	if len(info.Labels) == 0 {
+		info.Labels = other.Labels
+	}
+	return info
+}
+
+// registry returns the registry served to peers.
+func registry() map[string]registryEntry {
+	entries := map[string]registryEntry{}
+
+	siteMu.RLock()
+	for id, info := range site.Inverters {
+		entries[id] = registryEntry{inverterInfo: mergeInfo(info, peerInverters[id])}
+	}
+	for id, info := range peerInverters {
+		if _, ok := entries[id]; !ok {
+			entries[id] = registryEntry{inverterInfo: info}
+		}
+	}
+	siteMu.RUnlock()
+
+	for _, s := range allStates() {
+		if s.FirstSeen.IsZero() {
+			continue
+		}
+		t := s.FirstSeen
+		entry := entries[s.ID]
+		entry.FirstSeen = &t
+		entries[s.ID] = entry
+	}
+	return entries
+}
+
+func serveRegistry(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(registry())
+}
+
+// startPeerSync polls the configured peers in the background.
+func startPeerSync() {
+	cfg := currentConfig()
+	value := cfg.Peers
+	if value == "" {
+		return
+	}
+	var peers []string
+	for _, peer := range strings.Split(value, ",") {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	token := cfg.peerToken()
+	interval := cfg.PeerSyncInterval
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	go func() {
+		for {
+			var failed error
+			for _, peer := range peers {
+				if err := syncPeer(client, peer, token); err != nil {
+					logger.Errorf("Registry sync with %s failed: %s", peer, err)
+					enecPeerUp.WithLabelValues(peer).Set(0)
+					failed = fmt.Errorf("%s: %s", peer, err)
+				} else {
+					enecPeerUp.WithLabelValues(peer).Set(1)
+				}
+			}
+			reportHealth("peers", failed)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func syncPeer(client *http.Client, peer, token string) error {
+	req, err := http.NewRequest(http.MethodGet, peer+"/api/v1/registry", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	var entries map[string]registryEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return err
+	}
+
+	var changed []string
+	siteMu.Lock()
+	for id, entry := range entries {
+		// the site file wins, and a peer that knows no more than the
+		// first seen time doesn't clear what the others told us
+		if _, ok := site.Inverters[id]; ok || reflect.DeepEqual(entry.inverterInfo, inverterInfo{}) {
+			continue
+		}
+		if !reflect.DeepEqual(entry.inverterInfo, peerInverters[id]) {
+			peerInverters[id] = entry.inverterInfo
+			changed = append(changed, id)
+		}
+	}
+	siteMu.Unlock()
+
+	for id, entry := range entries {
+		if entry.FirstSeen == nil {
+			continue
+		}
+		if s, _ := stateOf(id); s.FirstSeen.IsZero() || entry.FirstSeen.Before(s.FirstSeen) {
+			t := *entry.FirstSeen
+			updateState(id, func(s *inverterState) { s.FirstSeen = t })
+		}
+	}
+
+	for _, id := range changed {
+		if _, ok := latestReading(id); ok {
+			publishMeta(id)
+		}
+	}
+	return nil
+}
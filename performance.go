@@ -0,0 +1,32 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Performance ratio: the AC power of an inverter relative to the ratedWatts
+// of the site file, exported for inverters with a rating as
+// enecsys_performance_ratio. Panels of one array see the same sun, so one
+// far below its neighbours is underperforming, e.g.
+//
+//	enecsys_performance_ratio < on(site, array) group_left 0.7 * avg by (site, array) (enecsys_performance_ratio)
+//
+// with array in inverterLabels.
+
+var enecPerformanceRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "enecsys_performance_ratio",
+	Help: "AC power of the inverter relative to its rated power.",
+},
+	[]string{"id", "site"},
+)
+
+func init() {
+	prometheus.MustRegister(enecPerformanceRatio)
+}
+
+// recordPerformance exports the performance ratio of r.
+func recordPerformance(r reading) {
+	rated := inverter(r.ID).RatedWatts
+	if rated <= 0 || !r.valid("acpower") {
+		return
+	}
+	enecPerformanceRatio.WithLabelValues(r.ID, r.Site).Set(r.ACPower / rated)
+}
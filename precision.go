@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Numbers in MQTT and JSON outputs are rounded to a per-value number of
+// decimals, by default whole watts and watt hours, two decimals for
+// currents. The precision config key overrides it per topic name:
+//
+//	precision: "acpower=1,accurrent=3,wh=0"
+//
+// Prometheus metrics always carry the full resolution.
+
+var (
+	precisionOnce sync.Once
+	precisions    map[string]int
+)
+
+func loadPrecisions() {
+	precisions = map[string]int{}
+	for _, f := range fields {
+		precisions[f.topic] = f.precision
+	}
+	value := currentConfig().Precision
+	if value == "" {
+		return
+	}
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			logger.Errorf("Invalid precision %q, expected topic=decimals", pair)
+			continue
+		}
+		if _, known := precisions[kv[0]]; !known {
+			logger.Errorf("Unknown topic %q in precision", kv[0])
+			continue
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n < 0 {
+			logger.Errorf("Invalid precision %q for %s", kv[1], kv[0])
+			continue
+		}
+		precisions[kv[0]] = n
+	}
+}
+
+func precisionOf(topic string) int {
+	precisionOnce.Do(loadPrecisions)
+	return precisions[topic]
+}
+
+// formatValue formats v with the precision configured for topic.
+func formatValue(topic string, v float64) string {
+	return strconv.FormatFloat(v, 'f', precisionOf(topic), 64)
+}
+
+// roundValue rounds v to the precision configured for topic, for JSON
+// outputs.
+func roundValue(topic string, v float64) float64 {
+	scale := math.Pow(10, float64(precisionOf(topic)))
+	return math.Round(v*scale) / scale
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Privacy mode, for sharing dashboards publicly. With
+//
+//	privacy: true
+//	privacySalt: some long random string
+//
+// the responses of the public port - /metrics, the aggregate and the API -
+// show a stable pseudonym like inv-3fa2c1d0 instead of every inverter ID
+// and serial number, in labels, JSON and event messages alike. Query
+// parameters take the pseudonyms, e.g. /api/v1/heatmap?id=inv-3fa2c1d0.
+// The captures and traces, whose raw telegrams contain the IDs, are only
+// served on the admin port.
+//
+// The pseudonyms are derived from the ID with privacySalt, they change
+// when it does; keep it secret, the IDs are short enough to be guessed from
+// unsalted pseudonyms. The admin port, MQTT, remote_write and the files
+// keep the real IDs.
+
+// pseudonym returns the pseudonym of inverter id.
+func pseudonym(id string) string {
+	hexID, err := telegramID(id)
+	if err != nil {
+		hexID = id
+	}
+	mac := hmac.New(sha256.New, []byte(currentConfig().PrivacySalt))
+	mac.Write([]byte(hexID))
+	return "inv-" + hex.EncodeToString(mac.Sum(nil))[:8]
+}
+
+// pseudonyms returns the pseudonyms of the IDs and serials of all known
+// inverters, and their IDs by pseudonym.
+func pseudonyms() (names, ids map[string]string) {
+	known := map[string]bool{}
+	for _, s := range allStates() {
+		known[s.ID] = true
+	}
+	siteMu.RLock()
+	for id := range site.Inverters {
+		known[id] = true
+	}
+	siteMu.RUnlock()
+
+	names, ids = map[string]string{}, map[string]string{}
+	for id := range known {
+		p := pseudonym(id)
+		names[id], ids[p] = p, id
+		if hexID, err := telegramID(id); err == nil {
+			names[hexID] = p
+		}
+		if serial := inverter(id).Serial; serial != "" {
+			names[serial] = p
+		}
+	}
+	return names, ids
+}
+
+// replaceIdentifiers returns body with the identifiers of names replaced
+// where they aren't part of a longer word or number.
+func replaceIdentifiers(body []byte, names map[string]string) []byte {
+	if len(names) == 0 {
+		return body
+	}
+	keys := make([]string, 0, len(names))
+	for k := range names {
+		keys = append(keys, regexp.QuoteMeta(k))
+	}
+	// Longest first, a serial may contain an ID.
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+	pattern := regexp.MustCompile(strings.Join(keys, "|"))
+
+	var out bytes.Buffer
+	last := 0
+	for _, m := range pattern.FindAllIndex(body, -1) {
+		if m[0] > 0 && isWordByte(body[m[0]-1]) || m[1] < len(body) && isWordByte(body[m[1]]) {
+			continue
+		}
+		out.Write(body[last:m[0]])
+		out.WriteString(names[string(body[m[0]:m[1]])])
+		last = m[1]
+	}
+	out.Write(body[last:])
+	return out.Bytes()
+}
+
+func isWordByte(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// privateResponse buffers a response to rewrite it.
+type privateResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (p *privateResponse) Header() http.Header         { return p.header }
+func (p *privateResponse) Write(b []byte) (int, error) { return p.body.Write(b) }
+func (p *privateResponse) WriteHeader(status int)      { p.status = status }
+
+// privateHandler serves handler with pseudonyms instead of inverter IDs
+// while privacy is set.
+func privateHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !currentConfig().Privacy {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		names, ids := pseudonyms()
+		query := r.URL.Query()
+		for key, values := range query {
+			for i, v := range values {
+				if id, ok := ids[v]; ok {
+					values[i] = id
+				}
+			}
+			query[key] = values
+		}
+		r.URL.RawQuery = query.Encode()
+		// The rewritten body is sent uncompressed.
+		r.Header.Del("Accept-Encoding")
+
+		resp := &privateResponse{header: w.Header(), status: http.StatusOK}
+		handler.ServeHTTP(resp, r)
+		body := replaceIdentifiers(resp.body.Bytes(), names)
+		w.Header().Del("Content-Length")
+		w.WriteHeader(resp.status)
+		w.Write(body)
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Push mode, for exporters behind NAT that Prometheus can't scrape. With
+// remoteWriteUrl set the values of every reading are queued with the time
+// they were received and sent to the remote_write endpoint of Prometheus,
+// Mimir or VictoriaMetrics every remoteWriteInterval (default 15s), in
+// requests of up to remoteWriteBatchSize (default 1000) samples:
+//
+//	remoteWriteUrl: https://mimir.example.com/api/v1/push
+//	remoteWriteUser: solar
+//	remoteWritePassword: secret
+//	remoteWriteLabels: job=enecsys,instance=home
+//
+// The series are named like the scraped ones (metricNames, metricNamespace)
+// and labelled with id, site and remoteWriteLabels. Requests the endpoint
+// fails or throttles are retried with a backoff doubling up to 5 minutes;
+// samples it rejects (other 4xx responses) are dropped. While the endpoint
+// is unreachable up to remoteWriteQueueSize (default 100000) samples are
+// kept, the oldest dropped beyond that.
+
+const remoteWriteMaxBackoff = 5 * time.Minute
+
+type pushSample struct {
+	metric, id, site string
+	value            float64
+	time             time.Time
+}
+
+var (
+	pushMu      sync.Mutex
+	pushPending []pushSample
+	// samples removed from the front of pushPending so far
+	pushRemoved int
+
+	enecRemoteWriteSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_remote_write_samples_total",
+		Help: "Samples pushed to the remote_write endpoint, by outcome (sent, rejected, dropped).",
+	},
+		[]string{"outcome"},
+	)
+	enecRemoteWritePending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "enecsys_remote_write_pending_samples",
+		Help: "Samples waiting to be pushed to the remote_write endpoint.",
+	})
+	enecRemoteWriteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "enecsys_remote_write_failures_total",
+		Help: "Requests to the remote_write endpoint that failed and are retried.",
+	})
+	enecRemoteWriteLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "enecsys_remote_write_last_success_timestamp_seconds",
+		Help: "Time of the last request the remote_write endpoint accepted.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(enecRemoteWriteSamples)
+	prometheus.MustRegister(enecRemoteWritePending)
+	prometheus.MustRegister(enecRemoteWriteFailures)
+	prometheus.MustRegister(enecRemoteWriteLastSuccess)
+	for _, outcome := range []string{"sent", "rejected", "dropped"} {
+		enecRemoteWriteSamples.WithLabelValues(outcome)
+	}
+}
+
+// pushReading queues the valid values of r for the remote_write endpoint.
+func pushReading(r reading) {
+	cfg := currentConfig()
+	if cfg.RemoteWriteURL == "" {
+		return
+	}
+	legacy, renamed := metricNameMode(r.Time)
+	var samples []pushSample
+	for _, f := range fields {
+		if !r.valid(f.topic) {
+			continue
+		}
+		value := f.value(&r)
+		if legacy {
+			samples = append(samples, pushSample{namespaced(f.metric), r.ID, r.Site, value, r.Time})
+		}
+		if name, ok := metricRenames[f.metric]; ok && renamed {
+			samples = append(samples, pushSample{namespaced(name), r.ID, r.Site, value, r.Time})
+		}
+	}
+
+	pushMu.Lock()
+	defer pushMu.Unlock()
+	pushPending = append(pushPending, samples...)
+	if excess := len(pushPending) - cfg.RemoteWriteQueueSize; excess > 0 {
+		pushPending = append([]pushSample{}, pushPending[excess:]...)
+		pushRemoved += excess
+		enecRemoteWriteSamples.WithLabelValues("dropped").Add(float64(excess))
+	}
+	enecRemoteWritePending.Set(float64(len(pushPending)))
+}
+
+// startPush sends the queued samples in the background if remoteWriteUrl
+// is set.
+func startPush() {
+	cfg := currentConfig()
+	if cfg.RemoteWriteURL == "" {
+		return
+	}
+	fmt.Println("pushing samples to", cfg.RemoteWriteURL)
+	go func() {
+		interval := cfg.RemoteWriteInterval
+		backoff := interval
+		for {
+			time.Sleep(backoff)
+			err := pushOnce()
+			reportHealth("remoteWrite", err)
+			if err != nil {
+				enecRemoteWriteFailures.Inc()
+				if backoff *= 2; backoff > remoteWriteMaxBackoff {
+					backoff = remoteWriteMaxBackoff
+				}
+				logger.Errorf("Couldn't push samples, retrying in %s: %s", backoff, err)
+				continue
+			}
+			backoff = interval
+		}
+	}()
+}
+
+// pushOnce sends the queued samples in batches. It returns the error of a
+// batch to be retried, which stays queued.
+func pushOnce() error {
+	cfg := currentConfig()
+	for {
+		pushMu.Lock()
+		n := len(pushPending)
+		if n > cfg.RemoteWriteBatchSize {
+			n = cfg.RemoteWriteBatchSize
+		}
+		batch := append([]pushSample{}, pushPending[:n]...)
+		end := pushRemoved + n
+		pushMu.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		err := remoteWrite(cfg.RemoteWriteURL, cfg.RemoteWriteUser, cfg.RemoteWritePassword, pushSeries(batch))
+		if rwErr, ok := err.(*remoteWriteError); ok && !rwErr.retryable() {
+			logger.Errorf("Dropping %d samples rejected by the remote_write endpoint: %s", n, err)
+			enecRemoteWriteSamples.WithLabelValues("rejected").Add(float64(n))
+		} else if err != nil {
+			return err
+		} else {
+			enecRemoteWriteSamples.WithLabelValues("sent").Add(float64(n))
+			enecRemoteWriteLastSuccess.SetToCurrentTime()
+		}
+
+		pushMu.Lock()
+		// Samples dropped for a full queue meanwhile were the oldest, of
+		// the batch.
+		if n = end - pushRemoved; n > 0 {
+			pushPending = append([]pushSample{}, pushPending[n:]...)
+			pushRemoved += n
+		}
+		enecRemoteWritePending.Set(float64(len(pushPending)))
+		pushMu.Unlock()
+	}
+}
+
+// pushSeries groups samples into series with the remoteWriteLabels.
+func pushSeries(samples []pushSample) []rwSeries {
+	extra, _ := parseRemoteWriteLabels(currentConfig().RemoteWriteLabels)
+	index := map[[3]string]int{}
+	var series []rwSeries
+	for _, s := range samples {
+		key := [3]string{s.metric, s.id, s.site}
+		i, ok := index[key]
+		if !ok {
+			labels := append([]rwLabel{{"__name__", s.metric}, {"id", s.id}}, extra...)
+			if s.site != "" {
+				labels = append(labels, rwLabel{"site", s.site})
+			}
+			i = len(series)
+			index[key] = i
+			series = append(series, rwSeries{labels: labels})
+		}
+		series[i].samples = append(series[i].samples, rwSample{value: s.value, timestamp: s.time.UnixNano() / int64(time.Millisecond)})
+	}
+	return series
+}
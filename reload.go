@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/juju/loggo"
+)
+
+// SIGHUP reloads the config file without dropping the gateway listeners:
+// the log level, MQTT credentials and TLS settings and most thresholds apply
+// right away, and the site file is read again for changed friendly names.
+// An invalid config is logged and the running one kept. The keys in restartKeys are read when
+// the service starts, changing them needs a restart; their running values
+// are kept.
+
+var restartKeys = map[string]bool{
+	"listenAddress": true, "bindInterface": true, "listenAllow": true,
+	"tlsListen": true, "tlsCert": true, "tlsKey": true, "tlsClientCA": true, "tlsSite": true, "tlsAllow": true,
+	"metricsAddress": true, "metricsPath": true, "metricsOnAdmin": true, "metricsTlsCert": true, "metricsTlsKey": true, "aggregatePath": true, "adminAddress": true, "adminAllow": true,
+	"tracing": true, "traceBufferSize": true,
+	"mqttQueueSize": true, "mqttPublishTimeout": true, "mqttRestartAfter": true, "mqttBrokers": true,
+	"siteFile": true, "siteFileInterval": true, "stateFile": true, "snapshotInterval": true,
+	"historyDir": true, "dayOffset": true, "captureDir": true, "corpusDir": true, "sleepAfter": true,
+	"gatewayTimeout": true, "staleTimeout": true, "seriesExpiry": true, "decodeErrorThreshold": true, "decodeErrorPeriod": true,
+	"recordWorkers": true, "recordQueueSize": true,
+	"forecastProvider": true, "forecastApiKey": true, "forecastInterval": true,
+	"gridTopic": true, "gridJsonField": true, "gridInvert": true, "gridTimeout": true,
+	"s3Bucket": true, "s3Endpoint": true, "s3Region": true, "s3AccessKey": true, "s3SecretKey": true,
+	"archiveInterval": true, "peers": true, "peerSyncInterval": true,
+	"remoteWriteUrl": true, "remoteWriteInterval": true, "remoteWriteQueueSize": true,
+}
+
+// watchReload reloads the config file at path on every SIGHUP. It never
+// returns.
+func watchReload(path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadConfig(path)
+	}
+}
+
+func reloadConfig(path string) {
+	parsed, problems, err := readConfig(path)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Couldn't reload config file, keeping the running config: %s", err)
+		return
+	}
+	if problems = append(problems, parsed.validate()...); len(problems) > 0 {
+		for _, problem := range problems {
+			logger.Errorf("%s: %s", path, problem)
+		}
+		logger.Errorf("Invalid config file, keeping the running config")
+		return
+	}
+	siteMu.RLock()
+	err = checkTopicNames(parsed.MqttTopicTemplate, site.Inverters)
+	siteMu.RUnlock()
+	if err != nil {
+		logger.Errorf("%s: mqttTopicTemplate: %s, keeping the running config", path, err)
+		return
+	}
+
+	var pending []string
+	running := currentConfig()
+	current := reflect.ValueOf(running).Elem()
+	next := reflect.ValueOf(&parsed).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		key := current.Type().Field(i).Tag.Get("yaml")
+		if !restartKeys[key] {
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+			pending = append(pending, key)
+		}
+		next.Field(i).Set(current.Field(i))
+	}
+
+	mqttChanged := parsed.UserName != running.UserName || parsed.Password != running.Password ||
+		parsed.MqttAddress != running.MqttAddress || parsed.ClientName != running.ClientName ||
+		parsed.MqttCAFile != running.MqttCAFile || parsed.MqttCert != running.MqttCert || parsed.MqttKey != running.MqttKey ||
+		parsed.MqttServerName != running.MqttServerName || parsed.MqttInsecureSkipVerify != running.MqttInsecureSkipVerify ||
+		parsed.MqttHeaders != running.MqttHeaders
+	setConfig(parsed)
+	loggo.ConfigureLoggers("<root>=" + parsed.LogLevel)
+	fmt.Println("Reloaded config file", path)
+	for _, key := range pending {
+		logger.Warningf("%s changed, it applies after a restart", key)
+	}
+
+	if mqttChanged {
+		restartMqtt()
+	}
+	if parsed.SiteFile != "" {
+		reloadSiteFile(parsed.SiteFile)
+	}
+}
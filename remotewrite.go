@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Minimal Prometheus remote_write client. The WriteRequest protobuf is small
+// enough to encode by hand, and the body is snappy framed in the block
+// format using literals only, which every snappy decoder accepts.
+
+type rwLabel struct {
+	name, value string
+}
+
+type rwSample struct {
+	value     float64
+	timestamp int64 // milliseconds
+}
+
+type rwSeries struct {
+	labels  []rwLabel
+	samples []rwSample
+}
+
+var remoteWriteClient = &http.Client{Timeout: 30 * time.Second}
+
+// encodeWriteRequest encodes series as prometheus.WriteRequest.
+func encodeWriteRequest(series []rwSeries) []byte {
+	var req bytes.Buffer
+	for _, s := range series {
+		var ts bytes.Buffer
+		sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+		for _, l := range s.labels {
+			var label bytes.Buffer
+			pbString(&label, 1, l.name)
+			pbString(&label, 2, l.value)
+			pbBytes(&ts, 1, label.Bytes())
+		}
+		for _, sample := range s.samples {
+			var smp bytes.Buffer
+			pbDouble(&smp, 1, sample.value)
+			pbVarint(&smp, 2, uint64(sample.timestamp))
+			pbBytes(&ts, 2, smp.Bytes())
+		}
+		pbBytes(&req, 1, ts.Bytes())
+	}
+	return req.Bytes()
+}
+
+func pbKey(buf *bytes.Buffer, field int, wireType int) {
+	pbUvarint(buf, uint64(field<<3|wireType))
+}
+
+func pbUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func pbVarint(buf *bytes.Buffer, field int, v uint64) {
+	pbKey(buf, field, 0)
+	pbUvarint(buf, v)
+}
+
+func pbDouble(buf *bytes.Buffer, field int, v float64) {
+	pbKey(buf, field, 1)
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+	buf.Write(tmp[:])
+}
+
+func pbBytes(buf *bytes.Buffer, field int, v []byte) {
+	pbKey(buf, field, 2)
+	pbUvarint(buf, uint64(len(v)))
+	buf.Write(v)
+}
+
+func pbString(buf *bytes.Buffer, field int, v string) {
+	pbBytes(buf, field, []byte(v))
+}
+
+// snappyEncode wraps data in a snappy block made of 64 KiB literals.
+func snappyEncode(data []byte) []byte {
+	var buf bytes.Buffer
+	pbUvarint(&buf, uint64(len(data)))
+	for len(data) > 0 {
+		n := len(data)
+		if n > 65536 {
+			n = 65536
+		}
+		// Tag 61: literal with a two byte little endian length-1.
+		buf.WriteByte(61 << 2)
+		buf.WriteByte(byte(n - 1))
+		buf.WriteByte(byte((n - 1) >> 8))
+		buf.Write(data[:n])
+		data = data[n:]
+	}
+	return buf.Bytes()
+}
+
+// remoteWriteError is the response of a remote_write endpoint refusing
+// samples.
+type remoteWriteError struct {
+	status  int
+	message string
+}
+
+func (e *remoteWriteError) Error() string {
+	return "remote write: " + e.message
+}
+
+// retryable reports whether sending the samples again can succeed: the
+// endpoint failed or asked to slow down rather than rejecting them.
+func (e *remoteWriteError) retryable() bool {
+	return e.status/100 == 5 || e.status == http.StatusTooManyRequests
+}
+
+// parseRemoteWriteLabels parses comma separated name=value pairs. The
+// names must be valid and unique, and not the ones every series has.
+func parseRemoteWriteLabels(value string) ([]rwLabel, error) {
+	var labels []rwLabel
+	seen := map[string]bool{}
+	for _, pair := range splitList(value) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", pair)
+		}
+		switch name := kv[0]; {
+		case !model.LabelName(name).IsValid():
+			return nil, fmt.Errorf("invalid label name %q", name)
+		case strings.HasPrefix(name, "__") || name == "id" || name == "site":
+			return nil, fmt.Errorf("label name %q is reserved", name)
+		case seen[name]:
+			return nil, fmt.Errorf("label %q given twice", name)
+		}
+		seen[kv[0]] = true
+		labels = append(labels, rwLabel{kv[0], kv[1]})
+	}
+	return labels, nil
+}
+
+// remoteWrite sends series to a remote_write endpoint. user and password
+// enable basic auth when user isn't empty.
+func remoteWrite(url, user, password string, series []rwSeries) error {
+	body := snappyEncode(encodeWriteRequest(series))
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := remoteWriteClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &remoteWriteError{status: resp.StatusCode, message: fmt.Sprintf("%s: %s", resp.Status, bytes.TrimSpace(msg))}
+	}
+	return nil
+}
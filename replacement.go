@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Inverter replacements. When a broken inverter is swapped for a new one,
+// POST /admin/replacements marks the new inverter as the replacement of
+// the old one; it requires the adminToken as bearer token:
+//
+//	curl -H "Authorization: Bearer $TOKEN" -d '{"old":"0f2a91cc","new":"0f2b0d17"}' http://localhost:5042/admin/replacements
+//
+// Both keep their physical ID in the metrics, MQTT topics and the history
+// store. The replacement continues under the logical ID of the old one, the
+// ID of the first inverter in the chain of replacements:
+//
+//   - enecsys_logical_lifetime_watt_hours continues the lifetime counter of
+//     the old inverter with that of the new one, labelled with the logical
+//     ID; the old inverter isn't exported there anymore
+//   - the logical_id inverter label (see inverterlabels.go) adds the logical
+//     ID to every series
+//   - the heat map of the logical ID covers the history of both
+//
+// GET lists the replacements, DELETE ?new=<id> undoes one. The replacements
+// are kept in the stateFile, which is saved right away.
+
+type replacement struct {
+	Old  string    `json:"old"`
+	New  string    `json:"new"`
+	Time time.Time `json:"time"`
+	// lifetime energy of the logical inverter before the new one
+	BaseWh float64 `json:"baseWh"`
+}
+
+var (
+	replacementsMu sync.RWMutex
+	// replacements by the ID of the new inverter
+	replacements = map[string]replacement{}
+
+	logicalLifetimeDesc = prometheus.NewDesc("enecsys_logical_lifetime_watt_hours",
+		"Lifetime energy of the logical inverter, continued across replacements.", []string{"id", "logical_id", "site"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(logicalLifetimeCollector{})
+	adminMux.HandleFunc("/admin/replacements", requireAdminToken(serveReplacements))
+}
+
+// logicalID returns the ID of the first inverter in the chain of
+// replacements ending with id, id itself if it didn't replace one.
+func logicalID(id string) string {
+	replacementsMu.RLock()
+	defer replacementsMu.RUnlock()
+	return logicalIDLocked(id)
+}
+
+// logicalIDLocked is logicalID. replacementsMu must be held.
+func logicalIDLocked(id string) string {
+	// The chain is checked for cycles when a replacement is added, the
+	// limit only guards against a hand-edited stateFile.
+	for i := 0; i <= len(replacements); i++ {
+		r, ok := replacements[id]
+		if !ok {
+			break
+		}
+		id = r.Old
+	}
+	return id
+}
+
+// replacedBy returns the ID of the inverter that replaced id, if any.
+func replacedBy(id string) (string, bool) {
+	replacementsMu.RLock()
+	defer replacementsMu.RUnlock()
+	return replacedByLocked(id)
+}
+
+// replacedByLocked is replacedBy. replacementsMu must be held.
+func replacedByLocked(id string) (string, bool) {
+	for _, r := range replacements {
+		if r.Old == id {
+			return r.New, true
+		}
+	}
+	return "", false
+}
+
+// addReplacement marks inverter newID as the replacement of oldID, whose
+// latest reading ends its part of the lifetime energy.
+func addReplacement(oldID, newID string, now time.Time) (replacement, error) {
+	if oldID == "" || newID == "" || oldID == newID {
+		return replacement{}, fmt.Errorf("expected two different inverter IDs, got %q and %q", oldID, newID)
+	}
+	old, ok := latestReading(oldID)
+	if !ok {
+		return replacement{}, fmt.Errorf("inverter %s has no reading", oldID)
+	}
+
+	// checked and added under one lock, so concurrent requests can't both
+	// replace the same inverter or build a cycle
+	replacementsMu.Lock()
+	defer replacementsMu.Unlock()
+	if other, ok := replacedByLocked(oldID); ok {
+		return replacement{}, fmt.Errorf("inverter %s is already replaced by %s", oldID, other)
+	}
+	if logicalIDLocked(oldID) == newID {
+		return replacement{}, fmt.Errorf("inverter %s was replaced by %s", newID, oldID)
+	}
+	if r, ok := replacements[newID]; ok {
+		return replacement{}, fmt.Errorf("inverter %s already replaces %s", newID, r.Old)
+	}
+	r := replacement{Old: oldID, New: newID, Time: now, BaseWh: replacements[oldID].BaseWh + old.LifeWh}
+	replacements[newID] = r
+	return r, nil
+}
+
+// removeReplacement undoes the replacement by inverter newID.
+func removeReplacement(newID string) (replacement, bool) {
+	replacementsMu.Lock()
+	defer replacementsMu.Unlock()
+	r, ok := replacements[newID]
+	delete(replacements, newID)
+	return r, ok
+}
+
+// allReplacements returns the replacements ordered by time.
+func allReplacements() []replacement {
+	replacementsMu.RLock()
+	out := make([]replacement, 0, len(replacements))
+	for _, r := range replacements {
+		out = append(out, r)
+	}
+	replacementsMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out
+}
+
+// setReplacements replaces all replacements, e.g. from a snapshot.
+func setReplacements(list []replacement) {
+	replacementsMu.Lock()
+	replacements = map[string]replacement{}
+	for _, r := range list {
+		replacements[r.New] = r
+	}
+	replacementsMu.Unlock()
+}
+
+func serveReplacements(w http.ResponseWriter, r *http.Request) {
+	var message string
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Old string `json:"old"`
+			New string `json:"new"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		added, err := addReplacement(canonicalID(req.Old), canonicalID(req.New), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		message = fmt.Sprintf("Inverter %s replaced by %s at %.0f Wh", added.Old, added.New, added.BaseWh)
+	case http.MethodDelete:
+		id := canonicalID(r.URL.Query().Get("new"))
+		removed, ok := removeReplacement(id)
+		if !ok {
+			http.Error(w, "inverter "+id+" replaces none", http.StatusNotFound)
+			return
+		}
+		message = fmt.Sprintf("Replacement of inverter %s by %s undone", removed.Old, removed.New)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if message != "" {
+		fmt.Println(message)
+		emitEvent(event{Kind: "admin_replacement", Severity: severityInfo, Message: message})
+		if path := currentConfig().StateFile; path != "" {
+			if err := saveSnapshot(path); err != nil {
+				logger.Errorf("Couldn't save state: %s", err)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(allReplacements())
+}
+
+// logicalLifetimeCollector exports enecsys_logical_lifetime_watt_hours of
+// every inverter not replaced.
+type logicalLifetimeCollector struct{}
+
+func (logicalLifetimeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- logicalLifetimeDesc
+}
+
+func (logicalLifetimeCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range allStates() {
+		if !s.HasReading {
+			continue
+		}
+		if _, ok := replacedBy(s.ID); ok {
+			continue
+		}
+		replacementsMu.RLock()
+		base := replacements[s.ID].BaseWh
+		replacementsMu.RUnlock()
+		ch <- prometheus.MustNewConstMetric(logicalLifetimeDesc, prometheus.GaugeValue,
+			base+s.Reading.LifeWh, s.ID, logicalID(s.ID), s.Reading.Site)
+	}
+}
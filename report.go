@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Daily accounting of produced energy. Every reading credits the energy
+// produced since the previous reading of the same inverter to the current
+// day and tariff window. When the day rolls over a report is published
+// retained to enecsys/report/daily and, if reportDir is configured, written
+// to <reportDir>/<day>.json. Readings of a day already reported, e.g. one
+// queued behind other inverters' readings across midnight, are left out;
+// the report isn't published again.
+//
+// Days start at midnight, or dayOffset later for accounting on a meter day,
+// e.g. from 06:00 to 06:00 with dayOffset: 6h, or earlier with a negative
+// offset. The offset applies to the wall clock, so days keep their start
+// across DST changes. It moves everything done per day: reports, the
+// "today" metrics, history, capture and event log files and the lifetime
+// and power energy sources. The Wh field of the telegrams still resets at
+// the inverter's midnight; use energySource: lifetime for an offset
+// enecsys_watthours_today.
+
+const (
+	reportTopic = "enecsys/report/daily"
+	// the report of the running day so far, on request, see commands.go
+	currentReportTopic = "enecsys/report/current"
+)
+
+type tariffTotal struct {
+	Wh    float64 `json:"wh"`
+	Value float64 `json:"value"`
+}
+
+type dailyReport struct {
+	Day     string  `json:"day"`
+	TotalWh float64 `json:"totalWh"`
+	// energy estimated for reporting gaps, on top of totalWh
+	EstimatedWh float64                 `json:"estimatedWh,omitempty"`
+	Inverters   map[string]float64      `json:"inverters"`
+	Tariffs     map[string]*tariffTotal `json:"tariffs,omitempty"`
+	Gaps        map[string]*gapTotal    `json:"gaps,omitempty"`
+	Hours       map[string][]float64    `json:"hours,omitempty"`
+	// time at the AC limit, see clipping.go
+	Clipping map[string]float64 `json:"clippingSeconds,omitempty"`
+}
+
+var (
+	dayMu sync.Mutex
+	// the running day, set by startDay once the config (dayOffset) and the
+	// state are loaded
+	today *dailyReport
+)
+
+// startDay starts the running day, unless the restored state continues
+// one.
+func startDay() {
+	dayMu.Lock()
+	if today == nil {
+		today = newDailyReport(siteDay(time.Now()))
+	}
+	dayMu.Unlock()
+}
+
+func newDailyReport(day string) *dailyReport {
+	return &dailyReport{
+		Day:       day,
+		Inverters: map[string]float64{},
+		Tariffs:   map[string]*tariffTotal{},
+		Gaps:      map[string]*gapTotal{},
+		Hours:     map[string][]float64{},
+		Clipping:  map[string]float64{},
+	}
+}
+
+// siteDay returns the accounting day t belongs to.
+func siteDay(t time.Time) string {
+	offset := currentConfig().DayOffset
+	y, m, d := t.Date()
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	switch {
+	case offset > 0 && clock < offset:
+		d--
+	case offset < 0 && clock >= 24*time.Hour+offset:
+		d++
+	}
+	return time.Date(y, m, d, 12, 0, 0, 0, t.Location()).Format("2006-01-02")
+}
+
+// The kWh field of the lifetime counter is 16 bits wide and wraps around
+// to 0 after 65535 kWh. A drop from the top kwhRolloverMargin kWh to the
+// bottom ones is taken as the wrap.
+const (
+	kwhRollover       = 1 << 16
+	kwhRolloverMargin = 100
+)
+
+// lifetimeDelta returns the energy produced between prev and r according
+// to the lifetime counter, continued across its rollover. Other decreases
+// (resets) come out negative.
+func lifetimeDelta(prev, r reading) float64 {
+	wh := r.LifeWh - prev.LifeWh
+	if wh < 0 && prev.Kwh >= kwhRollover-kwhRolloverMargin && r.Kwh < kwhRolloverMargin {
+		fmt.Println("Lifetime counter of", r.ID, "rolled over from", prev.Kwh, "kWh to", r.Kwh, "kWh")
+		wh += kwhRollover * 1000
+	}
+	return wh
+}
+
+// accountEnergy credits the energy produced between the previous and the
+// current reading of an inverter. Decreasing lifetime counters (resets) and
+// jumps are ignored, rollovers continued.
+func accountEnergy(prev, r reading) {
+	wh := lifetimeDelta(prev, r)
+	if wh <= 0 || r.LifetimeJump > 0 {
+		return
+	}
+
+	finished := rollover(r.Time)
+	if finished != nil {
+		defer publishReport(finished)
+	}
+
+	day := siteDay(r.Time)
+	dayMu.Lock()
+	if day != today.Day {
+		dayMu.Unlock()
+		return
+	}
+	today.Inverters[r.ID] += wh
+	today.TotalWh += wh
+	countEnergy(r, wh)
+	creditHour(today, r.ID, r.Time, wh)
+	enecWhCurrentHour.WithLabelValues(r.ID, r.Site).Set(today.Hours[r.ID][r.Time.Hour()])
+	if w := tariffAt(r.Time); w != nil {
+		total := today.Tariffs[w.Name]
+		if total == nil {
+			total = &tariffTotal{}
+			today.Tariffs[w.Name] = total
+		}
+		total.Wh += wh
+		total.Value += wh / 1000 * w.Price
+	}
+	updateTariffMetrics(r.Time, today.Tariffs)
+	dayMu.Unlock()
+}
+
+// rollover starts a new day if now belongs to a later day than the current
+// totals and returns the finished report, nil otherwise.
+func rollover(now time.Time) *dailyReport {
+	day := siteDay(now)
+
+	dayMu.Lock()
+	defer dayMu.Unlock()
+	if day <= today.Day {
+		return nil
+	}
+	finished := today
+	updateHourlyMetrics(finished, now, true)
+	today = newDailyReport(day)
+	enecWhCurrentHour.Reset()
+	updateTariffMetrics(now, today.Tariffs)
+	enecGaps.Reset()
+	enecGapSeconds.Reset()
+	enecAvailability.Reset()
+	enecClippingToday.Reset()
+	return finished
+}
+
+// watchRollover closes the day even when no inverter reports around
+// midnight. It never returns.
+func watchRollover() {
+	for now := range time.Tick(time.Minute) {
+		if finished := rollover(now); finished != nil {
+			publishReport(finished)
+		}
+		dayMu.Lock()
+		updateTariffMetrics(now, today.Tariffs)
+		updateHourlyMetrics(today, now, false)
+		dayMu.Unlock()
+	}
+}
+
+// rounded returns a copy of the report with the energies rounded to the
+// configured Wh precision.
+func (report *dailyReport) rounded() *dailyReport {
+	out := *report
+	out.TotalWh = roundValue("wh", report.TotalWh)
+	out.Inverters = map[string]float64{}
+	for id, wh := range report.Inverters {
+		out.Inverters[id] = roundValue("wh", wh)
+	}
+	out.Tariffs = map[string]*tariffTotal{}
+	for name, total := range report.Tariffs {
+		out.Tariffs[name] = &tariffTotal{Wh: roundValue("wh", total.Wh), Value: total.Value}
+	}
+	out.EstimatedWh = roundValue("wh", report.EstimatedWh)
+	out.Gaps = map[string]*gapTotal{}
+	for id, g := range report.Gaps {
+		gap := *g
+		gap.EstimatedWh = roundValue("wh", g.EstimatedWh)
+		out.Gaps[id] = &gap
+	}
+	out.Hours = map[string][]float64{}
+	for id, hours := range report.Hours {
+		rounded := make([]float64, len(hours))
+		for i, wh := range hours {
+			rounded[i] = roundValue("wh", wh)
+		}
+		out.Hours[id] = rounded
+	}
+	out.Clipping = map[string]float64{}
+	for id, seconds := range report.Clipping {
+		out.Clipping[id] = math.Round(seconds)
+	}
+	return &out
+}
+
+func publishReport(report *dailyReport) {
+	payload, err := json.Marshal(report.rounded())
+	if err != nil {
+		logger.Errorf("Couldn't encode daily report: %s", err)
+		return
+	}
+	fmt.Println("Daily report:", string(payload))
+	publishMqtt(reportTopic, string(payload))
+
+	if dir := currentConfig().ReportDir; dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			logger.Errorf("Couldn't create report directory: %s", err)
+			return
+		}
+		path := filepath.Join(dir, report.Day+".json")
+		if err := ioutil.WriteFile(path, payload, 0644); err != nil {
+			logger.Errorf("Couldn't write daily report: %s", err)
+		}
+	}
+}
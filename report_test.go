@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRolloverInterleaved feeds readings of two inverters across midnight,
+// the one of the second inverter from before midnight recorded last.
+func TestRolloverInterleaved(t *testing.T) {
+	dir := t.TempDir()
+	c := defaultConfig()
+	c.ReportDir = dir
+	setConfig(c)
+	defer setConfig(defaultConfig())
+
+	midnight := time.Date(2026, 6, 2, 0, 0, 0, 0, time.Local)
+	dayMu.Lock()
+	saved := today
+	today = newDailyReport("2026-06-01")
+	dayMu.Unlock()
+	defer func() {
+		dayMu.Lock()
+		today = saved
+		dayMu.Unlock()
+	}()
+
+	at := func(id string, t time.Time, lifeWh float64) reading {
+		return reading{ID: id, Time: t, LifeWh: lifeWh}
+	}
+	a, b := "00100000", "00100001"
+	accountEnergy(at(a, midnight.Add(-10*time.Minute), 1000), at(a, midnight.Add(-time.Second), 1100))
+	accountEnergy(at(a, midnight.Add(-time.Second), 1100), at(a, midnight.Add(time.Second), 1150))
+	accountEnergy(at(b, midnight.Add(-10*time.Minute), 2000), at(b, midnight.Add(-time.Second), 2080))
+	accountReport(b, "", midnight.Add(-time.Second), false, 0)
+
+	dayMu.Lock()
+	day, total := today.Day, today.TotalWh
+	dayMu.Unlock()
+	if day != "2026-06-02" || total != 50 {
+		t.Errorf("today is %s with %g Wh, want 2026-06-02 with 50 Wh", day, total)
+	}
+
+	var finished dailyReport
+	payload, err := ioutil.ReadFile(filepath.Join(dir, "2026-06-01.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(payload, &finished); err != nil {
+		t.Fatal(err)
+	}
+	if finished.Inverters[a] != 100 || finished.TotalWh != 100 {
+		t.Errorf("report of 2026-06-01 has %g Wh, %g Wh of %s, want 100 Wh", finished.TotalWh, finished.Inverters[a], a)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2026-06-02.json")); !os.IsNotExist(err) {
+		t.Errorf("report of the current day written: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Sampled frame logging. With logSampleEvery set to N every Nth decoded
+// telegram is logged in full - the line, the payload, every decoded value
+// and why values failed validation - as one block, so decoding can be
+// watched on a running exporter without the volume of debug logging:
+//
+//	logSampleEvery: 1000
+//
+// 0 (the default) logs none. The setting takes effect on a config reload.
+
+// decoded telegrams counted for sampling
+var sampledFrames uint64
+
+// sampleFrame logs r, decoded from the gateway line message, if it's the
+// Nth telegram.
+func sampleFrame(message, gateway string, r reading) {
+	every := currentConfig().LogSampleEvery
+	if every <= 0 {
+		return
+	}
+	n := atomic.AddUint64(&sampledFrames, 1)
+	if n%uint64(every) != 0 {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Sample of telegram %d from %s", n, gateway)
+	if r.Site != "" {
+		fmt.Fprintf(&b, " (site %s)", r.Site)
+	}
+	fmt.Fprintf(&b, " received %s\n", r.Time.Format(historyTimeFormat))
+	fmt.Fprintf(&b, "  line:  %s\n", message)
+	fmt.Fprintf(&b, "  hex:   %s\n", r.Hex)
+	fmt.Fprintf(&b, "  id:    %s  pan: %s", r.ID, r.PAN)
+	if r.Trace != "" {
+		fmt.Fprintf(&b, "  trace: %s", r.Trace)
+	}
+	b.WriteString("\n")
+	for _, f := range fields {
+		fmt.Fprintf(&b, "  %-12s %g", f.label+":", f.value(&r))
+		if reason, invalid := r.Invalid[f.topic]; invalid {
+			fmt.Fprintf(&b, "  (invalid: %s)", reason)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Print(b.String())
+}
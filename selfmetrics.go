@@ -0,0 +1,55 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Self-metrics for alerting on the data path: connections accepted per
+// listener, gateway lines received per site and frame type, and telegrams
+// decoded. Together with enecsys_decode_errors_total (decodeerrors.go) and
+// enecsys_mqtt_published_total and enecsys_mqtt_dropped_total (mqtt.go)
+// they tell a gateway that stopped sending apart from decoding or
+// publishing that started failing, e.g.
+//
+//	rate(enecsys_frames_received_total{type="WS"}[15m]) == 0
+//	rate(enecsys_decode_errors_total[15m]) > 0.1 * sum by (site) (rate(enecsys_frames_received_total{type="WS"}[15m]))
+
+var (
+	enecConnectionsAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_connections_accepted_total",
+		Help: "Gateway connections accepted by the listener.",
+	},
+		[]string{"listener"},
+	)
+	enecFramesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_frames_received_total",
+		Help: "Gateway lines received, by site and frame type (the telegram code, e.g. WS, or other).",
+	},
+		[]string{"site", "type"},
+	)
+	enecFramesDecoded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_frames_decoded_total",
+		Help: "Telegrams decoded into a reading, by site and frame type.",
+	},
+		[]string{"site", "type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(enecConnectionsAccepted)
+	prometheus.MustRegister(enecFramesReceived)
+	prometheus.MustRegister(enecFramesDecoded)
+}
+
+// frameType returns the telegram code of a gateway line, the two letters
+// before the "=" following the 18 character header, or "other".
+func frameType(message string) string {
+	if len(message) < 21 || message[20] != '=' {
+		return "other"
+	}
+	code := message[18:20]
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return "other"
+		}
+	}
+	return code
+}
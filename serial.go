@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Serial numbers of inverters without a serial in the site file are
+// derived from their Zigbee ID, by the strategy serialFormat names (default
+// decimal). Production batches differ, so the site file can override it
+// per inverter with serialFormat:
+//
+//	decimal   the ID as decimal number
+//	reversed  the ID in reversed byte order as decimal number
+//	hex       the ID as 8 lowercase hex digits
+//
+// Anything else is a template of the placeholders {decimal}, {reversed},
+// {hex}, {batch} (the first byte of the ID as decimal number) and {unit}
+// (the other three bytes as decimal number), e.g. "12{unit}" or
+// "{batch}-{unit}". decode -serial-format shows the serials of a strategy,
+// to find the one matching the labels.
+
+var serialStrategies = map[string]string{
+	"decimal":  "{decimal}",
+	"reversed": "{reversed}",
+	"hex":      "{hex}",
+}
+
+// checkSerialFormat returns an error unless format names a strategy or is
+// a template of known placeholders.
+func checkSerialFormat(format string) error {
+	if format == "" || serialStrategies[format] != "" {
+		return nil
+	}
+	placeholders := topicPlaceholder.FindAllString(format, -1)
+	if len(placeholders) == 0 {
+		return fmt.Errorf("serialFormat: expected decimal, reversed, hex or a template, got %q", format)
+	}
+	for _, p := range placeholders {
+		switch p {
+		case "{decimal}", "{reversed}", "{hex}", "{batch}", "{unit}":
+		default:
+			return fmt.Errorf("serialFormat: unknown placeholder %s", p)
+		}
+	}
+	return nil
+}
+
+// deriveSerial returns the serial of inverter id by format, or by
+// serialFormat if format is empty.
+func deriveSerial(id, format string) string {
+	if format == "" {
+		format = currentConfig().SerialFormat
+	}
+	if format == "" {
+		format = "decimal"
+	}
+	if template, ok := serialStrategies[format]; ok {
+		format = template
+	}
+	hexID, err := telegramID(id)
+	if err != nil {
+		return ""
+	}
+	v, err := strconv.ParseUint(hexID, 16, 32)
+	if err != nil {
+		return ""
+	}
+	reversed, _ := strconv.ParseUint(reverseHexBytes(hexID), 16, 32)
+	values := map[string]string{
+		"decimal":  strconv.FormatUint(v, 10),
+		"reversed": strconv.FormatUint(reversed, 10),
+		"hex":      strings.ToLower(hexID),
+		"batch":    strconv.FormatUint(v>>24, 10),
+		"unit":     strconv.FormatUint(v&0xffffff, 10),
+	}
+	return topicPlaceholder.ReplaceAllStringFunc(format, func(p string) string {
+		return values[p[1:len(p)-1]]
+	})
+}
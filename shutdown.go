@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Graceful shutdown. On SIGINT or SIGTERM the exporter
+//
+//  1. stops accepting gateway connections and lines: the listeners are
+//     closed, connected gateways are cut off after their current line and
+//     the other inputs' lines dropped
+//  2. records the readings still queued (see ordering.go)
+//  3. closes the history and capture files and saves the stateFile
+//  4. pushes the pending remote_write samples once more
+//  5. publishes the queued MQTT messages and the offline bridge state and
+//     disconnects cleanly, so the broker doesn't send the last will
+//  6. shuts down the HTTP servers, letting running requests finish
+//
+// and exits. Steps 2, 4, 5 and 6 wait until shutdownTimeout (default 10s)
+// in total at most; a second signal exits right away.
+
+var (
+	// 1 once shutting down
+	stopping int32
+
+	shutdownMu    sync.Mutex
+	openListeners = map[net.Listener]bool{}
+	openConns     = map[net.Conn]bool{}
+	httpServers   []*http.Server
+)
+
+// shuttingDown reports whether the exporter is shutting down.
+func shuttingDown() bool {
+	return atomic.LoadInt32(&stopping) == 1
+}
+
+// trackListener registers a gateway listener to be closed on shutdown.
+func trackListener(listener net.Listener) {
+	shutdownMu.Lock()
+	openListeners[listener] = true
+	shutdownMu.Unlock()
+}
+
+// trackConn registers a gateway connection while it's open.
+func trackConn(conn net.Conn, open bool) {
+	shutdownMu.Lock()
+	if open {
+		openConns[conn] = true
+	} else {
+		delete(openConns, conn)
+	}
+	shutdownMu.Unlock()
+}
+
+// trackServer registers an HTTP server to be shut down.
+func trackServer(server *http.Server) {
+	shutdownMu.Lock()
+	httpServers = append(httpServers, server)
+	shutdownMu.Unlock()
+}
+
+// shutdownOnSignal shuts down on SIGINT or SIGTERM and exits.
+func shutdownOnSignal() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	fmt.Println("Shutting down on", sig)
+	go func() {
+		sig := <-signals
+		logger.Errorf("Exiting on a second %s without finishing the shutdown", sig)
+		os.Exit(1)
+	}()
+	os.Exit(shutdown(time.Now().Add(currentConfig().ShutdownTimeout)))
+}
+
+// shutdown stops the exporter, waiting until deadline at most, and
+// returns the exit code.
+func shutdown(deadline time.Time) int {
+	cfg := currentConfig()
+	atomic.StoreInt32(&stopping, 1)
+	shutdownMu.Lock()
+	for listener := range openListeners {
+		listener.Close()
+	}
+	// A gateway's current line is delivered before its read fails.
+	for conn := range openConns {
+		conn.SetReadDeadline(time.Now())
+	}
+	shutdownMu.Unlock()
+
+	if !waitUntil(deadline, drainRecordQueues) {
+		logger.Errorf("Timed out recording the queued readings")
+	}
+
+	code := 0
+	historyMu.Lock()
+	closeHistory()
+	historyMu.Unlock()
+	captureMu.Lock()
+	closeCapture()
+	captureMu.Unlock()
+	if path := cfg.StateFile; path != "" {
+		if err := saveSnapshot(path); err != nil {
+			logger.Errorf("Couldn't save state: %s", err)
+			code = 1
+		} else {
+			fmt.Println("State saved")
+		}
+	}
+
+	if cfg.RemoteWriteURL != "" {
+		pushed := waitUntil(deadline, func() {
+			if err := pushOnce(); err != nil {
+				logger.Errorf("Couldn't push the pending samples: %s", err)
+			}
+		})
+		if !pushed {
+			logger.Errorf("Timed out pushing the pending samples")
+		}
+	}
+	if cfg.mqttEnabled() {
+		stopMqtt(deadline)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	shutdownMu.Lock()
+	servers := httpServers
+	shutdownMu.Unlock()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Errorf("Couldn't shut down the HTTP server on %s: %s", server.Addr, err)
+		}
+	}
+	fmt.Println("Shut down")
+	return code
+}
+
+// waitUntil runs fn and reports whether it returned before deadline.
+func waitUntil(deadline time.Time, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
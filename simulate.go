@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The simulate subcommand impersonates a gateway: it connects to an
+// exporter and sends WS telegrams of a number of inverters producing along
+// a half sine between 6:00 and 20:00, for trying out dashboards and sinks
+// without hardware.
+//
+// -dawn reproduces the morning burst: the simulated day starts at 6:00 and
+// every inverter wakes up at a random moment within -wake, spread over
+// -gateways connections. enecsys_mqtt_dropped_total and the queue depth of
+// the exporter show whether it copes, e.g.
+//
+//	enecsys-exporter simulate -dawn -inverters 200 -gateways 4 -wake 1m -interval 5s -count 20
+
+func runSimulate(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	address := flags.String("address", "127.0.0.1:5040", "exporter to send the telegrams to")
+	inverters := flags.Int("inverters", 2, "number of simulated inverters")
+	peak := flags.Float64("watts", 220, "peak DC power per inverter")
+	interval := flags.Duration("interval", 10*time.Second, "time between the telegrams of an inverter")
+	count := flags.Int("count", 0, "telegrams per inverter to send, 0 for no limit")
+	dawn := flags.Bool("dawn", false, "start the simulated day at 6:00 with the inverters waking up")
+	wake := flags.Duration("wake", time.Minute, "window in which the inverters wake up with -dawn")
+	gateways := flags.Int("gateways", 1, "number of gateway connections to spread the inverters over")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s simulate [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 || *inverters < 1 || *gateways < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	conns := make([]net.Conn, *gateways)
+	for g := range conns {
+		conn, err := net.Dial("tcp", *address)
+		if err != nil {
+			fmt.Println("Couldn't connect:", err)
+			return 1
+		}
+		defer conn.Close()
+		conns[g] = conn
+	}
+
+	// The simulated clock runs offset from the real one with -dawn.
+	start := time.Now()
+	offset := time.Duration(0)
+	if *dawn {
+		y, m, d := start.Date()
+		offset = time.Date(y, m, d, 6, 0, 0, 0, start.Location()).Sub(start)
+	}
+
+	lifeWh := make([]float64, *inverters)
+	next := make([]time.Time, *inverters)
+	sent := make([]int, *inverters)
+	for i := range lifeWh {
+		lifeWh[i] = float64(100000 * (i + 1))
+		next[i] = start
+		if *dawn {
+			next[i] = start.Add(time.Duration(rand.Int63n(int64(*wake) + 1)))
+		}
+	}
+	for {
+		// the inverter due first
+		i := -1
+		for j := range next {
+			if (*count == 0 || sent[j] < *count) && (i < 0 || next[j].Before(next[i])) {
+				i = j
+			}
+		}
+		if i < 0 {
+			break
+		}
+		time.Sleep(time.Until(next[i]))
+
+		r := simulatedReading(i, next[i].Add(offset), *peak)
+		lifeWh[i] += r.ACPower * interval.Hours()
+		r.Kwh = math.Floor(lifeWh[i] / 1000)
+		r.Wh = math.Floor(lifeWh[i] - 1000*r.Kwh)
+		line := strings.Repeat("0", 18) + "WS=" + encodeWS(r) + "\r"
+		if _, err := conns[i%len(conns)].Write([]byte(line)); err != nil {
+			fmt.Println("Couldn't send:", err)
+			return 1
+		}
+		if sent[i] == 0 && *dawn {
+			fmt.Println("Inverter", r.ID, "woke up")
+		}
+		sent[i]++
+		next[i] = next[i].Add(*interval)
+	}
+	total := 0
+	for _, n := range sent {
+		total += n
+	}
+	fmt.Println("Sent", total, "telegrams of", len(lifeWh), "inverters")
+	return 0
+}
+
+// simulatedReading returns the reading of the i-th simulated inverter at t.
+func simulatedReading(i int, t time.Time, peak float64) reading {
+	hours := float64(t.Hour()) + float64(t.Minute())/60
+	sun := math.Sin((hours - 6) / 14 * math.Pi)
+	if sun < 0 {
+		sun = 0
+	}
+	r := reading{
+		ID:          fmt.Sprintf("%08x", 0x100000+i),
+		Temperature: 20 + 25*sun,
+		DCPower:     peak * sun * (1 - 0.05*float64(i%3)),
+		Efficiency:  94,
+		ACFreq:      50,
+		ACVolt:      230,
+	}
+	r.DCCurrent = r.DCPower / 32
+	r.ACPower = r.DCPower * r.Efficiency / 100
+	return r
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// The site file holds structured per-installation data that doesn't fit the
+// flat key/value configuration, e.g.
+//
+//	inverters:
+//	  "0f2a91cc":
+//	    name: Garage East 3
+//	    model: SMI-S240W-72
+//	    ratedWatts: 240
+//	    serial: "120100812"
+//	    array: east
+//	    azimuth: -80
+//	    tilt: 35
+//	    energySource: lifetime
+//	    labels:
+//	      roof: garage
+//	arrays:
+//	  east:
+//	    declination: 30
+//	    azimuth: -90
+//	    kwp: 2.4
+//
+// One exporter can serve several named sites. Frames are attributed to a
+// site by the listener or gateway address they arrive from, unless the
+// inverter names its site explicitly. Each site has its own MQTT prefix,
+// time zone, labels (exported via enecsys_site_info), notification targets
+// and API keys for HTTP ingest (see ingest.go):
+//
+//	sites:
+//	  smith:
+//	    listen: ":5050"
+//	    gateways: ["192.0.2.10"]
+//	    mqttPrefix: enecsys/smith
+//	    timeZone: Europe/Berlin
+//	    labels:
+//	      customer: smith
+//	    notify: [smith-phone]
+//	notifiers:
+//	  smith-phone:
+//	    webhook: https://ntfy.sh/smith-roof
+//	notify: [installer]
+//
+// The top-level notify list receives events of inverters without a site.
+// Tariffs are described in tariff.go, notifiers in events.go. The path of
+// the site file is configured with the siteFile key.
+
+type inverterInfo struct {
+	Name         string            `yaml:"name" json:"name,omitempty"`
+	Model        string            `yaml:"model" json:"model,omitempty"`
+	RatedWatts   float64           `yaml:"ratedWatts" json:"ratedWatts,omitempty"`
+	Serial       string            `yaml:"serial" json:"serial,omitempty"`
+	SerialFormat string            `yaml:"serialFormat" json:"-"`
+	Array        string            `yaml:"array" json:"array,omitempty"`
+	Azimuth      *float64          `yaml:"azimuth" json:"azimuth,omitempty"`
+	Tilt         *float64          `yaml:"tilt" json:"tilt,omitempty"`
+	Site         string            `yaml:"site" json:"site,omitempty"`
+	EnergySource string            `yaml:"energySource" json:"energySource,omitempty"`
+	Labels       map[string]string `yaml:"labels" json:"labels,omitempty"`
+}
+
+// arrayInfo describes the orientation of a group of panels. Azimuth follows
+// the Forecast.Solar convention: 0 is south, -90 east and 90 west.
+type arrayInfo struct {
+	Declination float64 `yaml:"declination"`
+	Azimuth     float64 `yaml:"azimuth"`
+	Kwp         float64 `yaml:"kwp"`
+	SolcastSite string  `yaml:"solcastSite"`
+}
+
+type siteInfo struct {
+	Latitude  *float64 `yaml:"latitude"`
+	Longitude *float64 `yaml:"longitude"`
+	// IANA name of the time zone of the notifiers' quiet hours
+	TimeZone   string            `yaml:"timeZone"`
+	Listen     string            `yaml:"listen"`
+	Allow      []string          `yaml:"allow"`
+	Gateways   []string          `yaml:"gateways"`
+	MqttPrefix string            `yaml:"mqttPrefix"`
+	Labels     map[string]string `yaml:"labels"`
+	Notify     []string          `yaml:"notify"`
+	APIKeys    []string          `yaml:"apiKeys"`
+}
+
+type siteConfig struct {
+	Inverters map[string]inverterInfo `yaml:"inverters"`
+	Arrays    map[string]arrayInfo    `yaml:"arrays"`
+	Tariffs   []tariffWindow          `yaml:"tariffs"`
+	Sites     map[string]siteInfo     `yaml:"sites"`
+	Notifiers map[string]notifierInfo `yaml:"notifiers"`
+	Notify    []string                `yaml:"notify"`
+}
+
+var (
+	siteMu sync.RWMutex
+	site   siteConfig
+)
+
+// loadSiteFile parses the site file at path and replaces the active site
+// configuration with it.
+func loadSiteFile(path string) error {
+	osFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer osFile.Close()
+
+	var parsed siteConfig
+	if err := yaml.NewDecoder(osFile).Decode(&parsed); err != nil {
+		return err
+	}
+
+	inverters := make(map[string]inverterInfo, len(parsed.Inverters))
+	for id, info := range parsed.Inverters {
+		canonical, err := normalizeID(id)
+		if err != nil {
+			return err
+		}
+		if _, dup := inverters[canonical]; dup {
+			return fmt.Errorf("inverter %s is listed twice", canonical)
+		}
+		inverters[canonical] = info
+	}
+	parsed.Inverters = inverters
+
+	for i := range parsed.Tariffs {
+		if err := parsed.Tariffs[i].parse(); err != nil {
+			return err
+		}
+	}
+	for id, info := range parsed.Inverters {
+		if _, ok := parsed.Sites[info.Site]; info.Site != "" && !ok {
+			return fmt.Errorf("inverter %s: unknown site %q", id, info.Site)
+		}
+		if err := checkEnergySource(info.EnergySource); err != nil {
+			return fmt.Errorf("inverter %s: %s", id, err)
+		}
+		if err := checkSerialFormat(info.SerialFormat); err != nil {
+			return fmt.Errorf("inverter %s: %s", id, err)
+		}
+		if err := checkLabelNames(info.Labels); err != nil {
+			return fmt.Errorf("inverter %s: %s", id, err)
+		}
+	}
+	keys := map[string]string{}
+	for name, s := range parsed.Sites {
+		if _, err := parseAllowlist(s.Allow); err != nil {
+			return fmt.Errorf("site %s: %s", name, err)
+		}
+		if err := checkLabelNames(s.Labels); err != nil {
+			return fmt.Errorf("site %s: %s", name, err)
+		}
+		if _, ok := s.Labels["site"]; ok {
+			return fmt.Errorf("site %s: label site is reserved", name)
+		}
+		if _, err := time.LoadLocation(s.TimeZone); err != nil {
+			return fmt.Errorf("site %s: timeZone: %s", name, err)
+		}
+		for _, key := range s.APIKeys {
+			if other, dup := keys[key]; dup {
+				return fmt.Errorf("site %s: API key also used by site %s", name, other)
+			}
+			keys[key] = name
+		}
+		for _, target := range s.Notify {
+			if _, ok := parsed.Notifiers[target]; !ok {
+				return fmt.Errorf("site %s: unknown notifier %q", name, target)
+			}
+		}
+	}
+	for _, target := range parsed.Notify {
+		if _, ok := parsed.Notifiers[target]; !ok {
+			return fmt.Errorf("unknown notifier %q", target)
+		}
+	}
+	for name, n := range parsed.Notifiers {
+		if err := n.check(); err != nil {
+			return fmt.Errorf("notifier %s: %s", name, err)
+		}
+	}
+
+	siteMu.Lock()
+	defer siteMu.Unlock()
+	files := siteFileInverters
+	siteFileInverters = parsed.Inverters
+	edited := editedInverters()
+	if err := checkTopicNames(currentConfig().MqttTopicTemplate, edited); err != nil {
+		siteFileInverters = files
+		return fmt.Errorf("mqttTopicTemplate: %s", err)
+	}
+	parsed.Inverters = edited
+	site = parsed
+	return nil
+}
+
+// checkLabelNames returns an error if a key of labels can't be used as a
+// Prometheus label name.
+func checkLabelNames(labels map[string]string) error {
+	for k := range labels {
+		if !model.LabelName(k).IsValid() || strings.HasPrefix(k, "__") {
+			return fmt.Errorf("invalid label name %q", k)
+		}
+	}
+	return nil
+}
+
+// inverter returns the configured metadata for id, with the serial derived
+// from the Zigbee ID when none is configured, see serial.go.
+func inverter(id string) inverterInfo {
+	siteMu.RLock()
+	info := mergeInfo(site.Inverters[id], peerInverters[id])
+	siteMu.RUnlock()
+
+	if info.Serial == "" {
+		info.Serial = deriveSerial(id, info.SerialFormat)
+	}
+	return info
+}
+
+// siteArrays returns a copy of the configured arrays.
+func siteArrays() map[string]arrayInfo {
+	siteMu.RLock()
+	defer siteMu.RUnlock()
+
+	arrays := make(map[string]arrayInfo, len(site.Arrays))
+	for name, a := range site.Arrays {
+		arrays[name] = a
+	}
+	return arrays
+}
+
+// siteByName returns the configured site name, or false if it doesn't
+// exist.
+func siteByName(name string) (siteInfo, bool) {
+	siteMu.RLock()
+	defer siteMu.RUnlock()
+	s, ok := site.Sites[name]
+	return s, ok
+}
+
+// siteTimeZone returns the time zone of siteName, the local one if it has
+// none.
+func siteTimeZone(siteName string) *time.Location {
+	s, _ := siteByName(siteName)
+	if s.TimeZone == "" {
+		return time.Local
+	}
+	zone, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.Local
+	}
+	return zone
+}
+
+// siteListeners returns the listen address of every site that has its own
+// gateway listener.
+func siteListeners() map[string]string {
+	siteMu.RLock()
+	defer siteMu.RUnlock()
+
+	listeners := map[string]string{}
+	for name, s := range site.Sites {
+		if s.Listen != "" {
+			listeners[name] = s.Listen
+		}
+	}
+	return listeners
+}
+
+// siteForGateway returns the site whose gateway list contains the host of
+// address, or "" if there is none.
+func siteForGateway(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	siteMu.RLock()
+	defer siteMu.RUnlock()
+	for name, s := range site.Sites {
+		for _, gateway := range s.Gateways {
+			if gateway == host {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// inverterTopic returns the MQTT topic for name of inverter id, laid out
+// by mqttTopicTemplate (default {prefix}/{inverter}/{metric}). The
+// placeholders are:
+//
+//	{prefix}    the MQTT prefix of the inverter's site, enecsys by default
+//	{site}      the inverter's site, "default" if it has none
+//	{inverter}  the inverter ID
+//	{serial}    the serial number
+//	{name}      the name of the inverter in lower case, characters other
+//	            than letters and digits replaced by _, or its ID without
+//	            a name; names have to be unique then
+//	{metric}    the value or status topic, e.g. acpower or availability
+func inverterTopic(id, name string) string {
+	siteName := inverterSite(id)
+	prefix := "enecsys"
+	if s, ok := siteByName(siteName); ok && s.MqttPrefix != "" {
+		prefix = s.MqttPrefix
+	}
+	if siteName == "" {
+		siteName = "default"
+	}
+	template := currentConfig().MqttTopicTemplate
+	values := map[string]string{"prefix": prefix, "site": siteName, "inverter": id, "metric": name}
+	if strings.Contains(template, "{serial}") {
+		values["serial"] = inverter(id).Serial
+	}
+	if strings.Contains(template, "{name}") {
+		values["name"] = topicName(id)
+	}
+	return topicPlaceholder.ReplaceAllStringFunc(template, func(p string) string {
+		return values[p[1:len(p)-1]]
+	})
+}
+
+const defaultTopicTemplate = "{prefix}/{inverter}/{metric}"
+
+// topicName returns the name of inverter id for topics.
+func topicName(id string) string {
+	return formatTopicName(id, inverter(id).Name)
+}
+
+func formatTopicName(id, name string) string {
+	if name == "" {
+		return id
+	}
+	return strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			return c
+		}
+		return '_'
+	}, strings.ToLower(name))
+}
+
+// checkTopicNames returns an error if two of inverters have the same topic
+// name while template uses {name}, they would publish to the same topics.
+func checkTopicNames(template string, inverters map[string]inverterInfo) error {
+	if !strings.Contains(template, "{name}") {
+		return nil
+	}
+	ids := make([]string, 0, len(inverters))
+	for id := range inverters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	owners := map[string]string{}
+	for _, id := range ids {
+		name := formatTopicName(id, inverters[id].Name)
+		if other, dup := owners[name]; dup {
+			return fmt.Errorf("inverters %s and %s have the same topic name %q", other, id, name)
+		}
+		owners[name] = id
+	}
+	return nil
+}
+
+var topicPlaceholder = regexp.MustCompile(`\{[a-z]+\}`)
+
+// checkTopicTemplate validates an mqttTopicTemplate: it must tell the
+// inverters and their topics apart and use known placeholders only.
+func checkTopicTemplate(template string) error {
+	for _, p := range topicPlaceholder.FindAllString(template, -1) {
+		switch p {
+		case "{prefix}", "{site}", "{inverter}", "{serial}", "{name}", "{metric}":
+		default:
+			return fmt.Errorf("unknown placeholder %s", p)
+		}
+	}
+	if !strings.Contains(template, "{metric}") {
+		return fmt.Errorf("{metric} missing")
+	}
+	if !strings.Contains(template, "{inverter}") && !strings.Contains(template, "{serial}") && !strings.Contains(template, "{name}") {
+		return fmt.Errorf("{inverter}, {serial} or {name} missing")
+	}
+	if strings.ContainsAny(topicPlaceholder.ReplaceAllString(template, ""), "+#") {
+		return fmt.Errorf("wildcards aren't allowed in topics")
+	}
+	return nil
+}
+
+type inverterMeta struct {
+	ID string `json:"id"`
+	inverterInfo
+}
+
+// publishMeta publishes the metadata of inverter id to its retained meta
+// topic, and its Home Assistant discovery config if enabled.
+func publishMeta(id string) {
+	info := inverter(id)
+	info.Site = inverterSite(id)
+	payload, err := json.Marshal(inverterMeta{ID: id, inverterInfo: info})
+	if err != nil {
+		logger.Errorf("Couldn't encode metadata for %s: %s", id, err)
+		return
+	}
+	publishRetained(inverterTopic(id, "meta"), string(payload))
+	publishDiscovery(id)
+}
+
+// siteInfoCollector exports enecsys_site_info with the configured labels of
+// every site. The label names differ per site, so the collector is
+// unchecked.
+type siteInfoCollector struct{}
+
+func (siteInfoCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (siteInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	siteMu.RLock()
+	defer siteMu.RUnlock()
+
+	for name, s := range site.Sites {
+		labels := prometheus.Labels{}
+		for k, v := range s.Labels {
+			labels[k] = v
+		}
+		labels["site"] = name
+		desc := prometheus.NewDesc("enecsys_site_info", "Labels of the configured sites.", nil, labels)
+		m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, 1)
+		if err != nil {
+			m = prometheus.NewInvalidMetric(desc, err)
+		}
+		ch <- m
+	}
+}
+
+// siteConfigCollector exports the configured capacity and composition of
+// every site with at least one inverter in the site file, as
+// enecsys_site_config_info{site,kwp,inverters,groups,latitude,longitude}
+// and enecsys_group_config_info{site,group,kwp,inverters,declination,azimuth}.
+// The capacity is the sum of the kwp of the site's arrays, or of the rated
+// power of its inverters where their array has no kwp. The kwp of an array
+// whose inverters belong to several sites is split between them by their
+// number of inverters. groups lists the
+// arrays with their number of inverters, e.g. "east:6,west:4".
+type siteConfigCollector struct{}
+
+var (
+	siteConfigDesc = prometheus.NewDesc("enecsys_site_config_info",
+		"Capacity, inverter count, groups and coordinates of the site as configured.",
+		[]string{"site", "kwp", "inverters", "groups", "latitude", "longitude"}, nil)
+	groupConfigDesc = prometheus.NewDesc("enecsys_group_config_info",
+		"Capacity, inverter count and orientation of the group (array) as configured.",
+		[]string{"site", "group", "kwp", "inverters", "declination", "azimuth"}, nil)
+)
+
+func (siteConfigCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- siteConfigDesc
+	ch <- groupConfigDesc
+}
+
+func (siteConfigCollector) Collect(ch chan<- prometheus.Metric) {
+	type group struct{ site, name string }
+	inverters := map[string]int{}
+	groupInverters := map[group]int{}
+	arrayInverters := map[string]int{}
+	ratedKwp := map[group]float64{}
+
+	siteMu.RLock()
+	for _, info := range site.Inverters {
+		inverters[info.Site]++
+		g := group{info.Site, info.Array}
+		groupInverters[g]++
+		arrayInverters[info.Array]++
+		ratedKwp[g] += info.RatedWatts / 1000
+	}
+	arrays := site.Arrays
+	siteMu.RUnlock()
+
+	kwp := map[string]float64{}
+	groups := map[string][]string{}
+	for g, n := range groupInverters {
+		capacity := ratedKwp[g]
+		if a, ok := arrays[g.name]; ok && a.Kwp > 0 {
+			capacity = a.Kwp * float64(n) / float64(arrayInverters[g.name])
+		}
+		kwp[g.site] += capacity
+		if g.name == "" {
+			continue
+		}
+		groups[g.site] = append(groups[g.site], fmt.Sprintf("%s:%d", g.name, n))
+		var declination, azimuth string
+		if a, ok := arrays[g.name]; ok {
+			declination, azimuth = formatFloat(a.Declination), formatFloat(a.Azimuth)
+		}
+		ch <- prometheus.MustNewConstMetric(groupConfigDesc, prometheus.GaugeValue, 1, g.site, g.name,
+			formatFloat(capacity), strconv.Itoa(n), declination, azimuth)
+	}
+
+	for siteName, n := range inverters {
+		sort.Strings(groups[siteName])
+		var lat, lon string
+		if la, lo, ok := siteLocation(siteName); ok {
+			lat, lon = formatFloat(la), formatFloat(lo)
+		}
+		ch <- prometheus.MustNewConstMetric(siteConfigDesc, prometheus.GaugeValue, 1, siteName,
+			formatFloat(kwp[siteName]), strconv.Itoa(n), strings.Join(groups[siteName], ","), lat, lon)
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func init() {
+	prometheus.MustRegister(siteInfoCollector{})
+	prometheus.MustRegister(siteConfigCollector{})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+)
+
+// Live reload of the site file. The file is checked for modifications every
+// siteFileInterval (default 10s). Renamed or relabelled inverters apply to
+// the next sample right away: their metadata is re-published, and series of
+// inverters that moved to another site are deleted so they reappear under
+// the new site label.
+
+func watchSiteFile(path string, interval time.Duration) {
+	var modified time.Time
+	if info, err := os.Stat(path); err == nil {
+		modified = info.ModTime()
+	}
+
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modified) {
+			continue
+		}
+		modified = info.ModTime()
+		reloadSiteFile(path)
+	}
+}
+
+// reloadSiteFile loads the site file again and applies the changes to known
+// inverters. The previous configuration stays active if the file is
+// invalid.
+func reloadSiteFile(path string) {
+	type known struct {
+		info     inverterInfo
+		siteName string
+	}
+	before := map[string]known{}
+	for _, id := range knownInverters() {
+		before[id] = known{inverter(id), inverterSite(id)}
+	}
+
+	if err := loadSiteFile(path); err != nil {
+		logger.Errorf("Couldn't reload site file, keeping the previous one: %s", err)
+		return
+	}
+	fmt.Println("Reloaded site file", path)
+
+	for id, old := range before {
+		info, siteName := inverter(id), inverterSite(id)
+		if siteName != old.siteName {
+			deleteInverterSeries(id, old.siteName)
+			enecLastReport.DeleteLabelValues(id, old.siteName)
+		}
+		if siteName != old.siteName || !reflect.DeepEqual(info, old.info) {
+			publishMeta(id)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Deep sleep for hosts running on battery or solar power. With sleepAfter
+// set the exporter goes to sleep once no telegram arrived for that long, or
+// for a minute after sunset at the configured location. While asleep the
+// history and capture flush and the forecast refresh run sleepSlowdown
+// (default 10) times less often; the buffers are flushed when falling
+// asleep. The first telegram wakes everything up instantly. With
+// sleepStatus set, "sleeping" and "awake" are published to enecsys/sleep.
+
+const sleepTopic = "enecsys/sleep"
+
+var (
+	sleepMu       sync.Mutex
+	sleeping      bool
+	lastTelegram  = time.Now()
+	wakeRequested = make(chan struct{})
+
+	enecSleeping = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "enecsys_sleeping",
+		Help: "1 while the exporter is in deep sleep.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(enecSleeping)
+}
+
+// markTelegram records a telegram arriving at t and wakes the exporter up.
+func markTelegram(t time.Time) {
+	sleepMu.Lock()
+	lastTelegram = t
+	wasSleeping := sleeping
+	if sleeping {
+		sleeping = false
+		close(wakeRequested)
+	}
+	sleepMu.Unlock()
+
+	if wasSleeping {
+		fmt.Println("Waking up on the first telegram")
+		enecSleeping.Set(0)
+		if currentConfig().SleepStatus {
+			publishMqtt(sleepTopic, "awake")
+		}
+	}
+}
+
+// sleepState returns whether the exporter is asleep and, if so, a channel
+// closed on waking up.
+func sleepState() (bool, <-chan struct{}) {
+	sleepMu.Lock()
+	defer sleepMu.Unlock()
+	if !sleeping {
+		return false, nil
+	}
+	return true, wakeRequested
+}
+
+// watchSleep puts the exporter to sleep when it's quiet. It never returns.
+func watchSleep(after time.Duration) {
+	for now := range time.Tick(time.Minute) {
+		sleepMu.Lock()
+		quiet := now.Sub(lastTelegram)
+		if sleeping {
+			sleepMu.Unlock()
+			continue
+		}
+		daylight, known := isDaylight("", now)
+		if quiet < after && (!known || daylight || quiet < time.Minute) {
+			sleepMu.Unlock()
+			continue
+		}
+		sleeping = true
+		wakeRequested = make(chan struct{})
+		sleepMu.Unlock()
+
+		fmt.Println("Going to sleep, no telegram for", quiet.Round(time.Second))
+		enecSleeping.Set(1)
+		historyMu.Lock()
+		flushHistory()
+		historyMu.Unlock()
+		captureMu.Lock()
+		if captureWriter != nil {
+			captureWriter.Flush()
+		}
+		captureMu.Unlock()
+		if currentConfig().SleepStatus {
+			publishMqtt(sleepTopic, "sleeping")
+		}
+	}
+}
+
+// sleepyTick is like time.Tick, but ticks sleepSlowdown times less often
+// while asleep and right away on waking up.
+func sleepyTick(d time.Duration) <-chan time.Time {
+	ticks := make(chan time.Time, 1)
+	go func() {
+		for {
+			asleep, wake := sleepState()
+			wait := d
+			if asleep {
+				wait = d * time.Duration(currentConfig().SleepSlowdown)
+			}
+			timer := time.NewTimer(wait)
+			var now time.Time
+			select {
+			case now = <-timer.C:
+			case <-wake:
+				timer.Stop()
+				now = time.Now()
+			}
+			select {
+			case ticks <- now:
+			default:
+			}
+		}
+	}()
+	return ticks
+}
+
+func startSleep() {
+	cfg := currentConfig()
+	if cfg.SleepAfter > 0 {
+		go watchSleep(cfg.SleepAfter)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Runtime state survives restarts and upgrades through a versioned snapshot
+// file (stateFile key). It is written periodically and on shutdown and
+// restored on startup, so the day totals keep counting and the first reading
+// after a restart still credits the energy produced while the exporter was
+// down.
+
+const snapshotVersion = 1
+
+type snapshotInverter struct {
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	LastReading time.Time `json:"lastReading"`
+	Wh          float64   `json:"wh"`
+	LifeWh      float64   `json:"lifeWh"`
+	// site the latest reading was exported with
+	Site string `json:"site,omitempty"`
+	// baseline and power integration of the day, see energysource.go
+	Energy *energyDay `json:"energy,omitempty"`
+}
+
+type snapshot struct {
+	Version   int                         `json:"version"`
+	SavedAt   time.Time                   `json:"savedAt"`
+	Today     *dailyReport                `json:"today"`
+	Inverters map[string]snapshotInverter `json:"inverters"`
+	// see replacement.go
+	Replacements []replacement `json:"replacements,omitempty"`
+	// see inverteredits.go
+	InverterEdits map[string]inverterEdit `json:"inverterEdits,omitempty"`
+}
+
+func takeSnapshot() snapshot {
+	snap := snapshot{Version: snapshotVersion, SavedAt: time.Now(), Inverters: map[string]snapshotInverter{}}
+
+	dayMu.Lock()
+	// Copy the maps, the snapshot is encoded without holding the lock.
+	raw, _ := json.Marshal(today)
+	dayMu.Unlock()
+	json.Unmarshal(raw, &snap.Today)
+
+	for _, s := range allStates() {
+		if s.LastSeen.IsZero() && !s.HasReading {
+			continue
+		}
+		inv := snapshotInverter{FirstSeen: s.FirstSeen, LastSeen: s.LastSeen}
+		if s.HasReading {
+			inv.LastReading = s.Reading.Time
+			inv.Wh = s.Reading.Wh
+			inv.LifeWh = s.Reading.LifeWh
+			inv.Site = s.Reading.Site
+		}
+		inv.Energy = energyDayOf(s.ID)
+		snap.Inverters[s.ID] = inv
+	}
+	snap.Replacements = allReplacements()
+	snap.InverterEdits = allInverterEdits()
+
+	return snap
+}
+
+// saveSnapshot atomically replaces path with the current state.
+func saveSnapshot(path string) error {
+	payload, err := json.MarshalIndent(takeSnapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".enecsys-state-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// restoreSnapshot loads the state saved at path. Inverters start out
+// offline and come online with their first reading.
+func restoreSnapshot(path string) error {
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return applySnapshot(path, payload)
+}
+
+// applySnapshot replaces the runtime state with the encoded snapshot read
+// from source.
+func applySnapshot(source string, payload []byte) error {
+	var snap snapshot
+	if err := json.Unmarshal(payload, &snap); err != nil {
+		return err
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("%s has version %d, expected %d", source, snap.Version, snapshotVersion)
+	}
+
+	if snap.Today != nil {
+		if snap.Today.Inverters == nil {
+			snap.Today.Inverters = map[string]float64{}
+		}
+		if snap.Today.Tariffs == nil {
+			snap.Today.Tariffs = map[string]*tariffTotal{}
+		}
+		if snap.Today.Gaps == nil {
+			snap.Today.Gaps = map[string]*gapTotal{}
+		}
+		if snap.Today.Hours == nil {
+			snap.Today.Hours = map[string][]float64{}
+		}
+		if snap.Today.Clipping == nil {
+			snap.Today.Clipping = map[string]float64{}
+		}
+		dayMu.Lock()
+		today = snap.Today
+		dayMu.Unlock()
+	}
+
+	setReplacements(snap.Replacements)
+	setInverterEdits(snap.InverterEdits)
+	for id, inv := range snap.Inverters {
+		inv := inv
+		// snapshots written by older versions carry no site
+		if inv.Site == "" {
+			inv.Site = inverterSite(id)
+		}
+		updateState(id, func(s *inverterState) {
+			s.FirstSeen, s.LastSeen = inv.FirstSeen, inv.LastSeen
+			if !inv.LastReading.IsZero() {
+				s.Reading = reading{ID: id, Site: inv.Site, Time: inv.LastReading, Wh: inv.Wh, LifeWh: inv.LifeWh}
+				s.HasReading = true
+			}
+		})
+		if inv.Energy != nil {
+			restoreEnergyDay(id, *inv.Energy)
+		}
+		if !inv.LastReading.IsZero() {
+			enecLastReport.WithLabelValues(id, inv.Site).Set(float64(inv.LastReading.Unix()))
+		}
+	}
+
+	fmt.Println("Restored state of", len(snap.Inverters), "inverters saved at", snap.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// saveSnapshots writes the state every interval. It's saved once more on
+// shutdown, see shutdown.go.
+func saveSnapshots(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := saveSnapshot(path); err != nil {
+			logger.Errorf("Couldn't save state: %s", err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The state store holds what is known about every inverter right now: its
+// latest reading, when it was first and last seen, the site of the gateway
+// it last reported through and whether it's online. The REST API, the
+// TUI, aggregates, availability and snapshots all read from it instead of
+// keeping state of their own.
+//
+// Every change bumps the store's generation, and each inverter's state
+// remembers the generation of its last change, so readers can tell cheaply
+// whether anything changed since they last looked. Lookups of latest
+// readings and the number of readings older than staleTimeout are
+// exported.
+
+type inverterState struct {
+	ID string
+	// latest reading, valid if HasReading
+	Reading    reading
+	HasReading bool
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	// site of the gateway the inverter last reported through
+	Site   string
+	Online bool
+	// store generation of the last change
+	Generation uint64
+}
+
+var (
+	stateMu         sync.RWMutex
+	states          = map[string]*inverterState{}
+	stateGeneration uint64
+
+	enecStateLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_state_lookups_total",
+		Help: "Lookups of the latest reading of an inverter in the state store, by result (hit, miss).",
+	},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(enecStateLookups)
+	for _, result := range []string{"hit", "miss"} {
+		enecStateLookups.WithLabelValues(result)
+	}
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "enecsys_state_generation",
+		Help: "Changes made to the state store since the start.",
+	}, func() float64 {
+		stateMu.RLock()
+		defer stateMu.RUnlock()
+		return float64(stateGeneration)
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "enecsys_state_stale_readings",
+		Help: "Latest readings in the state store older than staleTimeout.",
+	}, func() float64 {
+		deadline := time.Now().Add(-currentConfig().StaleTimeout)
+		stateMu.RLock()
+		defer stateMu.RUnlock()
+		stale := 0
+		for _, s := range states {
+			if s.HasReading && s.Reading.Time.Before(deadline) {
+				stale++
+			}
+		}
+		return float64(stale)
+	}))
+}
+
+// updateState runs fn on the state of inverter id, created if needed, and
+// bumps its generation. stateMu must not be held.
+func updateState(id string, fn func(s *inverterState)) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := states[id]
+	if s == nil {
+		s = &inverterState{ID: id}
+		states[id] = s
+	}
+	fn(s)
+	stateGeneration++
+	s.Generation = stateGeneration
+}
+
+// storeReading stores r as the latest reading of its inverter.
+func storeReading(r reading) {
+	updateState(r.ID, func(s *inverterState) {
+		s.Reading, s.HasReading = r, true
+	})
+}
+
+// latestReading returns the latest reading of inverter id, if any.
+func latestReading(id string) (reading, bool) {
+	stateMu.RLock()
+	s := states[id]
+	ok := s != nil && s.HasReading
+	var r reading
+	if ok {
+		r = s.Reading
+	}
+	stateMu.RUnlock()
+
+	if ok {
+		enecStateLookups.WithLabelValues("hit").Inc()
+	} else {
+		enecStateLookups.WithLabelValues("miss").Inc()
+	}
+	return r, ok
+}
+
+// stateOf returns a copy of the state of inverter id, if it's known.
+func stateOf(id string) (inverterState, bool) {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	if s := states[id]; s != nil {
+		return *s, true
+	}
+	return inverterState{}, false
+}
+
+// allStates returns a copy of the state of every inverter seen or restored.
+func allStates() []inverterState {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	all := make([]inverterState, 0, len(states))
+	for _, s := range states {
+		all = append(all, *s)
+	}
+	return all
+}
+
+// currentGeneration returns the generation of the store, which changes
+// with every update.
+func currentGeneration() uint64 {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return stateGeneration
+}
+
+// currentReadings returns the latest reading of every inverter that is
+// currently online.
+func currentReadings() []reading {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	current := make([]reading, 0, len(states))
+	for _, s := range states {
+		if s.Online && s.HasReading {
+			current = append(current, s.Reading)
+		}
+	}
+	return current
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GET /api/v1/status tells integrators which optional subsystems are
+// enabled and whether they work, instead of guessing from the config:
+//
+//	{"version":"1.4.0","time":"...","ready":true,"subsystems":{
+//	  "mqtt":{"enabled":true,"healthy":true},
+//	  "history":{"enabled":true,"healthy":false,"error":"open /var/lib/enecsys/history: permission denied"},
+//	  "remoteWrite":{"enabled":false,"healthy":false}, ...}}
+//
+// MQTT and what depends on it (homeAssistant, commands, grid) are healthy
+// while the publishing client is connected to a broker. The history, the
+// captures, remoteWrite, forecast, archive, peers, alertmanager and grafana
+// are healthy unless their last attempt failed, with the error. Features
+// without an outside dependency (tracing, privacy, pprof, stateFile, admin)
+// are healthy when enabled. ready is that of /ready, see health.go.
+
+type subsystemStatus struct {
+	Enabled bool   `json:"enabled"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+type status struct {
+	Version    string                     `json:"version"`
+	Time       time.Time                  `json:"time"`
+	Ready      bool                       `json:"ready"`
+	Subsystems map[string]subsystemStatus `json:"subsystems"`
+}
+
+var (
+	healthMu sync.Mutex
+	// error of the last attempt of a subsystem, "" after a success
+	healthErrors = map[string]string{}
+)
+
+func init() {
+	publicMux.HandleFunc("/api/v1/status", serveStatus)
+}
+
+// reportHealth records the outcome of the last attempt of subsystem name.
+func reportHealth(name string, err error) {
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	healthMu.Lock()
+	healthErrors[name] = message
+	healthMu.Unlock()
+}
+
+// currentStatus returns the status at now.
+func currentStatus(now time.Time) status {
+	cfg := currentConfig()
+	mqttEnabled, connected := cfg.mqttEnabled(), mqttConnected()
+	viaMqtt := func(enabled bool) subsystemStatus {
+		return subsystemStatus{Enabled: enabled, Healthy: enabled && connected}
+	}
+	local := func(enabled bool) subsystemStatus {
+		return subsystemStatus{Enabled: enabled, Healthy: enabled}
+	}
+	healthMu.Lock()
+	reported := func(name string, enabled bool) subsystemStatus {
+		s := subsystemStatus{Enabled: enabled}
+		if enabled {
+			s.Error = healthErrors[name]
+			s.Healthy = s.Error == ""
+		}
+		return s
+	}
+	subsystems := map[string]subsystemStatus{
+		"mqtt":          viaMqtt(mqttEnabled),
+		"homeAssistant": viaMqtt(mqttEnabled && cfg.HomeAssistant),
+		"commands":      viaMqtt(mqttEnabled && cfg.CommandToken != ""),
+		"grid":          viaMqtt(mqttEnabled && cfg.GridTopic != ""),
+		"history":       reported("history", cfg.HistoryDir != ""),
+		"captures":      reported("captures", cfg.CaptureDir != ""),
+		"remoteWrite":   reported("remoteWrite", cfg.RemoteWriteURL != ""),
+		"forecast":      reported("forecast", cfg.ForecastProvider != ""),
+		"archive":       reported("archive", cfg.S3Bucket != ""),
+		"peers":         reported("peers", cfg.Peers != ""),
+		"alertmanager":  reported("alertmanager", cfg.AlertmanagerURL != ""),
+		"grafana":       reported("grafana", cfg.GrafanaURL != ""),
+		"tracing":       local(tracingEnabled()),
+		"privacy":       local(cfg.Privacy),
+		"pprof":         local(cfg.Pprof),
+		"stateFile":     local(cfg.StateFile != ""),
+		"admin":         local(cfg.AdminAddress != ""),
+	}
+	healthMu.Unlock()
+
+	return status{Version: version, Time: now, Ready: checkReadiness(now).Ready, Subsystems: subsystems}
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentStatus(time.Now()))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /api/v1/summary returns the state of the installation in one small
+// document for displays and widgets: the AC power of the online inverters,
+// the energy produced today, this month, this year and in total (the sum
+// of the lifetime counters), the best day and the power and energy today of
+// every group (array). Month, year and best day come from the daily reports
+// in reportDir and are left out without it. site restricts everything to
+// one site:
+//
+//	/api/v1/summary?site=home
+
+type summary struct {
+	Site       string         `json:"site,omitempty"`
+	Time       time.Time      `json:"time"`
+	PowerW     float64        `json:"powerW"`
+	Inverters  int            `json:"inverters"`
+	Online     int            `json:"online"`
+	TodayWh    float64        `json:"todayWh"`
+	MonthWh    *float64       `json:"monthWh,omitempty"`
+	YearWh     *float64       `json:"yearWh,omitempty"`
+	LifetimeWh float64        `json:"lifetimeWh"`
+	BestDay    *summaryDay    `json:"bestDay,omitempty"`
+	Groups     []summaryGroup `json:"groups,omitempty"`
+}
+
+type summaryDay struct {
+	Day string  `json:"day"`
+	Wh  float64 `json:"wh"`
+}
+
+type summaryGroup struct {
+	Site    string  `json:"site,omitempty"`
+	Group   string  `json:"group"`
+	PowerW  float64 `json:"powerW"`
+	TodayWh float64 `json:"todayWh"`
+}
+
+var (
+	// energy per inverter of the finished days in reportDir, which don't
+	// change anymore
+	reportCacheMu sync.Mutex
+	reportCache   = map[string]map[string]float64{}
+)
+
+func init() {
+	publicMux.HandleFunc("/api/v1/summary", serveSummary)
+}
+
+func serveSummary(w http.ResponseWriter, r *http.Request) {
+	siteName := r.URL.Query().Get("site")
+	if siteName != "" {
+		if _, ok := siteByName(siteName); !ok {
+			http.Error(w, "unknown site "+siteName, http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildSummary(siteName, time.Now()))
+}
+
+// buildSummary returns the summary of siteName, of all sites if empty, at
+// now.
+func buildSummary(siteName string, now time.Time) summary {
+	s := summary{Site: siteName, Time: now}
+	in := func(id string) bool { return siteName == "" || inverterSite(id) == siteName }
+
+	type group struct{ site, name string }
+	groups := map[group]*summaryGroup{}
+	groupOf := func(id string) *summaryGroup {
+		array := inverter(id).Array
+		if array == "" {
+			return nil
+		}
+		g := group{inverterSite(id), array}
+		if groups[g] == nil {
+			groups[g] = &summaryGroup{Site: g.site, Group: g.name}
+		}
+		return groups[g]
+	}
+
+	for _, state := range allStates() {
+		if !in(state.ID) || state.LastSeen.IsZero() && !state.HasReading {
+			continue
+		}
+		s.Inverters++
+		if state.HasReading {
+			s.LifetimeWh += state.Reading.LifeWh
+		}
+		if state.Online && state.HasReading {
+			s.Online++
+			s.PowerW += state.Reading.ACPower
+			if g := groupOf(state.ID); g != nil {
+				g.PowerW += state.Reading.ACPower
+			}
+		}
+	}
+
+	dayMu.Lock()
+	day := today.Day
+	todayWh := make(map[string]float64, len(today.Inverters))
+	for id, wh := range today.Inverters {
+		todayWh[id] = wh
+	}
+	dayMu.Unlock()
+	for id, wh := range todayWh {
+		if !in(id) {
+			continue
+		}
+		s.TodayWh += wh
+		if g := groupOf(id); g != nil {
+			g.TodayWh += wh
+		}
+	}
+
+	if dir := currentConfig().ReportDir; dir != "" {
+		var month, year float64
+		best := summaryDay{Day: day, Wh: s.TodayWh}
+		for reportDay, inverters := range finishedReports(dir, day) {
+			var total float64
+			for id, wh := range inverters {
+				if in(id) {
+					total += wh
+				}
+			}
+			if reportDay[:7] == day[:7] {
+				month += total
+			}
+			if reportDay[:4] == day[:4] {
+				year += total
+			}
+			if total > best.Wh || total == best.Wh && reportDay < best.Day {
+				best = summaryDay{Day: reportDay, Wh: total}
+			}
+		}
+		month, year = roundValue("wh", month+s.TodayWh), roundValue("wh", year+s.TodayWh)
+		best.Wh = roundValue("wh", best.Wh)
+		s.MonthWh, s.YearWh, s.BestDay = &month, &year, &best
+	}
+
+	s.PowerW = roundValue("acpower", s.PowerW)
+	s.TodayWh = roundValue("wh", s.TodayWh)
+	s.LifetimeWh = roundValue("wh", s.LifetimeWh)
+	for _, g := range groups {
+		g.PowerW = roundValue("acpower", g.PowerW)
+		g.TodayWh = roundValue("wh", g.TodayWh)
+		s.Groups = append(s.Groups, *g)
+	}
+	sort.Slice(s.Groups, func(i, j int) bool {
+		if s.Groups[i].Site != s.Groups[j].Site {
+			return s.Groups[i].Site < s.Groups[j].Site
+		}
+		return s.Groups[i].Group < s.Groups[j].Group
+	})
+	return s
+}
+
+// finishedReports returns the energy per inverter of the daily reports in
+// dir before day, by day.
+func finishedReports(dir, day string) map[string]map[string]float64 {
+	files, err := filepath.Glob(filepath.Join(dir, "????-??-??.json"))
+	if err != nil {
+		logger.Errorf("Couldn't list daily reports: %s", err)
+		return nil
+	}
+	reportCacheMu.Lock()
+	defer reportCacheMu.Unlock()
+	reports := map[string]map[string]float64{}
+	for _, file := range files {
+		reportDay := strings.TrimSuffix(filepath.Base(file), ".json")
+		if reportDay >= day {
+			continue
+		}
+		inverters, ok := reportCache[reportDay]
+		if !ok {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				logger.Errorf("Couldn't read daily report: %s", err)
+				continue
+			}
+			var report dailyReport
+			if err := json.Unmarshal(data, &report); err != nil {
+				logger.Errorf("Couldn't decode daily report %s: %s", file, err)
+				continue
+			}
+			inverters = report.Inverters
+			reportCache[reportDay] = inverters
+		}
+		reports[reportDay] = inverters
+	}
+	return reports
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Solar position, precise to a fraction of a degree, which is plenty to
+// tell day from night.
+
+// solarElevation returns the elevation of the sun in degrees at t, seen from
+// lat/lon in degrees.
+func solarElevation(t time.Time, lat, lon float64) float64 {
+	rad := math.Pi / 180
+	// days since J2000.0
+	d := float64(t.Unix())/86400 - 10957.5
+
+	g := (357.529 + 0.98560028*d) * rad
+	q := 280.459 + 0.98564736*d
+	l := (q + 1.915*math.Sin(g) + 0.020*math.Sin(2*g)) * rad
+	e := (23.439 - 0.00000036*d) * rad
+
+	ra := math.Atan2(math.Cos(e)*math.Sin(l), math.Cos(l))
+	dec := math.Asin(math.Sin(e) * math.Sin(l))
+	gmst := math.Mod(18.697374558+24.06570982441908*d, 24)
+	ha := (gmst*15+lon)*rad - ra
+
+	lat *= rad
+	return math.Asin(math.Sin(lat)*math.Sin(dec)+math.Cos(lat)*math.Cos(dec)*math.Cos(ha)) / rad
+}
+
+// siteLocation returns the coordinates of siteName, falling back to the
+// global latitude/longitude keys. ok is false if no location is known.
+func siteLocation(siteName string) (lat, lon float64, ok bool) {
+	cfg := currentConfig()
+	if s, found := siteByName(siteName); found && s.Latitude != nil && s.Longitude != nil {
+		return *s.Latitude, *s.Longitude, true
+	}
+	if cfg.Latitude == nil || cfg.Longitude == nil {
+		return 0, 0, false
+	}
+	return *cfg.Latitude, *cfg.Longitude, true
+}
+
+// isDaylight reports whether the sun is up at siteName. known is false if
+// the site has no location.
+func isDaylight(siteName string, t time.Time) (daylight, known bool) {
+	lat, lon, ok := siteLocation(siteName)
+	if !ok {
+		return false, false
+	}
+	return solarElevation(t, lat, lon) > 0, true
+}
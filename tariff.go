@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Tariff schedule from the site file. The first window matching a point in
+// time wins, so seasonal or weekday specific windows go before the general
+// ones:
+//
+//	tariffs:
+//	  - name: peak
+//	    price: 0.32
+//	    from: "07:00"
+//	    to: "21:00"
+//	    days: [mon, tue, wed, thu, fri]
+//	    months: [4, 5, 6, 7, 8, 9]
+//	  - name: offpeak
+//	    price: 0.12
+//
+// A window without from/to covers the whole day, one whose from is later
+// than its to wraps around midnight.
+
+var (
+	enecTariffWh = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_tariff_watthours_today",
+		Help: "Watt hours produced today within the tariff window.",
+	},
+		[]string{"tariff"},
+	)
+	enecTariffValue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_tariff_value_today",
+		Help: "Value of the energy produced today within the tariff window.",
+	},
+		[]string{"tariff"},
+	)
+	enecTariffActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "enecsys_tariff_active",
+		Help: "1 for the tariff window currently in effect, 0 otherwise.",
+	},
+		[]string{"tariff"},
+	)
+
+	weekdays = map[string]time.Weekday{
+		"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+		"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+	}
+)
+
+func init() {
+	prometheus.MustRegister(enecTariffWh)
+	prometheus.MustRegister(enecTariffValue)
+	prometheus.MustRegister(enecTariffActive)
+}
+
+type tariffWindow struct {
+	Name   string   `yaml:"name"`
+	Price  float64  `yaml:"price"`
+	From   string   `yaml:"from"`
+	To     string   `yaml:"to"`
+	Days   []string `yaml:"days"`
+	Months []int    `yaml:"months"`
+
+	from, to int // minutes since midnight
+}
+
+// parse validates the window and converts from/to to minutes.
+func (w *tariffWindow) parse() error {
+	if w.Name == "" {
+		return fmt.Errorf("tariff without name")
+	}
+	var err error
+	if w.from, err = parseClock(w.From, 0); err != nil {
+		return fmt.Errorf("tariff %s: %s", w.Name, err)
+	}
+	if w.to, err = parseClock(w.To, 24*60); err != nil {
+		return fmt.Errorf("tariff %s: %s", w.Name, err)
+	}
+	for _, day := range w.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("tariff %s: unknown day %q", w.Name, day)
+		}
+	}
+	return nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight, def if empty.
+func parseClock(clock string, def int) (int, error) {
+	if clock == "" {
+		return def, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w *tariffWindow) matches(t time.Time) bool {
+	if len(w.Months) > 0 {
+		found := false
+		for _, m := range w.Months {
+			found = found || time.Month(m) == t.Month()
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(w.Days) > 0 {
+		found := false
+		for _, day := range w.Days {
+			found = found || weekdays[strings.ToLower(day)] == t.Weekday()
+		}
+		if !found {
+			return false
+		}
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return minute >= w.from && minute < w.to
+	}
+	return minute >= w.from || minute < w.to
+}
+
+// tariffAt returns the tariff window in effect at t, or nil if there is
+// none.
+func tariffAt(t time.Time) *tariffWindow {
+	siteMu.RLock()
+	defer siteMu.RUnlock()
+
+	for i := range site.Tariffs {
+		if site.Tariffs[i].matches(t) {
+			w := site.Tariffs[i]
+			return &w
+		}
+	}
+	return nil
+}
+
+// updateTariffMetrics exports the tariff totals of the current day.
+func updateTariffMetrics(now time.Time, totals map[string]*tariffTotal) {
+	active := tariffAt(now)
+
+	siteMu.RLock()
+	defer siteMu.RUnlock()
+	for _, w := range site.Tariffs {
+		total := totals[w.Name]
+		if total == nil {
+			total = &tariffTotal{}
+		}
+		enecTariffWh.WithLabelValues(w.Name).Set(total.Wh)
+		enecTariffValue.WithLabelValues(w.Name).Set(total.Value)
+		if active != nil && active.Name == w.Name {
+			enecTariffActive.WithLabelValues(w.Name).Set(1)
+		} else {
+			enecTariffActive.WithLabelValues(w.Name).Set(0)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Publish-on-change and throttling for small brokers. With mqttOnChange
+// set the value of a reading is only published when it differs from the
+// one published last to its topic, as formatted, or for the topic names
+// listed in mqttChangeDeltas by at least the given amount:
+//
+//	mqttChangeDeltas: "acpower=5,dcpower=5,temperature=1"
+//
+// mqttMinInterval publishes to each topic at most once per interval, values
+// of readings in between are left out. Both apply to the state documents
+// of mqttPayload: json as well, which count as changed when any value in it
+// did. After the MQTT client was rebuilt every topic is published again.
+
+type publishedValue struct {
+	value     float64
+	formatted string
+	at        time.Time
+}
+
+var (
+	throttleMu sync.Mutex
+	published  = map[string]publishedValue{}
+
+	// mqttChangeDeltas as parsed last, parsed again when a reload changes it
+	changeDeltasMu     sync.Mutex
+	changeDeltasParsed bool
+	changeDeltasOf     string
+	changeDeltas       map[string]float64
+
+	enecMqttSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_mqtt_suppressed_total",
+		Help: "Values of readings not published to MQTT, by reason (unchanged, throttled).",
+	},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(enecMqttSuppressed)
+	for _, reason := range []string{"unchanged", "throttled"} {
+		enecMqttSuppressed.WithLabelValues(reason)
+	}
+	onMqttRestart(func() {
+		throttleMu.Lock()
+		published = map[string]publishedValue{}
+		throttleMu.Unlock()
+	})
+}
+
+// parseChangeDeltas parses comma separated topic=delta pairs.
+func parseChangeDeltas(value string) (map[string]float64, error) {
+	known := map[string]bool{}
+	for _, f := range fields {
+		known[f.topic] = true
+	}
+	deltas := map[string]float64{}
+	for _, pair := range splitList(value) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid delta %q, expected topic=delta", pair)
+		}
+		name := strings.TrimSpace(kv[0])
+		if !known[name] {
+			return nil, fmt.Errorf("unknown topic %q", name)
+		}
+		d, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid delta %q for %s", kv[1], name)
+		}
+		deltas[name] = d
+	}
+	return deltas, nil
+}
+
+func changeDelta(name string) (float64, bool) {
+	value := currentConfig().MqttChangeDeltas
+	changeDeltasMu.Lock()
+	defer changeDeltasMu.Unlock()
+	if !changeDeltasParsed || value != changeDeltasOf {
+		deltas, err := parseChangeDeltas(value)
+		if err != nil {
+			logger.Errorf("Ignoring mqttChangeDeltas: %s", err)
+		}
+		changeDeltas, changeDeltasOf, changeDeltasParsed = deltas, value, true
+	}
+	d, ok := changeDeltas[name]
+	return d, ok
+}
+
+// shouldPublish reports whether the value of topic name, formatted for
+// publishing, is to be published to topic at t, and if so records it as
+// published.
+func shouldPublish(topic, name string, value float64, formatted string, t time.Time) bool {
+	cfg := currentConfig()
+	if !cfg.MqttOnChange && cfg.MqttMinInterval <= 0 {
+		return true
+	}
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+
+	last, seen := published[topic]
+	if seen && cfg.MqttOnChange {
+		unchanged := formatted == last.formatted
+		if d, ok := changeDelta(name); ok {
+			unchanged = math.Abs(value-last.value) < d
+		}
+		if unchanged {
+			enecMqttSuppressed.WithLabelValues("unchanged").Inc()
+			return false
+		}
+	}
+	if seen && t.Sub(last.at) < cfg.MqttMinInterval {
+		enecMqttSuppressed.WithLabelValues("throttled").Inc()
+		return false
+	}
+	published[topic] = publishedValue{value: value, formatted: formatted, at: t}
+	return true
+}
+
+// shouldPublishState is shouldPublish for the state document of a reading
+// taken at t: it changed if any value but the time did.
+func shouldPublishState(topic string, state map[string]interface{}, t time.Time) bool {
+	cfg := currentConfig()
+	if !cfg.MqttOnChange && cfg.MqttMinInterval <= 0 {
+		return true
+	}
+	values := make(map[string]interface{}, len(state))
+	for k, v := range state {
+		if k != "time" {
+			values[k] = v
+		}
+	}
+	key, _ := json.Marshal(values)
+
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+	last, seen := published[topic]
+	if seen && cfg.MqttOnChange && !stateChanged(last.formatted, values) {
+		enecMqttSuppressed.WithLabelValues("unchanged").Inc()
+		return false
+	}
+	if seen && t.Sub(last.at) < cfg.MqttMinInterval {
+		enecMqttSuppressed.WithLabelValues("throttled").Inc()
+		return false
+	}
+	published[topic] = publishedValue{formatted: string(key), at: t}
+	return true
+}
+
+// stateChanged reports whether any value of state differs from the state
+// published last, encoded as JSON, beyond its change delta.
+func stateChanged(last string, state map[string]interface{}) bool {
+	var previous map[string]interface{}
+	if err := json.Unmarshal([]byte(last), &previous); err != nil || len(previous) != len(state) {
+		return true
+	}
+	for k, v := range state {
+		p, ok := previous[k]
+		if !ok {
+			return true
+		}
+		x, isNumber := v.(float64)
+		y, _ := p.(float64)
+		if !isNumber {
+			if fmt.Sprint(v) != fmt.Sprint(p) {
+				return true
+			}
+			continue
+		}
+		if d, ok := changeDelta(k); ok {
+			if math.Abs(x-y) >= d {
+				return true
+			}
+		} else if x != y {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Frame tracing: with tracing set to true every decoded telegram gets a
+// random trace ID, and the last traceBufferSize (default 10000) frames are
+// kept with their raw line and decoded values. GET /api/v1/traces/<id> on
+// the admin port, protected by the adminToken, returns one of them.
+//
+// The trace IDs are attached as exemplars (trace_id) to
+// enecsys_frame_ac_power_watts and enecsys_energy_produced_watt_hours_total,
+// which are exposed in the OpenMetrics format when tracing is enabled. A
+// Grafana data link to /api/v1/traces/${__value.raw} on the admin port leads
+// from a spike to the frame that caused it.
+
+var (
+	enecFrameACPower = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "enecsys_frame_ac_power_watts",
+		Help:    "AC power reported per frame.",
+		Buckets: []float64{0, 25, 50, 100, 150, 200, 250, 300, 400, 500},
+	}, []string{"site"})
+	enecEnergyProduced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "enecsys_energy_produced_watt_hours_total",
+		Help: "Energy produced as credited to the daily report.",
+	}, []string{"id", "site"})
+)
+
+func init() {
+	prometheus.MustRegister(enecFrameACPower)
+	prometheus.MustRegister(enecEnergyProduced)
+}
+
+type traceEntry struct {
+	TraceID string    `json:"traceId"`
+	Time    time.Time `json:"time"`
+	Gateway string    `json:"gateway"`
+	Site    string    `json:"site"`
+	Line    string    `json:"line"`
+	Reading reading   `json:"reading"`
+}
+
+var (
+	traceMu    sync.Mutex
+	traces     = map[string]*traceEntry{}
+	traceOrder []string
+)
+
+func tracingEnabled() bool {
+	return currentConfig().Tracing
+}
+
+// startTrace assigns a trace ID to r, decoded from line, and keeps the
+// frame for /api/v1/traces. It does nothing unless tracing is enabled.
+func startTrace(r *reading, line, gateway string) {
+	if !tracingEnabled() {
+		return
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		logger.Errorf("Couldn't create trace ID: %s", err)
+		return
+	}
+	r.Trace = hex.EncodeToString(id)
+
+	size := currentConfig().TraceBufferSize
+
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	traces[r.Trace] = &traceEntry{TraceID: r.Trace, Time: r.Time, Gateway: gateway, Site: r.Site, Line: line, Reading: *r}
+	traceOrder = append(traceOrder, r.Trace)
+	for len(traceOrder) > size {
+		delete(traces, traceOrder[0])
+		traceOrder = traceOrder[1:]
+	}
+}
+
+// exemplar returns the exemplar labels of r, nil if it isn't traced.
+func exemplar(r reading) prometheus.Labels {
+	if r.Trace == "" {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": r.Trace}
+}
+
+// observeFrame records the traced metrics of r.
+func observeFrame(r reading) {
+	if !r.valid("acpower") {
+		return
+	}
+	observer := enecFrameACPower.WithLabelValues(r.Site)
+	if labels := exemplar(r); labels != nil {
+		observer.(prometheus.ExemplarObserver).ObserveWithExemplar(r.ACPower, labels)
+	} else {
+		observer.Observe(r.ACPower)
+	}
+}
+
+// countEnergy adds wh produced by r's inverter to
+// enecsys_energy_produced_watt_hours_total.
+func countEnergy(r reading, wh float64) {
+	counter := enecEnergyProduced.WithLabelValues(r.ID, r.Site)
+	if labels := exemplar(r); labels != nil {
+		counter.(prometheus.ExemplarAdder).AddWithExemplar(wh, labels)
+	} else {
+		counter.Add(wh)
+	}
+}
+
+func serveTrace(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/api/v1/traces/")
+
+	traceMu.Lock()
+	entry, ok := traces[id]
+	traceMu.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+func init() {
+	adminMux.HandleFunc("/api/v1/traces/", requireAdminToken(serveTrace))
+}
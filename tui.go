@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juju/loggo"
+)
+
+// With --tui the exporter draws a live table of the inverters to the
+// terminal instead of the trace output, handy when commissioning on site
+// over SSH. The latest log messages are shown below the table.
+
+const tuiLogLines = 5
+
+// tuiLog keeps the last log messages for display.
+type tuiLog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *tuiLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		l.lines = append(l.lines, line)
+	}
+	if len(l.lines) > tuiLogLines {
+		l.lines = l.lines[len(l.lines)-tuiLogLines:]
+	}
+	return len(p), nil
+}
+
+func (l *tuiLog) last() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+// startTUI takes over the terminal. It must be called before anything else
+// writes to stdout.
+func startTUI() {
+	terminal := os.Stdout
+	if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stdout = devNull
+	}
+	messages := &tuiLog{}
+	loggo.ReplaceDefaultWriter(loggo.NewSimpleWriter(messages, loggo.DefaultFormatter))
+
+	go func() {
+		for now := range time.Tick(time.Second) {
+			drawTUI(terminal, now, messages.last())
+		}
+	}()
+}
+
+func drawTUI(out io.Writer, now time.Time, messages []string) {
+	type row struct {
+		name, siteName, status string
+		power, todayKwh, temp  string
+		seen                   time.Duration
+	}
+
+	all := allStates()
+
+	dayMu.Lock()
+	todayWh := make(map[string]float64, len(today.Inverters))
+	for id, wh := range today.Inverters {
+		todayWh[id] = wh
+	}
+	dayMu.Unlock()
+
+	var rows []row
+	for _, s := range all {
+		if s.LastSeen.IsZero() {
+			continue
+		}
+		id := s.ID
+		status := availabilityOffline
+		if s.Online {
+			status = availabilityOnline
+		}
+		name := id
+		if n := inverter(id).Name; n != "" {
+			name = n + " (" + id + ")"
+		}
+		rw := row{name: name, siteName: inverterSite(id), status: status, seen: now.Sub(s.LastSeen),
+			power: "-", temp: "-", todayKwh: fmt.Sprintf("%.3f", todayWh[id]/1000)}
+		if s.HasReading {
+			rw.power = fmt.Sprintf("%.0f", s.Reading.ACPower)
+			rw.temp = fmt.Sprintf("%.0f", s.Reading.Temperature)
+		}
+		rows = append(rows, rw)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].name < rows[j].name })
+
+	// Home the cursor and clear the screen.
+	fmt.Fprint(out, "\033[H\033[2J")
+	fmt.Fprintf(out, "enecsys exporter  %s  %d inverters\n\n", now.Format("2006-01-02 15:04:05"), len(rows))
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INVERTER\tSITE\tPOWER W\tTODAY kWh\tTEMP C\tLAST SEEN\tSTATUS\t")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s ago\t%s\t\n",
+			r.name, r.siteName, r.power, r.todayKwh, r.temp, r.seen.Round(time.Second), r.status)
+	}
+	tw.Flush()
+	if len(messages) > 0 {
+		fmt.Fprintln(out)
+		for _, m := range messages {
+			fmt.Fprintln(out, m)
+		}
+	}
+}
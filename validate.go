@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Bounds and consistency checks for decoded readings. By default values
+// failing a check are dropped individually and the metrics keep their
+// previous value. With strictParse: "true" any failing check rejects the
+// whole telegram, so half-garbage frames never mix valid and impossible
+// values in metrics or stored history.
+
+const (
+	// used when the inverter's rated power isn't configured
+	defaultMaxDCPower = 1000
+	maxDCCurrent      = 20
+	maxDCVolt         = 100
+)
+
+// validate checks r and records every failing value in r.Invalid, keyed by
+// the field's topic. Derived values are invalid if their inputs are.
+func validate(r *reading) {
+	maxPower := float64(defaultMaxDCPower)
+	if rated := inverter(r.ID).RatedWatts; rated > 0 {
+		maxPower = 1.5 * rated
+	}
+
+	check := func(name string, value, lo, hi float64) {
+		if value < lo || value > hi {
+			r.invalidate(name, fmt.Sprintf("%g outside %g..%g", value, lo, hi))
+		}
+	}
+	check("temperature", r.Temperature, -40, 120)
+	check("wh", r.Wh, 0, 999)
+	check("dcpower", r.DCPower, 0, maxPower)
+	check("dccurrent", r.DCCurrent, 0, maxDCCurrent)
+	check("dcvolt", r.DCVolt, 0, maxDCVolt)
+	check("efficiency", r.Efficiency, 0, 100)
+	check("acvolt", r.ACVolt, 0, 300)
+	if r.ACFreq != 0 {
+		check("acfreq", r.ACFreq, 45, 65)
+	}
+	if r.DCPower > 0 && r.DCCurrent == 0 {
+		r.invalidate("dccurrent", "no current while producing power")
+	}
+	if r.ACPower > 0 && r.ACVolt == 0 {
+		r.invalidate("acvolt", "no voltage while producing power")
+	}
+
+	derived := func(name string, inputs ...string) {
+		for _, input := range inputs {
+			if _, ok := r.Invalid[input]; ok {
+				r.invalidate(name, "depends on invalid "+input)
+				return
+			}
+		}
+	}
+	derived("lifeWh", "wh", "kwh")
+	derived("dcvolt", "dcpower", "dccurrent")
+	derived("acpower", "dcpower", "efficiency")
+	derived("accurrent", "acpower", "acvolt")
+}
+
+func (r *reading) invalidate(name, reason string) {
+	if r.Invalid == nil {
+		r.Invalid = map[string]string{}
+	}
+	if _, ok := r.Invalid[name]; !ok {
+		r.Invalid[name] = reason
+	}
+}
+
+// valid reports whether the value exported under topic passed validation.
+func (r *reading) valid(topic string) bool {
+	_, invalid := r.Invalid[topic]
+	return !invalid
+}
+
+// invalidReasons describes the failed checks of r in a stable order.
+func (r *reading) invalidReasons() string {
+	var reasons []string
+	for name, reason := range r.Invalid {
+		reasons = append(reasons, name+": "+reason)
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, ", ")
+}
+
+// keepPrevious replaces the values that failed validation by those of prev,
+// so site totals and energy accounting continue from the last good values.
+func (r *reading) keepPrevious(prev reading) {
+	for name := range r.Invalid {
+		switch name {
+		case "temperature":
+			r.Temperature = prev.Temperature
+		case "wh":
+			r.Wh = prev.Wh
+		case "kwh":
+			r.Kwh = prev.Kwh
+		case "lifeWh":
+			r.LifeWh, r.LifeKwh = prev.LifeWh, prev.LifeKwh
+		case "time1":
+			r.Time1 = prev.Time1
+		case "time2":
+			r.Time2 = prev.Time2
+		case "dcpower":
+			r.DCPower = prev.DCPower
+		case "dcvolt":
+			r.DCVolt = prev.DCVolt
+		case "dccurrent":
+			r.DCCurrent = prev.DCCurrent
+		case "efficiency":
+			r.Efficiency = prev.Efficiency
+		case "acpower":
+			r.ACPower = prev.ACPower
+		case "acvolt":
+			r.ACVolt = prev.ACVolt
+		case "accurrent":
+			r.ACCurrent = prev.ACCurrent
+		case "acfreq":
+			r.ACFreq = prev.ACFreq
+		}
+	}
+}
+
+// zeroInvalid replaces the values that failed validation by zero, or NaN
+// for values that are undefined anyway when nothing is produced.
+func (r *reading) zeroInvalid() {
+	var prev reading
+	prev.DCVolt, prev.ACCurrent = math.NaN(), math.NaN()
+	r.keepPrevious(prev)
+}